@@ -0,0 +1,105 @@
+// Copyright © 2018 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackzampolin/bsk-idx/indexer"
+	"github.com/spf13/cobra"
+)
+
+// deadLettersCmd represents the deadletters command
+var deadLettersCmd = &cobra.Command{
+	Use:   "deadletters",
+	Short: "List and retry the names the indexer failed to process",
+}
+
+// deadLettersListCmd represents the deadletters list command
+var deadLettersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the dead lettered names with the stage and error they failed with",
+	// Failures here aren't usage mistakes
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := indexer.NewDB(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %s", err)
+		}
+		defer db.Close()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSTAGE\tATTEMPTS\tTIME\tERROR")
+		err = db.EachDeadLetter(context.Background(), func(dl indexer.DeadLetter) error {
+			_, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", dl.Name, dl.Stage, dl.Attempts, dl.Time.Format(time.RFC3339), dl.Error)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list dead letters: %s", err)
+		}
+		return w.Flush()
+	},
+}
+
+// deadLettersRetryCmd represents the deadletters retry command
+var deadLettersRetryCmd = &cobra.Command{
+	Use:          "retry [names...]",
+	Short:        "Retry the passed dead lettered names, or all of them",
+	SilenceUsage: true,
+	// Errors are returned rather than exiting so the database is closed, bolt holds a file lock
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Keep the stats server clear of a running serve process
+		retryCfg := *cfg
+		retryCfg.IDX.StatsPort = 0
+
+		// Names recovered from failed pages are added to the names file, so start from what's in it
+		names := []string{}
+		out, err := ioutil.ReadFile(cfg.IDX.NameFile)
+		if err == nil {
+			err = json.Unmarshal(out, &names)
+		}
+		idx, ierr := indexer.NewIndexer(&retryCfg, names)
+		if ierr != nil {
+			return ierr
+		}
+		defer idx.DB.Close()
+
+		// Stop between names on SIGINT or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		n, rerr := idx.RetryDeadLetters(ctx, args)
+		if err == nil {
+			idx.WriteNamesToFile(cfg.IDX.NameFile)
+		}
+		if rerr != nil {
+			return fmt.Errorf("failed to retry dead letters: %s", rerr)
+		}
+		fmt.Printf("%d dead letters retried successfully\n", n)
+		return nil
+	},
+}
+
+func init() {
+	deadLettersCmd.AddCommand(deadLettersListCmd)
+	deadLettersCmd.AddCommand(deadLettersRetryCmd)
+	rootCmd.AddCommand(deadLettersCmd)
+}
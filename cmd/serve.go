@@ -15,7 +15,11 @@
 package cmd
 
 import (
-	"sync"
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jackzampolin/bsk-idx/indexer"
 	"github.com/spf13/cobra"
@@ -26,11 +30,31 @@ var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "A brief description of your command",
 	Run: func(cmd *cobra.Command, args []string) {
-		idx := indexer.NewIndexer(cfg, []string{})
-		idx.Index()
-		var wg sync.WaitGroup
-		wg.Add(1)
-		wg.Wait()
+		// Deploys send SIGTERM, let the work in flight finish rather than dying mid write
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		idx, err := indexer.NewIndexer(cfg, []string{})
+		if err != nil {
+			log.Fatalf("failed to start indexer: %s", err)
+		}
+		// Serve whatever is already in the database while indexing runs
+		api := indexer.NewAPI(idx, cfg.IDX.APIPort)
+		go api.Listen()
+		idx.Index(ctx)
+		<-ctx.Done()
+		stop()
+
+		log.Printf("shutting down, waiting up to %s for indexing to stop...", idx.Config().ShutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), idx.Config().ShutdownTimeout)
+		defer cancel()
+		if err := api.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down api server: %s", err)
+		}
+		if err := idx.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to close database: %s", err)
+		}
+		log.Println("shutdown complete")
 	},
 }
 
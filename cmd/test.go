@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 
@@ -36,8 +37,11 @@ var testCmd = &cobra.Command{
 		if err != nil {
 			panic(err)
 		}
-		idx := indexer.NewIndexer(cfg, names)
-		idx.GetAllZonefiles()
+		idx, err := indexer.NewIndexer(cfg, names)
+		if err != nil {
+			panic(err)
+		}
+		idx.GetAllZonefiles(context.Background())
 	},
 }
 
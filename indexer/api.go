@@ -0,0 +1,265 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	apiPrefix = "[api]"
+
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+// NewAPI returns an API serving the data held by the indexer
+func NewAPI(idx *Indexer, port int) *API {
+	api := &API{
+		Port: port,
+		idx:  idx,
+		mux:  http.NewServeMux(),
+	}
+	api.server = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: api.mux}
+	api.mux.HandleFunc("/v1/users/", api.handleUser)
+	api.mux.HandleFunc("/v1/search", api.handleSearch)
+	api.mux.HandleFunc("/v1/disagreements", api.handleDisagreements)
+	api.mux.HandleFunc("/healthz", api.handleHealthz)
+	api.mux.HandleFunc("/readyz", api.handleReadyz)
+	return api
+}
+
+// API serves core.blockstack.org compatible endpoints out of the indexer's DB
+type API struct {
+	Port int
+
+	idx    *Indexer
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// Listen starts the API server, it blocks until the server is shut down
+func (api *API) Listen() {
+	log.Printf("%s Listening for requests on port :%d", apiPrefix, api.Port)
+	if err := api.server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops the API server once the requests in flight have been answered or ctx is done
+func (api *API) Shutdown(ctx context.Context) error {
+	return api.server.Shutdown(ctx)
+}
+
+// ServeHTTP implements http.Handler
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+// UserRecord models the per-name return from /v1/users/{username}
+type UserRecord struct {
+	OwnerAddress  string                 `json:"owner_address,omitempty"`
+	Status        string                 `json:"status,omitempty"`
+	Profile       Profile                `json:"profile"`
+	Verifications []interface{}          `json:"verifications"`
+	Zonefile      map[string]interface{} `json:"zone_file,omitempty"`
+}
+
+// handleUser is the handler for /v1/users/{username}
+func (api *API) handleUser(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/users/")
+	if name == "" || strings.Contains(name, "/") {
+		api.writeError(w, http.StatusBadRequest, "invalid username")
+		return
+	}
+	// Expired and revoked names have no profile any more, say why rather than not found
+	nr, nrErr := api.idx.DB.FetchNameRecord(r.Context(), name)
+	if nrErr == nil && !nr.Active() {
+		api.writeJSON(w, http.StatusGone, map[string]string{
+			"error":  fmt.Sprintf("%s is %s", name, nr.Status),
+			"status": nr.Status,
+		})
+		return
+	}
+
+	// Names looked up often are kept fresher
+	api.idx.sched.Hit(name)
+
+	profile, err := api.idx.DB.FetchProfile(r.Context(), name)
+	if err == ErrNotFound {
+		api.writeError(w, http.StatusNotFound, fmt.Sprintf("%s not found", name))
+		return
+	} else if err != nil {
+		log.Printf("%s failed to fetch profile for %s: %s", apiPrefix, name, err)
+		api.writeError(w, http.StatusInternalServerError, "failed to fetch profile")
+		return
+	}
+
+	// Profiles not signed by the name owner could have been uploaded by anyone
+	if !profile.Verified() {
+		api.writeError(w, http.StatusNotFound, fmt.Sprintf("%s has no profile signed by its owner (%s)", name, profile.Verification))
+		return
+	}
+
+	rec := UserRecord{Profile: profile.Profile, Verifications: []interface{}{}}
+
+	// The zonefile and owner are best effort, the profile is what callers need
+	if zf, err := api.idx.DB.FetchZonefile(r.Context(), name); err == nil {
+		rec.Zonefile = zonefileJSON(name, zf)
+	}
+	if nrErr == nil {
+		rec.OwnerAddress = nr.Owner
+		rec.Status = NameActive
+	}
+
+	api.writeJSON(w, http.StatusOK, map[string]UserRecord{name: rec})
+}
+
+// SearchHit models a single result from /v1/search
+type SearchHit struct {
+	FullyQualifiedName string  `json:"fullyQualifiedName"`
+	Username           string  `json:"username"`
+	Profile            Profile `json:"profile"`
+}
+
+// SearchResponse models the return from /v1/search
+type SearchResponse struct {
+	Results []SearchHit `json:"results"`
+	Total   int         `json:"total"`
+	Page    int         `json:"page"`
+}
+
+// handleSearch is the handler for /v1/search?query={query}&page={page}&limit={limit}
+func (api *API) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("query"))
+	if query == "" {
+		api.writeError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+	page, err := queryInt(q.Get("page"), 0)
+	if err != nil || page < 0 {
+		api.writeError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	limit, err := queryInt(q.Get("limit"), searchDefaultLimit)
+	if err != nil || limit < 1 {
+		api.writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+
+	results, total := api.idx.Search.Search(query, page*limit, limit)
+	out := SearchResponse{Results: make([]SearchHit, 0, len(results)), Total: total, Page: page}
+	for _, res := range results {
+		profile, err := api.idx.DB.FetchProfile(r.Context(), res.Name)
+		if err != nil || !profile.Verified() {
+			// Only verified profiles are indexed, so a hit the database doesn't have as one
+			// is stale. It leaves the index and the total so later pages line up with it
+			if err == nil || err == ErrNotFound {
+				log.Printf("%s dropping stale search hit %s", apiPrefix, res.Name)
+				api.idx.Search.Remove(res.Name)
+			}
+			out.Total--
+			continue
+		}
+		out.Results = append(out.Results, SearchHit{
+			FullyQualifiedName: res.Name,
+			Username:           strings.SplitN(res.Name, ".", 2)[0],
+			Profile:            profile.Profile,
+		})
+	}
+	api.writeJSON(w, http.StatusOK, out)
+}
+
+// disagreementReporter is implemented by Cores that cross check answers between hosts
+type disagreementReporter interface {
+	Disagreements() []Disagreement
+}
+
+// handleDisagreements is the handler for /v1/disagreements, it lists the most recent
+// name records the core hosts didn't agree on. It is empty unless quorum mode is on
+func (api *API) handleDisagreements(w http.ResponseWriter, r *http.Request) {
+	out := []Disagreement{}
+	if dr, ok := api.idx.BSK.(disagreementReporter); ok {
+		out = dr.Disagreements()
+	}
+	api.writeJSON(w, http.StatusOK, map[string][]Disagreement{"disagreements": out})
+}
+
+// queryInt parses an integer query parameter, returning def if it is empty
+func queryInt(val string, def int) (int, error) {
+	if val == "" {
+		return def, nil
+	}
+	return strconv.Atoi(val)
+}
+
+// handleHealthz answers 200 while the indexer is alive and 503 with the reasons when it isn't
+func (api *API) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	api.writeHealth(w, api.idx.Liveness(r.Context()))
+}
+
+// handleReadyz answers 200 when the indexer is ready to serve and 503 with the reasons when it isn't
+func (api *API) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	api.writeHealth(w, api.idx.Readiness(r.Context()))
+}
+
+func (api *API) writeHealth(w http.ResponseWriter, hc HealthCheck) {
+	code := http.StatusOK
+	if !hc.OK() {
+		code = http.StatusServiceUnavailable
+	}
+	api.writeJSON(w, code, hc)
+}
+
+func (api *API) writeError(w http.ResponseWriter, code int, message string) {
+	api.writeJSON(w, code, map[string]string{"error": message})
+}
+
+func (api *API) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	byt, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("%s failed to marshal response: %s", apiPrefix, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(byt)
+}
+
+// zonefileJSON renders a zonefile in the same shape as core.blockstack.org
+func zonefileJSON(name string, zf NameZonefile) map[string]interface{} {
+	out := map[string]interface{}{"$origin": name}
+	if uris, err := zf.URI(); err == nil && len(uris) > 0 {
+		records := make([]map[string]interface{}, 0, len(uris))
+		for _, u := range uris {
+			records = append(records, map[string]interface{}{
+				"name":     strings.TrimSuffix(u.Hdr.Name, "."),
+				"priority": u.Priority,
+				"weight":   u.Weight,
+				"target":   u.Target,
+			})
+		}
+		out["$ttl"] = uris[0].Hdr.Ttl
+		out["uri"] = records
+	}
+	if txts, err := zf.TXT(); err == nil && len(txts) > 0 {
+		records := make([]map[string]interface{}, 0, len(txts))
+		for _, t := range txts {
+			records = append(records, map[string]interface{}{
+				"name": strings.TrimSuffix(t.Hdr.Name, "."),
+				"txt":  strings.Join(t.Txt, ""),
+			})
+		}
+		out["txt"] = records
+	}
+	return out
+}
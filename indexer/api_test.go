@@ -0,0 +1,176 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func apiGet(t *testing.T, api *API, path string, out interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s: decoding %q: %s", path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func newTestAPI(t *testing.T) (*API, *fakeCore) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	fc.setOwner("bob.app", testAddress(testKey(7)))
+	idx := newTestIndexer(t, fc, NewMemDB(), fc.names())
+	idx.GetAllZonefiles(ctx)
+	idx.ResolveIndexerNames(ctx)
+	return NewAPI(idx, 0), fc
+}
+
+func TestAPIUser(t *testing.T) {
+	api, fc := newTestAPI(t)
+
+	out := map[string]UserRecord{}
+	if code := apiGet(t, api, "/v1/users/alice.app", &out); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	rec, ok := out["alice.app"]
+	if !ok || rec.Profile.Name != "Alice Appleseed" || rec.OwnerAddress != testAddress(fc.key) {
+		t.Fatalf("unexpected user record %+v", out)
+	}
+	if uri, ok := rec.Zonefile["uri"].([]interface{}); !ok || len(uri) != 1 {
+		t.Fatalf("unexpected zone_file %+v", rec.Zonefile)
+	}
+
+	if code := apiGet(t, api, "/v1/users/nobody.id", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown name, got %d", code)
+	}
+	if code := apiGet(t, api, "/v1/users/bob.app", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for profile not signed by the owner, got %d", code)
+	}
+}
+
+func TestAPIUserNotServed(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	api := NewAPI(newTestIndexer(t, fc, db, nil), 0)
+	owner := testAddress(fc.key)
+	for _, rec := range []struct {
+		name         string
+		status       string
+		verification string
+	}{
+		{"verified.id", NameActive, ProfileVerified},
+		{"mismatch.id", NameActive, ProfileOwnerMismatch},
+		{"unknown.id", NameActive, ProfileOwnerUnknown},
+		{"expired.id", NameExpired, ProfileVerified},
+		{"revoked.id", NameRevoked, ProfileVerified},
+	} {
+		db.UpsertNameRecord(ctx, NameRecord{Name: rec.name, Owner: owner, Status: rec.status})
+		db.UpsertProfile(ctx, ProfileRecord{Name: rec.name, Profile: Profile{Name: rec.name}, Verification: rec.verification})
+	}
+
+	if code := apiGet(t, api, "/v1/users/verified.id", nil); code != http.StatusOK {
+		t.Fatalf("expected 200 for a verified profile, got %d", code)
+	}
+
+	// Profiles not signed by the owner are as good as missing
+	for _, name := range []string{"mismatch.id", "unknown.id"} {
+		body := map[string]string{}
+		if code := apiGet(t, api, "/v1/users/"+name, &body); code != http.StatusNotFound || body["error"] == "" {
+			t.Fatalf("expected 404 for %s, got %d %v", name, code, body)
+		}
+	}
+
+	// Expired and revoked names say so, even with a profile still stored
+	for name, status := range map[string]string{"expired.id": NameExpired, "revoked.id": NameRevoked} {
+		body := map[string]string{}
+		if code := apiGet(t, api, "/v1/users/"+name, &body); code != http.StatusGone || body["status"] != status {
+			t.Fatalf("expected 410 %s for %s, got %d %v", status, name, code, body)
+		}
+	}
+}
+
+func TestAPISearch(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	out := SearchResponse{}
+	if code := apiGet(t, api, "/v1/search?query=alic", &out); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(out.Results) != 1 || out.Results[0].FullyQualifiedName != "alice.app" || out.Results[0].Username != "alice" {
+		t.Fatalf("unexpected results %+v", out)
+	}
+
+	// Typos in longer terms still match
+	out = SearchResponse{}
+	apiGet(t, api, "/v1/search?query=appleseeds", &out)
+	if len(out.Results) != 1 || out.Results[0].FullyQualifiedName != "alice.app" {
+		t.Fatalf("expected a fuzzy match on alice.app, got %+v", out)
+	}
+
+	// Paging through the 150 users
+	out = SearchResponse{}
+	apiGet(t, api, "/v1/search?query=user&page=1&limit=100", &out)
+	if out.Total != 150 || len(out.Results) != 50 {
+		t.Fatalf("expected 50 of 150 results, got %d of %d", len(out.Results), out.Total)
+	}
+
+	if code := apiGet(t, api, "/v1/search", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a query, got %d", code)
+	}
+}
+
+func TestAPISearchTotal(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestAPI(t)
+	idx := api.idx
+
+	// Only verified profiles make it into the index
+	for name := range idx.Search.docs {
+		if p, err := idx.DB.FetchProfile(ctx, name); err != nil || !p.Verified() {
+			t.Fatalf("expected only verified profiles indexed, %s is %+v, err %v", name, p, err)
+		}
+	}
+
+	// A hit whose profile the database no longer has as verified isn't counted
+	p, _ := idx.DB.FetchProfile(ctx, "user000.id")
+	p.Verification = ProfileOwnerMismatch
+	idx.DB.UpsertProfile(ctx, p)
+	out := SearchResponse{}
+	apiGet(t, api, "/v1/search?query=user&limit=100", &out)
+	if out.Total != 149 || len(out.Results) != 99 {
+		t.Fatalf("expected 99 of 149 results, got %d of %d", len(out.Results), out.Total)
+	}
+	out = SearchResponse{}
+	apiGet(t, api, "/v1/search?query=user&page=1&limit=100", &out)
+	if out.Total != 149 || len(out.Results) != 49 {
+		t.Fatalf("expected 49 of 149 results on the second page, got %d of %d", len(out.Results), out.Total)
+	}
+	if _, ok := idx.Search.docs["user000.id"]; ok {
+		t.Fatal("expected the stale hit dropped from the index")
+	}
+}
+
+func TestSearchWhileAdding(t *testing.T) {
+	si := NewSearchIndex()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			si.Add(fmt.Sprintf("user%03d.id", i), Profile{Name: fmt.Sprintf("Searcher %03d", i)})
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		si.Search("searcher", 0, 10)
+	}
+	<-done
+	if _, total := si.Search("searcher", 0, 10); total != 500 {
+		t.Fatalf("expected every name found once adding stops, got %d", total)
+	}
+}
@@ -0,0 +1,105 @@
+package indexer
+
+import (
+	"time"
+)
+
+// defaultZonefileBatchSize is the number of zonefiles written together when unset
+const defaultZonefileBatchSize = 100
+
+// changedZonefile is a zonefile a name lookup found to have changed since it was stored
+type changedZonefile struct {
+	name     string
+	hash     string
+	zonefile string
+}
+
+// zonefileBatch is a batch of changed zonefiles written together, keyed by hash
+type zonefileBatch map[string]*batchedZonefile
+
+// batchedZonefile is a zonefile in a batch along with the names it is the zonefile of
+type batchedZonefile struct {
+	zonefile string
+	names    []string
+}
+
+// zonefileBatcher groups the changed zonefiles found by the name lookups into batches
+// that are each stored in one database write. A batch is flushed as soon as it holds maxCount zonefiles or maxBytes of
+// them, when no zonefile has arrived for idle, and when the input is closed
+type zonefileBatcher struct {
+	maxCount int
+	maxBytes int
+	idle     time.Duration
+
+	batch zonefileBatch
+	bytes int
+	emit  func(zonefileBatch)
+}
+
+func newZonefileBatcher(cfg IDXConfig) *zonefileBatcher {
+	return &zonefileBatcher{
+		maxCount: cfg.ZonefileBatchSize,
+		maxBytes: cfg.ZonefileBatchBytes,
+		idle:     cfg.ZonefileBatchIdle,
+		batch:    make(zonefileBatch),
+	}
+}
+
+// run batches the changed zonefiles sent on in, passing each batch to emit, until in is
+// closed and then flushes what's left
+func (b *zonefileBatcher) run(in <-chan changedZonefile, emit func(zonefileBatch)) {
+	b.emit = emit
+	var idle <-chan time.Time
+	for {
+		select {
+		case zf, ok := <-in:
+			if !ok {
+				b.flush()
+				return
+			}
+			b.add(zf)
+			idle = nil
+			if len(b.batch) > 0 {
+				idle = time.After(b.idle)
+			}
+		case <-idle:
+			b.flush()
+			idle = nil
+		}
+	}
+}
+
+// add puts a zonefile in the batch, flushing first if it wouldn't fit and after if it is full
+func (b *zonefileBatcher) add(zf changedZonefile) {
+	// Names can share a zonefile, it is only held once
+	if bz, ok := b.batch[zf.hash]; ok {
+		bz.names = append(bz.names, zf.name)
+		return
+	}
+	size := len(zf.zonefile)
+	if len(b.batch) > 0 && b.bytes+size > b.maxBytes {
+		b.flush()
+	}
+	b.batch[zf.hash] = &batchedZonefile{zonefile: zf.zonefile, names: []string{zf.name}}
+	b.bytes += size
+	if len(b.batch) >= b.maxCount || b.bytes >= b.maxBytes {
+		b.flush()
+	}
+}
+
+func (b *zonefileBatcher) flush() {
+	if len(b.batch) == 0 {
+		return
+	}
+	b.emit(b.batch)
+	b.batch = make(zonefileBatch)
+	b.bytes = 0
+}
+
+func (b zonefileBatch) deadLetterNames() []string {
+	out := make([]string, 0, len(b))
+	for _, bz := range b {
+		out = append(out, bz.names...)
+	}
+	return out
+}
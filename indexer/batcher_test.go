@@ -0,0 +1,131 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runBatcher sends each zonefile to a batcher and returns the batches it flushed
+func runBatcher(b *zonefileBatcher, sends ...changedZonefile) []zonefileBatch {
+	in := make(chan changedZonefile)
+	go func() {
+		for _, s := range sends {
+			in <- s
+		}
+		close(in)
+	}()
+	batches := make([]zonefileBatch, 0)
+	b.run(in, func(batch zonefileBatch) { batches = append(batches, batch) })
+	return batches
+}
+
+func testHash(i int) string {
+	return fmt.Sprintf("%040x", i)
+}
+
+// testChangedZonefile returns a changed zonefile of size bytes for a name
+func testChangedZonefile(i, size int) changedZonefile {
+	return changedZonefile{name: fmt.Sprintf("name%d.id", i), hash: testHash(i), zonefile: strings.Repeat("z", size)}
+}
+
+func TestZonefileBatcherLimits(t *testing.T) {
+	cfg := IDXConfig{ZonefileBatchSize: 3, ZonefileBatchBytes: 1 << 20, ZonefileBatchIdle: time.Hour}
+
+	// Full batches are flushed as they fill, the rest when the input closes
+	sends := []changedZonefile{}
+	for i := 0; i < 7; i++ {
+		sends = append(sends, testChangedZonefile(i, 100))
+	}
+	batches := runBatcher(newZonefileBatcher(cfg), sends...)
+	if len(batches) != 3 || len(batches[0]) != 3 || len(batches[1]) != 3 || len(batches[2]) != 1 {
+		t.Fatalf("expected batches of 3, 3 and 1, got %v", batches)
+	}
+
+	// The size of the zonefiles in a batch is bounded too
+	cfg.ZonefileBatchBytes = 250
+	batches = runBatcher(newZonefileBatcher(cfg), sends[:5]...)
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %v", batches)
+	}
+	for _, b := range batches {
+		if len(b) > 2 {
+			t.Fatalf("expected no more than 2 zonefiles a batch, got %v", b)
+		}
+	}
+}
+
+func TestZonefileBatcherIdle(t *testing.T) {
+	cfg := IDXConfig{ZonefileBatchSize: 100, ZonefileBatchBytes: 1 << 20, ZonefileBatchIdle: 10 * time.Millisecond}
+	in := make(chan changedZonefile)
+	out := make(chan zonefileBatch)
+	go newZonefileBatcher(cfg).run(in, func(b zonefileBatch) { out <- b })
+	defer close(in)
+
+	// Names sharing a zonefile hold it once and a partial batch goes out once nothing else arrives
+	in <- changedZonefile{name: "alice.id", hash: testHash(1), zonefile: "zonefile"}
+	in <- changedZonefile{name: "alice.app", hash: testHash(1), zonefile: "zonefile"}
+	select {
+	case b := <-out:
+		if len(b) != 1 || len(b[testHash(1)].names) != 2 {
+			t.Fatalf("expected one zonefile for both names, got %v", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle batch to be flushed")
+	}
+}
+
+// countingDB wraps a DB and counts the zonefiles in each batch write, failing them when fail is set
+type countingDB struct {
+	DB
+
+	sync.Mutex
+	writes []int
+	fail   bool
+}
+
+func (c *countingDB) UpsertNameZonefiles(ctx context.Context, zfs []ZonefileRecord) error {
+	c.Lock()
+	defer c.Unlock()
+	c.writes = append(c.writes, len(zfs))
+	if c.fail {
+		return errors.New("write failed")
+	}
+	return c.DB.UpsertNameZonefiles(ctx, zfs)
+}
+
+func TestZonefilesWrittenInBatches(t *testing.T) {
+	fc := newTestNetwork(t)
+	db := &countingDB{DB: NewMemDB()}
+	names := fc.names()
+	idx := newTestIndexer(t, fc, db, names)
+	idx.config.ZonefileBatchSize = 100
+	idx.config.ZonefileBatchIdle = time.Hour
+
+	// Each batch is one database write
+	written := idx.GetZonefilesFor(context.Background(), names)
+	if len(written) != len(names) {
+		t.Fatalf("expected %d zonefiles written, got %d", len(names), len(written))
+	}
+	if !reflect.DeepEqual(db.writes, []int{100, len(names) - 100}) {
+		t.Fatalf("expected writes of 100 and %d zonefiles, got %v", len(names)-100, db.writes)
+	}
+
+	// A batch that can't be written is dead lettered as a whole
+	fc.updateName("alice.app", "Alice Anderson")
+	fc.updateName("bob.app", "Bob Brown")
+	db.fail = true
+	if written := idx.GetZonefilesFor(context.Background(), []string{"alice.app", "bob.app"}); len(written) != 0 {
+		t.Fatalf("expected nothing written, got %v", written)
+	}
+	for _, name := range []string{"alice.app", "bob.app"} {
+		if dl, err := db.FetchDeadLetter(context.Background(), name); err != nil || dl.Stage != stageZonefiles {
+			t.Fatalf("expected %s dead lettered at %s, got %+v, err %v", name, stageZonefiles, dl, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// stateLastBlock is the state key holding the last block height fully indexed
+	stateLastBlock = "lastBlock"
+
+	// maxCatchupBlocks is the largest gap walked block by block, anything
+	// further behind is cheaper to catch up on with a full resync
+	maxCatchupBlocks = 1000
+)
+
+// errFullResync is returned by IndexNewBlocks when the indexer can't catch up incrementally
+var errFullResync = errors.New("full resync required")
+
+// IndexNewBlocks asks core for the name operations in the blocks since the last indexed
+// height and refreshes the zonefiles and profiles of just the names they touched
+func (idx *Indexer) IndexNewBlocks(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	last, err := idx.lastBlock(ctx)
+	if err != nil {
+		return errFullResync
+	}
+	height, err := idx.GetBlockHeight(ctx)
+	if err != nil {
+		return err
+	}
+	if height <= last {
+		idx.caughtUp()
+		return nil
+	}
+	if height-last > maxCatchupBlocks {
+		return errFullResync
+	}
+
+	changed := make([]string, 0)
+	for block := last + 1; block <= height; block++ {
+		names, err := idx.GetNamesAtBlock(ctx, block)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, names...)
+	}
+	// Names expire without an operation on chain, their records are fetched again to see
+	// whether they were renewed. Names outside the indexed namespaces are dropped
+	changed = idx.config.Namespaces.filter(uniq(append(changed, idx.expiries.due(height)...)))
+	idx.ST.Rec(statBlocksIndexed, height-last)
+	idx.ST.Rec(statBlocksNamesChanged, len(changed))
+
+	if len(changed) > 0 {
+		idx.names.add(changed)
+		written := idx.GetZonefilesFor(ctx, changed)
+		idx.ResolveNames(ctx, uniq(append(changed, written...)))
+		idx.WriteNamesToFile(idx.config.NameFile)
+	}
+	// An interrupted pass has to be redone, leave the height where it was
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	idx.log(idxPrefix, fmt.Sprintf("indexed blocks %d to %d, %d names changed", last+1, height, len(changed)))
+	if err := idx.setLastBlock(ctx, height); err != nil {
+		return err
+	}
+	idx.caughtUp()
+	return nil
+}
+
+// lastBlock returns the last block height fully indexed
+func (idx *Indexer) lastBlock(ctx context.Context) (int, error) {
+	val, err := idx.DB.FetchState(ctx, stateLastBlock)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+func (idx *Indexer) setLastBlock(ctx context.Context, height int) error {
+	return idx.DB.UpsertState(ctx, stateLastBlock, strconv.Itoa(height))
+}
@@ -0,0 +1,73 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIndexNewBlocks(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, nil)
+	idx.Index(ctx)
+
+	fc.addName("carol.app", "Carol Cooper")
+	fc.mine("carol.app")
+	fc.updateName("alice.app", "Alice Anderson")
+	fc.mine("alice.app")
+	records := fc.callCount("/v1/names")
+
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the two changed names should have been looked up
+	if c := fc.callCount("/v1/names") - records; c != 2 {
+		t.Fatalf("expected 2 name record lookups, got %d", c)
+	}
+	for name, want := range map[string]string{"carol.app": "Carol Cooper", "alice.app": "Alice Anderson"} {
+		p, err := db.FetchProfile(ctx, name)
+		if err != nil || p.Profile.Name != want {
+			t.Fatalf("expected %s to have profile %q, got %+v, err %v", name, want, p, err)
+		}
+	}
+	if last, err := idx.lastBlock(ctx); err != nil || last != 102 {
+		t.Fatalf("expected last block 102, got %d, err %v", last, err)
+	}
+
+	// Nothing new has been mined so nothing should be fetched
+	records = fc.callCount("/v1/names")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c := fc.callCount("/v1/names") - records; c != 0 {
+		t.Fatalf("expected no name record lookups, got %d", c)
+	}
+}
+
+func TestIndexNewBlocksFullResync(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+
+	// Without a stored height there is nothing to catch up from
+	if err := idx.IndexNewBlocks(ctx); err != errFullResync {
+		t.Fatalf("expected errFullResync, got %v", err)
+	}
+
+	idx.FullResync(ctx)
+	if last, err := idx.lastBlock(ctx); err != nil || last != 100 {
+		t.Fatalf("expected last block 100, got %d, err %v", last, err)
+	}
+	if c := idx.DB.ProfilesCount(ctx); c != len(fc.names()) {
+		t.Fatalf("expected %d profiles, got %d", len(fc.names()), c)
+	}
+
+	for i := 0; i <= maxCatchupBlocks; i++ {
+		fc.mine()
+	}
+	if err := idx.IndexNewBlocks(ctx); err != errFullResync {
+		t.Fatalf("expected errFullResync after falling %d blocks behind, got %v", maxCatchupBlocks+1, err)
+	}
+}
@@ -0,0 +1,318 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltZonefilesBucket   = []byte(zonefilesCollection)
+	boltProfilesBucket    = []byte(profilesCollection)
+	boltNamesBucket       = []byte(namesCollection)
+	boltStateBucket       = []byte(stateCollection)
+	boltDeadLettersBucket = []byte(deadLettersCollection)
+	boltResolvedBucket    = []byte(resolvedCollection)
+)
+
+func init() {
+	RegisterDB("bolt", func(cfg *Config) (DB, error) {
+		return NewBoltDB(cfg)
+	})
+}
+
+// NewBoltDB opens (or creates) the bolt database file at cfg.DB.Connection
+func NewBoltDB(cfg *Config) (*BoltDB, error) {
+	db, err := bolt.Open(cfg.DB.Connection, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltZonefilesBucket, boltProfilesBucket, boltNamesBucket, boltStateBucket, boltDeadLettersBucket, boltResolvedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDB{Path: cfg.DB.Connection, DB: db}, nil
+}
+
+// BoltDB is an embedded implementation of the DB interface, everything
+// is stored in the single file at Path
+type BoltDB struct {
+	Path string
+	DB   *bolt.DB
+}
+
+// Ping checks the database file is still open
+func (bdb *BoltDB) Ping(ctx context.Context) error {
+	return bdb.view(ctx, func(tx *bolt.Tx) error { return nil })
+}
+
+// Close closes the database file
+func (bdb *BoltDB) Close() error {
+	return bdb.DB.Close()
+}
+
+// UpsertNameZonefile takes a name, its zonefile hash and zonefile and stores them as JSON under the name
+func (bdb *BoltDB) UpsertNameZonefile(ctx context.Context, name, hash, zonefile string) error {
+	return bdb.put(ctx, boltZonefilesBucket, name, NameZonefileBolt{Name: name, ZonefileHash: hash, Zonefile: zonefile})
+}
+
+// UpsertNameZonefiles stores a batch of zonefiles as JSON under their names in one transaction
+func (bdb *BoltDB) UpsertNameZonefiles(ctx context.Context, zfs []ZonefileRecord) error {
+	return bdb.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltZonefilesBucket)
+		for _, zf := range zfs {
+			byt, err := json.Marshal(NameZonefileBolt{Name: zf.Name, ZonefileHash: zf.Hash, Zonefile: zf.Zonefile})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(zf.Name), byt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FetchZonefile returns a name/zonefile pairing
+func (bdb *BoltDB) FetchZonefile(ctx context.Context, name string) (NameZonefile, error) {
+	zf := &NameZonefileBolt{}
+	err := bdb.get(ctx, boltZonefilesBucket, name, zf)
+	return zf, err
+}
+
+// UpsertProfile stores a profile record as JSON under its name
+func (bdb *BoltDB) UpsertProfile(ctx context.Context, rec ProfileRecord) error {
+	return bdb.put(ctx, boltProfilesBucket, rec.Name, rec)
+}
+
+// FetchProfile returns the profile record stored for a name
+func (bdb *BoltDB) FetchProfile(ctx context.Context, name string) (ProfileRecord, error) {
+	rec := ProfileRecord{}
+	err := bdb.get(ctx, boltProfilesBucket, name, &rec)
+	return rec, err
+}
+
+// EachProfile calls fn with every stored profile record, stopping at the first error
+func (bdb *BoltDB) EachProfile(ctx context.Context, fn func(rec ProfileRecord) error) error {
+	return bdb.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltProfilesBucket).ForEach(func(k, v []byte) error {
+			rec := ProfileRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			return fn(rec)
+		})
+	})
+}
+
+// UpsertNameRecord stores a name record as JSON under its name
+func (bdb *BoltDB) UpsertNameRecord(ctx context.Context, rec NameRecord) error {
+	return bdb.put(ctx, boltNamesBucket, rec.Name, rec)
+}
+
+// FetchNameRecord returns the name record stored for a name
+func (bdb *BoltDB) FetchNameRecord(ctx context.Context, name string) (NameRecord, error) {
+	rec := NameRecord{}
+	err := bdb.get(ctx, boltNamesBucket, name, &rec)
+	return rec, err
+}
+
+// EachNameRecord calls fn with every stored name record, stopping at the first error
+func (bdb *BoltDB) EachNameRecord(ctx context.Context, fn func(rec NameRecord) error) error {
+	return bdb.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltNamesBucket).ForEach(func(k, v []byte) error {
+			rec := NameRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			return fn(rec)
+		})
+	})
+}
+
+// PurgeName removes the zonefile, profile and resolution time stored for a name
+func (bdb *BoltDB) PurgeName(ctx context.Context, name string) error {
+	return bdb.update(ctx, func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltZonefilesBucket, boltProfilesBucket, boltResolvedBucket} {
+			if err := tx.Bucket(b).Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpsertState stores an indexer state value
+func (bdb *BoltDB) UpsertState(ctx context.Context, key, value string) error {
+	return bdb.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStateBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+// FetchState returns an indexer state value
+func (bdb *BoltDB) FetchState(ctx context.Context, key string) (string, error) {
+	var value string
+	err := bdb.view(ctx, func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltStateBucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		value = string(v)
+		return nil
+	})
+	return value, err
+}
+
+// UpsertDeadLetter stores a dead letter as JSON under its name
+func (bdb *BoltDB) UpsertDeadLetter(ctx context.Context, dl DeadLetter) error {
+	return bdb.put(ctx, boltDeadLettersBucket, dl.Name, dl)
+}
+
+// FetchDeadLetter returns the dead letter stored for a name
+func (bdb *BoltDB) FetchDeadLetter(ctx context.Context, name string) (DeadLetter, error) {
+	dl := DeadLetter{}
+	err := bdb.get(ctx, boltDeadLettersBucket, name, &dl)
+	return dl, err
+}
+
+// DeleteDeadLetter removes the dead letter for a name, if there is one
+func (bdb *BoltDB) DeleteDeadLetter(ctx context.Context, name string) error {
+	return bdb.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeadLettersBucket).Delete([]byte(name))
+	})
+}
+
+// EachDeadLetter calls fn with every dead letter in name order, stopping at the first error
+func (bdb *BoltDB) EachDeadLetter(ctx context.Context, fn func(dl DeadLetter) error) error {
+	return bdb.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeadLettersBucket).ForEach(func(k, v []byte) error {
+			dl := DeadLetter{}
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return err
+			}
+			return fn(dl)
+		})
+	})
+}
+
+// UpsertResolvedAt stores when a name's profile was last resolved as JSON under the name
+func (bdb *BoltDB) UpsertResolvedAt(ctx context.Context, name string, t time.Time) error {
+	return bdb.put(ctx, boltResolvedBucket, name, t)
+}
+
+// FetchResolvedAt returns when a name's profile was last resolved
+func (bdb *BoltDB) FetchResolvedAt(ctx context.Context, name string) (time.Time, error) {
+	var t time.Time
+	err := bdb.get(ctx, boltResolvedBucket, name, &t)
+	return t, err
+}
+
+// EachResolvedAt calls fn with every name that has been resolved and when, stopping at the first error
+func (bdb *BoltDB) EachResolvedAt(ctx context.Context, fn func(name string, t time.Time) error) error {
+	return bdb.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltResolvedBucket).ForEach(func(k, v []byte) error {
+			var t time.Time
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			return fn(string(k), t)
+		})
+	})
+}
+
+// view runs fn in a read transaction unless ctx is already done
+func (bdb *BoltDB) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bdb.DB.View(fn)
+}
+
+// update runs fn in a read-write transaction unless ctx is already done
+func (bdb *BoltDB) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bdb.DB.Update(fn)
+}
+
+// put stores v as JSON under key in bucket
+func (bdb *BoltDB) put(ctx context.Context, bucket []byte, key string, v interface{}) error {
+	byt, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bdb.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), byt)
+	})
+}
+
+// get unmarshals the JSON stored under key in bucket into v
+func (bdb *BoltDB) get(ctx context.Context, bucket []byte, key string, v interface{}) error {
+	return bdb.view(ctx, func(tx *bolt.Tx) error {
+		byt := tx.Bucket(bucket).Get([]byte(key))
+		if byt == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(byt, v)
+	})
+}
+
+// ZonefilesCount returns the count of all zonefiles
+func (bdb *BoltDB) ZonefilesCount(ctx context.Context) int {
+	return bdb.count(ctx, boltZonefilesBucket)
+}
+
+// ProfilesCount returns the count of all profiles
+func (bdb *BoltDB) ProfilesCount(ctx context.Context) int {
+	return bdb.count(ctx, boltProfilesBucket)
+}
+
+func (bdb *BoltDB) count(ctx context.Context, bucket []byte) int {
+	var count int
+	bdb.view(ctx, func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// NameZonefileBolt represents a name zonefile pairing
+// Contains methods for pulling out different types of resource records
+type NameZonefileBolt struct {
+	Name         string `json:"name"`
+	ZonefileHash string `json:"hash"`
+	Zonefile     string `json:"zonefile"`
+}
+
+// Hash returns the hash of the zonefile
+func (nz *NameZonefileBolt) Hash() string {
+	return nz.ZonefileHash
+}
+
+// URI returns the URI records from a zonefile
+func (nz *NameZonefileBolt) URI() ([]*dns.URI, error) {
+	return zonefileURI(nz.Zonefile)
+}
+
+// TXT returns the TXT records from a zonefile
+func (nz *NameZonefileBolt) TXT() ([]*dns.TXT, error) {
+	return zonefileTXT(nz.Zonefile)
+}
+
+// URL returns the URLs from the URI records in a zonefile
+func (nz *NameZonefileBolt) URL() ([]*url.URL, error) {
+	return zonefileURL(nz.Zonefile)
+}
@@ -0,0 +1,54 @@
+package indexer
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestBoltDB(t *testing.T) *BoltDB {
+	bdb, err := NewBoltDB(&Config{DB: DBConfig{Driver: "bolt", Connection: filepath.Join(t.TempDir(), "bsk-idx.db")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bdb.Close() })
+	return bdb
+}
+
+func TestBoltZonefiles(t *testing.T) {
+	testDBZonefiles(t, newTestBoltDB(t))
+}
+
+func TestBoltProfiles(t *testing.T) {
+	testDBProfiles(t, newTestBoltDB(t))
+}
+
+func TestBoltNameRecords(t *testing.T) {
+	testDBNameRecords(t, newTestBoltDB(t))
+}
+
+func TestBoltState(t *testing.T) {
+	testDBState(t, newTestBoltDB(t))
+}
+
+func TestBoltDeadLetters(t *testing.T) {
+	testDBDeadLetters(t, newTestBoltDB(t))
+}
+
+func TestBoltResolvedAt(t *testing.T) {
+	testDBResolvedAt(t, newTestBoltDB(t))
+}
+
+func TestBoltDriverRegistered(t *testing.T) {
+	db, err := NewDB(&Config{DB: DBConfig{Driver: "bolt", Connection: filepath.Join(t.TempDir(), "bsk-idx.db")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.(*BoltDB); !ok {
+		t.Fatalf("expected *BoltDB, got %T", db)
+	}
+	db.(*BoltDB).Close()
+}
+
+func TestBoltPurgeName(t *testing.T) {
+	testDBPurgeName(t, newTestBoltDB(t))
+}
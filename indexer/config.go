@@ -2,6 +2,8 @@ package indexer
 
 import (
 	"encoding/json"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/blockstack/blockstack.go/blockstack"
@@ -29,9 +31,39 @@ type BSKConfig struct {
 	Hosts   []blockstack.ServerConfig `json:"hosts"`
 	Retries int                       `json:"retries"`
 	Timeout time.Duration             `json:"timeout"`
+
+	// HealthCheckInterval is how often each host is checked, EjectTimeout
+	// is how long a failing host is taken out of rotation for
+	HealthCheckInterval time.Duration `json:"healthCheckInterval"`
+	EjectTimeout        time.Duration `json:"ejectTimeout"`
+
+	// Quorum is the number of hosts asked for each name record when more than one.
+	// A record is only accepted when a majority of them agree on it
+	Quorum int `json:"quorum"`
+}
+
+// servers returns Hosts, or Host when only a single node is configured
+func (c BSKConfig) servers() []blockstack.ServerConfig {
+	if len(c.Hosts) > 0 {
+		return c.Hosts
+	}
+	return []blockstack.ServerConfig{c.Host}
 }
 
-// DBConfig represents the backing database (MongoDB)
+// withDefaults fills in the host pool intervals when unset
+func (c BSKConfig) withDefaults() BSKConfig {
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = 30 * time.Second
+	}
+	if c.EjectTimeout == 0 {
+		c.EjectTimeout = time.Minute
+	}
+	return c
+}
+
+// DBConfig represents the backing database. Driver selects the implementation
+// ("mongo", "postgres" or "bolt") and Connection is passed to it as the dial
+// string, or the database file path for bolt
 type DBConfig struct {
 	Connection string `json:"connection"`
 	Database   string `json:"database"`
@@ -40,11 +72,187 @@ type DBConfig struct {
 
 // IDXConfig represents indexer specific configuration
 type IDXConfig struct {
-	StatsPort            int           `json:"statsPort"`
-	Concurrency          int           `json:"concurrency"`
-	Retries              int           `json:"retries"`
-	NameFile             string        `json:"namefile"`
-	Timeout              time.Duration `json:"timeout"`
-	NameFetchTimeout     time.Duration `json:"nameFetchTimeout"`
-	ZonefileFetchTimeout time.Duration `json:"zonefileFetchTimeout"`
+	StatsPort   int    `json:"statsPort"`
+	APIPort     int    `json:"apiPort"`
+	Concurrency int    `json:"concurrency"`
+	NameFile    string `json:"namefile"`
+
+	// Retries is the number of attempts made at each core call and profile fetch, counting
+	// the first. The wait between them starts at Timeout and doubles up to MaxRetryDelay,
+	// randomized by RetryJitter. RetryDeadline caps the time spent on one call including retries
+	Retries       int           `json:"retries"`
+	Timeout       time.Duration `json:"timeout"`
+	MaxRetryDelay time.Duration `json:"maxRetryDelay"`
+	RetryJitter   float64       `json:"retryJitter"`
+	RetryDeadline time.Duration `json:"retryDeadline"`
+
+	// BlockFetchTimeout is how often core is asked for new blocks. Names changed
+	// in those blocks get their zonefiles and profiles refreshed
+	BlockFetchTimeout time.Duration `json:"blockFetchTimeout"`
+	// FullResyncInterval is how often every name, zonefile and profile is refetched
+	FullResyncInterval time.Duration `json:"fullResyncInterval"`
+
+	// MinRefreshInterval and MaxRefreshInterval bound how long a profile goes between
+	// re-resolutions. A stable profile's interval doubles from the min up to the max
+	MinRefreshInterval time.Duration `json:"minRefreshInterval"`
+	MaxRefreshInterval time.Duration `json:"maxRefreshInterval"`
+
+	// ZonefileBatchSize and ZonefileBatchBytes bound the number and total size of the changed
+	// zonefiles stored in one database write. A batch that isn't full is written once no new zonefile
+	// has come in for ZonefileBatchIdle
+	ZonefileBatchSize  int           `json:"zonefileBatchSize"`
+	ZonefileBatchBytes int           `json:"zonefileBatchBytes"`
+	ZonefileBatchIdle  time.Duration `json:"zonefileBatchIdle"`
+
+	// LivenessDeadline is how long a pass can go without progress before /healthz fails
+	LivenessDeadline time.Duration `json:"livenessDeadline"`
+	// ReadyStages are the indexes, of names, zonefiles and profiles, that have to be ready
+	// for /readyz to pass. MaxStaleness is how long ago the index can have last caught up
+	// with the chain
+	ReadyStages  []string      `json:"readyStages"`
+	MaxStaleness time.Duration `json:"maxStaleness"`
+
+	// ShutdownTimeout bounds how long in flight work gets to finish on SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+
+	// Namespaces picks which namespaces are indexed and how
+	Namespaces NamespacesConfig `json:"namespaces"`
+}
+
+// NamespacesConfig filters namespaces by name or path.Match pattern, such as "id" or
+// "app*". A namespace is indexed when Include is empty or it matches Include, and it
+// doesn't match Exclude. Policies are keyed by namespace name
+type NamespacesConfig struct {
+	Include  []string                   `json:"include"`
+	Exclude  []string                   `json:"exclude"`
+	Policies map[string]NamespacePolicy `json:"policies"`
+}
+
+// NamespacePolicy overrides how the names in a namespace are indexed, anything left unset
+// is taken from IDXConfig. A namespace with its own Concurrency gets that many workers to
+// itself at each stage, the rest share Concurrency workers. ResolveProfiles set to false
+// indexes names and zonefiles but never fetches profiles
+type NamespacePolicy struct {
+	Concurrency        int           `json:"concurrency"`
+	MinRefreshInterval time.Duration `json:"minRefreshInterval"`
+	MaxRefreshInterval time.Duration `json:"maxRefreshInterval"`
+	ResolveProfiles    *bool         `json:"resolveProfiles"`
+}
+
+// indexed reports whether a namespace passes the include and exclude filters
+func (c NamespacesConfig) indexed(ns string) bool {
+	if len(c.Include) > 0 && !matchNamespace(c.Include, ns) {
+		return false
+	}
+	return !matchNamespace(c.Exclude, ns)
+}
+
+// everything reports whether there are no filters and every namespace is indexed
+func (c NamespacesConfig) everything() bool {
+	return len(c.Include) == 0 && len(c.Exclude) == 0
+}
+
+// filter returns the names in namespaces that are indexed
+func (c NamespacesConfig) filter(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if c.indexed(namespaceOf(name)) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// matchNamespace reports whether ns matches any of patterns, a leading dot is ignored
+func matchNamespace(patterns []string, ns string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "."), ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// badNamespacePatterns returns the include and exclude patterns path.Match can't parse,
+// they never match anything
+func (c NamespacesConfig) badNamespacePatterns() []string {
+	out := make([]string, 0)
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			out = append(out, pattern)
+		}
+	}
+	return out
+}
+
+// policy returns the policy of a namespace with the settings it leaves unset filled in
+func (c IDXConfig) policy(ns string) NamespacePolicy {
+	p := c.Namespaces.Policies[ns]
+	if p.Concurrency <= 0 {
+		p.Concurrency = c.Concurrency
+	}
+	if p.MinRefreshInterval == 0 {
+		p.MinRefreshInterval = c.MinRefreshInterval
+	}
+	if p.MaxRefreshInterval == 0 {
+		p.MaxRefreshInterval = c.MaxRefreshInterval
+	}
+	if p.MaxRefreshInterval < p.MinRefreshInterval {
+		p.MaxRefreshInterval = p.MinRefreshInterval
+	}
+	if p.ResolveProfiles == nil {
+		resolve := true
+		p.ResolveProfiles = &resolve
+	}
+	return p
+}
+
+// withDefaults fills in the intervals that would otherwise spin or panic when unset
+func (c IDXConfig) withDefaults() IDXConfig {
+	if c.Retries == 0 {
+		c.Retries = 1
+	}
+	if c.MaxRetryDelay == 0 {
+		c.MaxRetryDelay = 30 * time.Second
+	}
+	if c.RetryDeadline == 0 {
+		c.RetryDeadline = 5 * time.Minute
+	}
+	if c.BlockFetchTimeout == 0 {
+		c.BlockFetchTimeout = time.Minute
+	}
+	if c.FullResyncInterval == 0 {
+		c.FullResyncInterval = 24 * time.Hour
+	}
+	if c.MinRefreshInterval == 0 {
+		c.MinRefreshInterval = time.Hour
+	}
+	if c.MaxRefreshInterval < c.MinRefreshInterval {
+		c.MaxRefreshInterval = 7 * 24 * time.Hour
+		if c.MaxRefreshInterval < c.MinRefreshInterval {
+			c.MaxRefreshInterval = c.MinRefreshInterval
+		}
+	}
+	if c.ZonefileBatchSize <= 0 {
+		c.ZonefileBatchSize = defaultZonefileBatchSize
+	}
+	if c.ZonefileBatchBytes <= 0 {
+		c.ZonefileBatchBytes = 1 << 20
+	}
+	if c.ZonefileBatchIdle == 0 {
+		c.ZonefileBatchIdle = time.Second
+	}
+	if c.LivenessDeadline == 0 {
+		c.LivenessDeadline = 10 * time.Minute
+	}
+	if len(c.ReadyStages) == 0 {
+		c.ReadyStages = []string{"names", "zonefiles", "profiles"}
+	}
+	if c.MaxStaleness == 0 {
+		c.MaxStaleness = 10 * time.Minute
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	return c
 }
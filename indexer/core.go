@@ -0,0 +1,156 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blockstack/blockstack.go/blockstack"
+)
+
+// Core is the set of blockstack-core calls the indexer depends on. It lets the
+// indexer run against something other than a live core node, e.g. in tests. Calls
+// give up once their ctx is done
+type Core interface {
+	GetAllNamespaces(ctx context.Context) ([]string, error)
+	GetNamesInNamespace(ctx context.Context, ns string, page int) ([]string, error)
+	GetNameCount(ctx context.Context) (int, error)
+	GetNameBlockchainRecord(ctx context.Context, name string) (BlockchainRecord, error)
+	GetSponsoredNames(ctx context.Context, page int) ([]string, error)
+	GetBlockHeight(ctx context.Context) (int, error)
+	GetNamesAtBlock(ctx context.Context, height int) ([]string, error)
+}
+
+// BlockchainRecord is core's answer for a name at /v1/names/{name}. It carries the
+// current zonefile along with its hash
+type BlockchainRecord struct {
+	Address      string `json:"address"`
+	Status       string `json:"status"`
+	ExpireBlock  int    `json:"expire_block"`
+	Zonefile     string `json:"zonefile"`
+	ZonefileHash string `json:"zonefile_hash"`
+}
+
+// Revoked reports whether core has the name as revoked
+func (r BlockchainRecord) Revoked() bool {
+	return r.Status == "revoked"
+}
+
+// Expired reports whether core has the name as expired
+func (r BlockchainRecord) Expired() bool {
+	return r.Status == "expired"
+}
+
+// NewCoreClient returns a Core that calls the REST API of the given core node
+func NewCoreClient(cfg blockstack.ServerConfig) Core {
+	return &coreClient{
+		server: cfg,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// coreClient implements Core over the node's documented REST API, the one core.blockstack.org
+// serves. Every call goes through getJSON so a node answering with an error status always
+// comes back as a *statusError with its code, which the retry policy and the host pool
+// classify errors by
+type coreClient struct {
+	server blockstack.ServerConfig
+	http   *http.Client
+}
+
+// statusError is returned for non 200 responses from the node's REST API
+type statusError struct {
+	Path   string
+	Code   int
+	Status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s returned %s", e.Path, e.Status)
+}
+
+// getJSON fetches a path with an optional query from the node's REST API and unmarshals
+// the response into v, the request is abandoned if ctx is done
+func (c *coreClient) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	u := fmt.Sprintf("%s://%s:%d%s", c.server.Scheme, c.server.Address, c.server.Port, path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &statusError{Path: path, Code: res.StatusCode, Status: res.Status}
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// GetAllNamespaces returns the namespaces on the network
+func (c *coreClient) GetAllNamespaces(ctx context.Context) ([]string, error) {
+	out := []string{}
+	return out, c.getJSON(ctx, "/v1/namespaces", nil, &out)
+}
+
+// GetNamesInNamespace returns a page of the names in a namespace, core pages them by
+// namePageSize and answers past the last page with none
+func (c *coreClient) GetNamesInNamespace(ctx context.Context, ns string, page int) ([]string, error) {
+	out := []string{}
+	return out, c.getJSON(ctx, "/v1/namespaces/"+url.PathEscape(ns)+"/names", url.Values{"page": {strconv.Itoa(page)}}, &out)
+}
+
+// GetNameCount returns the number of names registered across every namespace
+func (c *coreClient) GetNameCount(ctx context.Context) (int, error) {
+	out := struct {
+		NamesCount int `json:"names_count"`
+	}{}
+	return out.NamesCount, c.getJSON(ctx, "/v1/blockchains/bitcoin/name_count", nil, &out)
+}
+
+// GetNameBlockchainRecord returns the record and zonefile of a name, a 404 if there is none
+func (c *coreClient) GetNameBlockchainRecord(ctx context.Context, name string) (BlockchainRecord, error) {
+	out := BlockchainRecord{}
+	return out, c.getJSON(ctx, "/v1/names/"+url.PathEscape(name), nil, &out)
+}
+
+// GetSponsoredNames returns a page of the subdomains sponsored by on-chain names
+func (c *coreClient) GetSponsoredNames(ctx context.Context, page int) ([]string, error) {
+	out := []string{}
+	return out, c.getJSON(ctx, "/v1/subdomains", url.Values{"page": {strconv.Itoa(page)}}, &out)
+}
+
+// GetBlockHeight returns the last block core has processed
+func (c *coreClient) GetBlockHeight(ctx context.Context) (int, error) {
+	out := struct {
+		LastBlockProcessed int `json:"last_block_processed"`
+	}{}
+	return out.LastBlockProcessed, c.getJSON(ctx, "/v1/info", nil, &out)
+}
+
+// GetNamesAtBlock returns the names affected by the name operations in a block
+func (c *coreClient) GetNamesAtBlock(ctx context.Context, height int) ([]string, error) {
+	ops := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := c.getJSON(ctx, fmt.Sprintf("/v1/blockchains/bitcoin/operations/%d", height), nil, &ops); err != nil {
+		return []string{}, err
+	}
+	out := make([]string, 0, len(ops))
+	for _, op := range ops {
+		// Namespace operations don't carry a name
+		if strings.Contains(op.Name, ".") {
+			out = append(out, op.Name)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// stateResolveCursor is the state key holding the last name a full resolution pass got
+	// through with every name before it also done. It is empty once a pass completes
+	stateResolveCursor = "resolveCursor"
+
+	// resolveCheckpointEvery is how many names are resolved between saves of the cursor
+	resolveCheckpointEvery = 100
+)
+
+// ResolveIndexerNames loops through the `names` array on the indexer struct and pulls all the profiles for those names.
+// A pass that was interrupted, by a shutdown or a crash, carries on after the last name it checkpointed
+func (idx *Indexer) ResolveIndexerNames(ctx context.Context) {
+	names := idx.names.current()
+	if cursor, err := idx.DB.FetchState(ctx, stateResolveCursor); err == nil && cursor != "" {
+		i := sort.SearchStrings(names, cursor)
+		if i < len(names) && names[i] == cursor {
+			i++
+		}
+		idx.log(idxPrefix, fmt.Sprintf("resuming profile resolution after %s, %d of %d names left", cursor, len(names)-i, len(names)))
+		names = names[i:]
+	}
+
+	rc := &resolveCursor{idx: idx, names: names, done: make([]bool, len(names))}
+	idx.resolveNames(ctx, names, rc.finish)
+
+	// The final checkpoint has to be saved even when ctx is why the pass stopped
+	wctx := context.WithoutCancel(ctx)
+	if ctx.Err() != nil {
+		rc.save(wctx)
+		return
+	}
+	if err := idx.DB.UpsertState(wctx, stateResolveCursor, ""); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to clear resolution cursor: %s", err))
+	}
+}
+
+// resolveNeeded reports whether the last full resolution pass didn't complete, or there hasn't been one
+func (idx *Indexer) resolveNeeded(ctx context.Context) bool {
+	cursor, err := idx.DB.FetchState(ctx, stateResolveCursor)
+	return err != nil || cursor != ""
+}
+
+// resolveCursor tracks which names of a resolution pass are done. Names finish out of
+// order so the cursor only moves past a name once every name before it is done too
+type resolveCursor struct {
+	idx   *Indexer
+	names []string
+	done  []bool
+	// names[:next] are all done, names[:saved] were done at the last checkpoint
+	next  int
+	saved int
+
+	sync.Mutex
+}
+
+// finish marks names[i] done and checkpoints every resolveCheckpointEvery names
+func (rc *resolveCursor) finish(ctx context.Context, i int) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.done[i] = true
+	for rc.next < len(rc.done) && rc.done[rc.next] {
+		rc.next++
+	}
+	if rc.next-rc.saved >= resolveCheckpointEvery {
+		rc.checkpoint(ctx)
+	}
+}
+
+// save stores the cursor if it moved since the last checkpoint
+func (rc *resolveCursor) save(ctx context.Context) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.next > rc.saved {
+		rc.checkpoint(ctx)
+	}
+}
+
+func (rc *resolveCursor) checkpoint(ctx context.Context) {
+	if err := rc.idx.DB.UpsertState(ctx, stateResolveCursor, rc.names[rc.next-1]); err != nil {
+		rc.idx.log(idxPrefix, fmt.Sprintf("failed to checkpoint profile resolution: %s", err))
+		return
+	}
+	rc.saved = rc.next
+}
@@ -0,0 +1,66 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveIndexerNamesResumes(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	names := fc.names()
+	idx := newTestIndexer(t, fc, db, names)
+	idx.GetAllZonefiles(ctx)
+
+	// A previous pass got through the first 100 names
+	if err := db.UpsertState(ctx, stateResolveCursor, names[99]); err != nil {
+		t.Fatal(err)
+	}
+	if !idx.resolveNeeded(ctx) {
+		t.Fatal("expected an interrupted pass to need resolving")
+	}
+	idx.ResolveIndexerNames(ctx)
+
+	if c := db.ProfilesCount(ctx); c != len(names)-100 {
+		t.Fatalf("expected %d profiles, got %d", len(names)-100, c)
+	}
+	if _, err := db.FetchResolvedAt(ctx, names[99]); err != ErrNotFound {
+		t.Fatalf("expected %s to be skipped, got %v", names[99], err)
+	}
+	if _, err := db.FetchResolvedAt(ctx, names[100]); err != nil {
+		t.Fatalf("expected %s to have a resolution time: %s", names[100], err)
+	}
+	if cursor, err := db.FetchState(ctx, stateResolveCursor); err != nil || cursor != "" {
+		t.Fatalf("expected the cursor to be cleared, got %q, err %v", cursor, err)
+	}
+	if idx.resolveNeeded(ctx) {
+		t.Fatal("expected a completed pass not to need resolving")
+	}
+}
+
+func TestResolveCursorCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	names := fc.names()
+	rc := &resolveCursor{idx: newTestIndexer(t, fc, db, nil), names: names, done: make([]bool, len(names))}
+
+	// Names finishing out of order don't move the cursor past the first one still going
+	for i := 1; i <= 120; i++ {
+		rc.finish(ctx, i)
+	}
+	if _, err := db.FetchState(ctx, stateResolveCursor); err != ErrNotFound {
+		t.Fatalf("expected no checkpoint yet, got %v", err)
+	}
+	rc.finish(ctx, 0)
+	if cursor, _ := db.FetchState(ctx, stateResolveCursor); cursor != names[120] {
+		t.Fatalf("expected the cursor at %s, got %q", names[120], cursor)
+	}
+
+	rc.finish(ctx, 121)
+	rc.save(ctx)
+	if cursor, _ := db.FetchState(ctx, stateResolveCursor); cursor != names[121] {
+		t.Fatalf("expected the cursor at %s, got %q", names[121], cursor)
+	}
+}
@@ -1,24 +1,211 @@
 package indexer
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/btcsuite/btcutil"
 	"github.com/miekg/dns"
 )
 
+// ErrNotFound is returned by DB implementations when a name has no record
+var ErrNotFound = errors.New("not found")
+
+// DBConstructor returns a connected DB for the given config
+type DBConstructor func(cfg *Config) (DB, error)
+
+var (
+	dbDrivers   = make(map[string]DBConstructor)
+	dbDriversMu sync.Mutex
+)
+
+// RegisterDB makes a DB driver available under the name used in DBConfig.Driver
+func RegisterDB(driver string, fn DBConstructor) {
+	dbDriversMu.Lock()
+	defer dbDriversMu.Unlock()
+	if _, ok := dbDrivers[driver]; ok {
+		panic(fmt.Sprintf("db driver %s registered twice", driver))
+	}
+	dbDrivers[driver] = fn
+}
+
+// NewDB returns the DB for the driver configured in cfg.DB.Driver, defaulting to mongo
+func NewDB(cfg *Config) (DB, error) {
+	driver := cfg.DB.Driver
+	if driver == "" {
+		driver = "mongo"
+	}
+	dbDriversMu.Lock()
+	fn, ok := dbDrivers[driver]
+	dbDriversMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown db driver %q", driver)
+	}
+	return fn(cfg)
+}
+
 // IndexerDB is the database driver interface for the Indexer
 type DB interface {
-	UpsertNameZonefile(name, zonefile string) error
-	ZonefilesCount() int
-	ProfilesCount() int
-	FetchZonefile(name string) (NameZonefile, error)
-	UpsertProfile(name string, profile Profile) error
+	UpsertNameZonefile(ctx context.Context, name, hash, zonefile string) error
+	UpsertNameZonefiles(ctx context.Context, zfs []ZonefileRecord) error
+	ZonefilesCount(ctx context.Context) int
+	ProfilesCount(ctx context.Context) int
+	FetchZonefile(ctx context.Context, name string) (NameZonefile, error)
+	UpsertProfile(ctx context.Context, rec ProfileRecord) error
+	FetchProfile(ctx context.Context, name string) (ProfileRecord, error)
+	EachProfile(ctx context.Context, fn func(rec ProfileRecord) error) error
+	UpsertNameRecord(ctx context.Context, rec NameRecord) error
+	FetchNameRecord(ctx context.Context, name string) (NameRecord, error)
+	EachNameRecord(ctx context.Context, fn func(rec NameRecord) error) error
+	PurgeName(ctx context.Context, name string) error
+	UpsertState(ctx context.Context, key, value string) error
+	FetchState(ctx context.Context, key string) (string, error)
+	UpsertDeadLetter(ctx context.Context, dl DeadLetter) error
+	FetchDeadLetter(ctx context.Context, name string) (DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, name string) error
+	EachDeadLetter(ctx context.Context, fn func(dl DeadLetter) error) error
+	UpsertResolvedAt(ctx context.Context, name string, t time.Time) error
+	FetchResolvedAt(ctx context.Context, name string) (time.Time, error)
+	EachResolvedAt(ctx context.Context, fn func(name string, t time.Time) error) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Profile verification statuses, the result of checking the key that signed a
+// profile against the owner of the name
+const (
+	ProfileVerified      = "verified"
+	ProfileOwnerMismatch = "owner_mismatch"
+	ProfileOwnerUnknown  = "owner_unknown"
+	// ProfileInvalid is a profile stored before the name's profile went missing, stopped
+	// verifying or stopped being a person's
+	ProfileInvalid = "invalid"
+)
+
+// ProfileRecord is a stored profile along with its verification status
+type ProfileRecord struct {
+	Name         string  `json:"name" bson:"_id"`
+	Profile      Profile `json:"profile" bson:"profile"`
+	Verification string  `json:"verification" bson:"verification"`
+}
+
+// Verified returns true if the profile was signed by the name owner
+func (pr ProfileRecord) Verified() bool {
+	return pr.Verification == ProfileVerified
+}
+
+// Name statuses, from the name's blockchain record and the current block height
+const (
+	NameActive  = "active"
+	NameExpired = "expired"
+	NameRevoked = "revoked"
+)
+
+// NameRecord holds what the indexer keeps from a name's blockchain record. The record of
+// an expired or revoked name is kept as a tombstone once its zonefile and profile are purged
+type NameRecord struct {
+	Name   string `json:"name" bson:"_id"`
+	Owner  string `json:"owner" bson:"owner"`
+	Status string `json:"status" bson:"status"`
+	// ExpireBlock is the block the name expires after, zero or less if it never does
+	ExpireBlock int `json:"expireBlock" bson:"expireBlock"`
+}
+
+// Active returns false for expired and revoked names. Records stored before statuses
+// were tracked have none and are active
+func (nr NameRecord) Active() bool {
+	return nr.Status == "" || nr.Status == NameActive
+}
+
+// DeadLetter records a name the indexer failed to process, at which stage and why,
+// so it can be looked at and retried
+type DeadLetter struct {
+	Name     string    `json:"name" bson:"_id"`
+	Stage    string    `json:"stage" bson:"stage"`
+	Error    string    `json:"error" bson:"error"`
+	Attempts int       `json:"attempts" bson:"attempts"`
+	Time     time.Time `json:"time" bson:"time"`
+}
+
+// ZonefileRecord is a zonefile to store under a name along with its hash
+type ZonefileRecord struct {
+	Name     string
+	Hash     string
+	Zonefile string
 }
 
 // NameZonefile represents a return from the database for fetching a name/zonefile pair
 // convinence methods for pulling out different resource records
 type NameZonefile interface {
+	Hash() string
 	URI() ([]*dns.URI, error)
 	URL() ([]*url.URL, error)
 	TXT() ([]*dns.TXT, error)
 }
+
+// zonefileHash returns the RIPEMD160(SHA256(zonefile)) hex digest core uses as a name's value hash
+func zonefileHash(zonefile string) string {
+	return hex.EncodeToString(btcutil.Hash160([]byte(zonefile)))
+}
+
+// originRegexp matches $ORIGIN lines, blockstack zonefiles leave off the trailing dot
+var originRegexp = regexp.MustCompile(`(?m)^\$ORIGIN[ \t]+([^ \t\r\n]*[^. \t\r\n])[ \t]*$`)
+
+// normalizeZonefile makes the $ORIGIN fully qualified so the zonefile parses
+func normalizeZonefile(zonefile string) string {
+	return originRegexp.ReplaceAllString(zonefile, "$$ORIGIN $1.")
+}
+
+// zonefileURI returns the URI records from a zonefile
+func zonefileURI(zonefile string) ([]*dns.URI, error) {
+	out := make([]*dns.URI, 0)
+	for x := range dns.ParseZone(strings.NewReader(normalizeZonefile(zonefile)), "", "") {
+		if x.Error != nil {
+			return out, x.Error
+		}
+		uri, ok := x.RR.(*dns.URI)
+		if ok {
+			out = append(out, uri)
+		}
+	}
+	return out, nil
+}
+
+// zonefileTXT returns the TXT records from a zonefile
+func zonefileTXT(zonefile string) ([]*dns.TXT, error) {
+	out := make([]*dns.TXT, 0)
+	for x := range dns.ParseZone(strings.NewReader(normalizeZonefile(zonefile)), "", "") {
+		if x.Error != nil {
+			return out, x.Error
+		}
+		txt, ok := x.RR.(*dns.TXT)
+		if ok {
+			out = append(out, txt)
+		}
+	}
+	return out, nil
+}
+
+// zonefileURL returns the parsable targets of the URI records in a zonefile
+func zonefileURL(zonefile string) ([]*url.URL, error) {
+	out := make([]*url.URL, 0)
+	uri, err := zonefileURI(zonefile)
+	if err != nil {
+		return out, err
+	}
+	for _, u := range uri {
+		ur, err := url.Parse(u.Target)
+		if err != nil {
+			continue
+		}
+		out = append(out, ur)
+	}
+	return out, nil
+}
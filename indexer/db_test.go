@@ -0,0 +1,263 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const testZonefile = `$ORIGIN muneeb.id.
+$TTL 3600
+_http._tcp IN URI 10 1 "https://gaia.blockstack.org/hub/1J3PUxY5uDShUnHRrMyU6yKtoHEUPhKULs/0/profile.json"
+`
+
+// testDBZonefiles exercises the zonefile half of a DB implementation, db must be empty
+func testDBZonefiles(t *testing.T, db DB) {
+	ctx := context.Background()
+	if _, err := db.FetchZonefile(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := db.UpsertNameZonefile(ctx, "muneeb.id", zonefileHash("stale"), "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertNameZonefile(ctx, "muneeb.id", zonefileHash(testZonefile), testZonefile); err != nil {
+		t.Fatal(err)
+	}
+	if c := db.ZonefilesCount(ctx); c != 1 {
+		t.Fatalf("expected 1 zonefile, got %d", c)
+	}
+
+	zf, err := db.FetchZonefile(ctx, "muneeb.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zf.Hash() != zonefileHash(testZonefile) {
+		t.Fatalf("expected hash %s, got %s", zonefileHash(testZonefile), zf.Hash())
+	}
+	urls, err := zf.URL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0].Host != "gaia.blockstack.org" {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+
+	// A batch overwrites the names it already has and adds the rest
+	batch := []ZonefileRecord{
+		{Name: "muneeb.id", Hash: zonefileHash("batched"), Zonefile: "batched"},
+		{Name: "jude.id", Hash: zonefileHash(testZonefile), Zonefile: testZonefile},
+	}
+	if err := db.UpsertNameZonefiles(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if c := db.ZonefilesCount(ctx); c != 2 {
+		t.Fatalf("expected 2 zonefiles, got %d", c)
+	}
+	for _, want := range batch {
+		zf, err := db.FetchZonefile(ctx, want.Name)
+		if err != nil || zf.Hash() != want.Hash {
+			t.Fatalf("expected %s stored with hash %s, got %v, err %v", want.Name, want.Hash, zf, err)
+		}
+	}
+}
+
+// testDBProfiles exercises the profile half of a DB implementation, db must be empty
+func testDBProfiles(t *testing.T, db DB) {
+	ctx := context.Background()
+	if _, err := db.FetchProfile(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	rec := ProfileRecord{
+		Name: "muneeb.id",
+		Profile: Profile{
+			Type:    "Person",
+			Name:    "Muneeb Ali",
+			Account: []Account{{Service: "twitter", Identifier: "muneeb"}},
+		},
+		Verification: ProfileVerified,
+	}
+	if err := db.UpsertProfile(ctx, ProfileRecord{Name: "muneeb.id", Profile: Profile{Type: "Person"}, Verification: ProfileOwnerMismatch}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertProfile(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if c := db.ProfilesCount(ctx); c != 1 {
+		t.Fatalf("expected 1 profile, got %d", c)
+	}
+
+	got, err := db.FetchProfile(ctx, "muneeb.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != rec.Name || got.Profile.Name != rec.Profile.Name || !got.Verified() ||
+		len(got.Profile.Account) != 1 || got.Profile.Account[0].Identifier != "muneeb" {
+		t.Fatalf("unexpected profile record %+v", got)
+	}
+
+	seen := 0
+	err = db.EachProfile(ctx, func(r ProfileRecord) error {
+		seen++
+		if r.Name != rec.Name {
+			t.Errorf("unexpected profile record %+v", r)
+		}
+		return nil
+	})
+	if err != nil || seen != 1 {
+		t.Fatalf("EachProfile returned %d profiles, err %v", seen, err)
+	}
+}
+
+// testDBNameRecords exercises name record storage, db must be empty
+func testDBNameRecords(t *testing.T, db DB) {
+	ctx := context.Background()
+	if _, err := db.FetchNameRecord(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := db.UpsertNameRecord(ctx, NameRecord{Name: "muneeb.id", Owner: "1stale"}); err != nil {
+		t.Fatal(err)
+	}
+	rec := NameRecord{Name: "muneeb.id", Owner: "1J3PUxY5uDShUnHRrMyU6yKtoHEUPhKULs", Status: NameActive, ExpireBlock: 700000}
+	if err := db.UpsertNameRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.FetchNameRecord(ctx, "muneeb.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rec {
+		t.Fatalf("expected %+v, got %+v", rec, got)
+	}
+	seen := []NameRecord{}
+	err = db.EachNameRecord(ctx, func(nr NameRecord) error {
+		seen = append(seen, nr)
+		return nil
+	})
+	if err != nil || len(seen) != 1 || seen[0] != rec {
+		t.Fatalf("EachNameRecord returned %+v, err %v", seen, err)
+	}
+}
+
+// testDBPurgeName checks purging a name leaves only its name record, db must be empty
+func testDBPurgeName(t *testing.T, db DB) {
+	ctx := context.Background()
+	rec := NameRecord{Name: "muneeb.id", Owner: "1J3PUxY5uDShUnHRrMyU6yKtoHEUPhKULs", Status: NameExpired}
+	if err := db.UpsertNameRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertNameZonefile(ctx, "muneeb.id", zonefileHash(testZonefile), testZonefile); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertProfile(ctx, ProfileRecord{Name: "muneeb.id", Profile: Profile{Type: "Person"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertResolvedAt(ctx, "muneeb.id", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PurgeName(ctx, "muneeb.id"); err != nil {
+		t.Fatal(err)
+	}
+	// Purging twice is fine
+	if err := db.PurgeName(ctx, "muneeb.id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FetchZonefile(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected the zonefile purged, got %v", err)
+	}
+	if _, err := db.FetchProfile(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected the profile purged, got %v", err)
+	}
+	if _, err := db.FetchResolvedAt(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected the resolution time purged, got %v", err)
+	}
+	if got, err := db.FetchNameRecord(ctx, "muneeb.id"); err != nil || got != rec {
+		t.Fatalf("expected the name record kept as a tombstone, got %+v, err %v", got, err)
+	}
+}
+
+// testDBState exercises indexer state storage, db must be empty
+func testDBState(t *testing.T, db DB) {
+	ctx := context.Background()
+	if _, err := db.FetchState(ctx, "lastBlock"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	for _, v := range []string{"1", "500000"} {
+		if err := db.UpsertState(ctx, "lastBlock", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := db.FetchState(ctx, "lastBlock"); err != nil || v != "500000" {
+		t.Fatalf("expected 500000, got %q, err %v", v, err)
+	}
+}
+
+// testDBDeadLetters exercises the dead letter half of a DB implementation, db must be empty
+func testDBDeadLetters(t *testing.T, db DB) {
+	ctx := context.Background()
+	if _, err := db.FetchDeadLetter(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, dl := range []DeadLetter{
+		{Name: "muneeb.id", Stage: "nameDetails", Error: "timeout", Attempts: 1, Time: now},
+		{Name: "muneeb.id", Stage: "zonefiles", Error: "502 Bad Gateway", Attempts: 2, Time: now},
+		{Name: "alice.id", Stage: "nameDetails", Error: "timeout", Attempts: 1, Time: now},
+	} {
+		if err := db.UpsertDeadLetter(ctx, dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dl, err := db.FetchDeadLetter(ctx, "muneeb.id")
+	if err != nil || dl.Stage != "zonefiles" || dl.Attempts != 2 || !dl.Time.Equal(now) {
+		t.Fatalf("unexpected dead letter %+v, err %v", dl, err)
+	}
+
+	names := []string{}
+	err = db.EachDeadLetter(ctx, func(dl DeadLetter) error {
+		names = append(names, dl.Name)
+		return nil
+	})
+	if err != nil || len(names) != 2 || names[0] != "alice.id" || names[1] != "muneeb.id" {
+		t.Fatalf("EachDeadLetter returned %v, err %v", names, err)
+	}
+
+	if err := db.DeleteDeadLetter(ctx, "muneeb.id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteDeadLetter(ctx, "muneeb.id"); err != nil {
+		t.Fatalf("expected deleting a missing dead letter to succeed, got %v", err)
+	}
+	if _, err := db.FetchDeadLetter(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// testDBResolvedAt exercises resolution timestamp storage, db must be empty
+func testDBResolvedAt(t *testing.T, db DB) {
+	ctx := context.Background()
+	if _, err := db.FetchResolvedAt(ctx, "muneeb.id"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, ts := range []time.Time{now.Add(-time.Hour), now} {
+		if err := db.UpsertResolvedAt(ctx, "muneeb.id", ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := db.FetchResolvedAt(ctx, "muneeb.id"); err != nil || !got.Equal(now) {
+		t.Fatalf("expected %s, got %s, err %v", now, got, err)
+	}
+	if err := db.UpsertResolvedAt(ctx, "alice.id", now); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]time.Time{}
+	err := db.EachResolvedAt(ctx, func(name string, ts time.Time) error {
+		seen[name] = ts
+		return nil
+	})
+	if err != nil || len(seen) != 2 || !seen["muneeb.id"].Equal(now) || !seen["alice.id"].Equal(now) {
+		t.Fatalf("EachResolvedAt returned %v, err %v", seen, err)
+	}
+}
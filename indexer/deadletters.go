@@ -0,0 +1,183 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The stages of the pipeline a name can be dead lettered at
+const (
+	stageNamespaces  = "namespaces"
+	stageNamePage    = "namePage"
+	stageNameDetails = "nameDetails"
+	stageZonefiles   = "zonefiles"
+)
+
+// deadLetterNamespaces is the name the namespaces listing is dead lettered under
+const deadLetterNamespaces = "*"
+
+// namePageDeadLetter returns the name a page of names is dead lettered under, {namespace}/{page}
+func namePageDeadLetter(ns string, page int) string {
+	return fmt.Sprintf("%s/%d", ns, page)
+}
+
+// nameWalkDeadLetter returns the name a walk through a namespace's pages that stopped is dead
+// lettered under, {namespace}/{page}+{step}
+func nameWalkDeadLetter(ns string, page, step int) string {
+	return fmt.Sprintf("%s/%d+%d", ns, page, step)
+}
+
+// parseNamePageDeadLetter splits a name page or name walk dead letter back into its
+// namespace, page and step. A single page has a step of 0
+func parseNamePageDeadLetter(name string) (ns string, page, step int, err error) {
+	sep := strings.LastIndex(name, "/")
+	if sep < 0 {
+		return "", 0, 0, fmt.Errorf("malformed name page %q", name)
+	}
+	ns, rest := name[:sep], name[sep+1:]
+	if plus := strings.Index(rest, "+"); plus >= 0 {
+		if step, err = strconv.Atoi(rest[plus+1:]); err != nil || step < 1 {
+			return "", 0, 0, fmt.Errorf("malformed name page %q", name)
+		}
+		rest = rest[:plus]
+	}
+	if page, err = strconv.Atoi(rest); err != nil {
+		return "", 0, 0, fmt.Errorf("malformed name page %q", name)
+	}
+	return ns, page, step, nil
+}
+
+// deadLetter records that name failed at stage so the pipeline can carry on without it
+func (idx *Indexer) deadLetter(ctx context.Context, stage, name string, err error) {
+	dl := DeadLetter{Name: name, Stage: stage, Error: err.Error(), Attempts: 1, Time: time.Now()}
+	if prev, ferr := idx.DB.FetchDeadLetter(ctx, name); ferr == nil {
+		dl.Attempts = prev.Attempts + 1
+	}
+	idx.log(idxPrefix, fmt.Sprintf("dead lettering %s at %s after %d attempts: %s", name, stage, dl.Attempts, err))
+	if uerr := idx.DB.UpsertDeadLetter(ctx, dl); uerr != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to store dead letter for %s: %s", name, uerr))
+	}
+	idx.deadLettered.add([]string{name})
+	idx.ST.Rec(StatDeadLetters.Counter(stage), 1)
+}
+
+// loadDeadLetters reads the names with a dead letter stored from the database
+func (idx *Indexer) loadDeadLetters(ctx context.Context) {
+	err := idx.DB.EachDeadLetter(ctx, func(dl DeadLetter) error {
+		idx.deadLettered.add([]string{dl.Name})
+		return nil
+	})
+	if err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to load dead letters: %s", err))
+	}
+}
+
+// clearDeadLetter removes the dead letter for a name a normal pass has since indexed
+func (idx *Indexer) clearDeadLetter(ctx context.Context, name string) {
+	if !idx.deadLettered.has(name) {
+		return
+	}
+	if err := idx.DB.DeleteDeadLetter(ctx, name); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to clear dead letter for %s: %s", name, err))
+		return
+	}
+	idx.deadLettered.remove([]string{name})
+	idx.ST.Rec(statDeadLettersCleared, 1)
+}
+
+// DeadLetters returns every dead lettered name in name order
+func (idx *Indexer) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	out := make([]DeadLetter, 0)
+	err := idx.DB.EachDeadLetter(ctx, func(dl DeadLetter) error {
+		out = append(out, dl)
+		return nil
+	})
+	return out, err
+}
+
+// RetryDeadLetters runs the passed dead lettered names, or all of them if none are passed,
+// back through the stage they failed at. Names that make it through are removed from the
+// store, the rest stay with their attempt count bumped. It returns how many succeeded
+func (idx *Indexer) RetryDeadLetters(ctx context.Context, names []string) (int, error) {
+	if len(names) == 0 {
+		dls, err := idx.DeadLetters(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, dl := range dls {
+			names = append(names, dl.Name)
+		}
+	}
+
+	succeeded := 0
+	for _, name := range names {
+		dl, err := idx.DB.FetchDeadLetter(ctx, name)
+		if err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("no dead letter for %s: %s", name, err))
+			continue
+		}
+		if err := idx.retryDeadLetter(ctx, dl); err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("can't retry dead letter for %s: %s", name, err))
+			continue
+		}
+		// An interrupted retry hasn't shown anything either way
+		if err := ctx.Err(); err != nil {
+			return succeeded, err
+		}
+
+		// Every stage dead letters the name again if it fails
+		after, err := idx.DB.FetchDeadLetter(ctx, name)
+		if err == nil && !after.Time.Equal(dl.Time) {
+			continue
+		}
+		// A stage that succeeded has usually cleared it already
+		if err := idx.DB.DeleteDeadLetter(ctx, name); err != nil {
+			return succeeded, err
+		}
+		idx.deadLettered.remove([]string{name})
+		idx.ST.Rec(statDeadLettersRetried, 1)
+		succeeded++
+	}
+	return succeeded, nil
+}
+
+// retryDeadLetter reruns the stage a dead letter failed at and the stages after it.
+// It only returns an error for dead letters it doesn't know how to retry
+func (idx *Indexer) retryDeadLetter(ctx context.Context, dl DeadLetter) error {
+	switch dl.Stage {
+	case stageNamespaces:
+		if _, err := idx.GetAllNames(ctx); err == nil {
+			idx.ResolveNames(ctx, idx.GetZonefilesFor(ctx, idx.names.current()))
+		}
+	case stageNamePage:
+		ns, page, step, err := parseNamePageDeadLetter(dl.Name)
+		if err != nil {
+			return err
+		}
+		var names []string
+		if step == 0 {
+			if names, err = idx.fetchNamePage(ctx, ns, page); err != nil {
+				idx.deadLetter(ctx, stageNamePage, dl.Name, err)
+				return nil
+			}
+		} else {
+			// A walk that stopped picks up from the page it stopped at, its pages that fail
+			// again are dead lettered as it goes
+			w := &nameWalk{ns: ns, page: page, step: step}
+			err := idx.walkNamePages(ctx, w, func(page []string) { names = append(names, page...) })
+			if err != nil {
+				idx.deadLetter(ctx, stageNamePage, dl.Name, err)
+			}
+		}
+		idx.names.add(names)
+		idx.ResolveNames(ctx, idx.GetZonefilesFor(ctx, names))
+	case stageNameDetails, stageZonefiles:
+		idx.ResolveNames(ctx, idx.GetZonefilesFor(ctx, []string{dl.Name}))
+	default:
+		return fmt.Errorf("unknown stage %q", dl.Stage)
+	}
+	return nil
+}
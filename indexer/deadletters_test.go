@@ -0,0 +1,198 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// brokenCore wraps a Core and fails the name record lookups for the names in broken, and
+// the pages of names whose {namespace}/{page} is in it
+type brokenCore struct {
+	Core
+
+	broken map[string]bool
+	sync.Mutex
+}
+
+func (b *brokenCore) setBroken(name string, broken bool) {
+	b.Lock()
+	b.broken[name] = broken
+	b.Unlock()
+}
+
+func (b *brokenCore) GetNameBlockchainRecord(ctx context.Context, name string) (BlockchainRecord, error) {
+	b.Lock()
+	broken := b.broken[name]
+	b.Unlock()
+	if broken {
+		return BlockchainRecord{}, &statusError{Path: "/v1/names/" + name, Code: http.StatusBadGateway, Status: "502 Bad Gateway"}
+	}
+	return b.Core.GetNameBlockchainRecord(ctx, name)
+}
+
+func (b *brokenCore) GetNamesInNamespace(ctx context.Context, ns string, page int) ([]string, error) {
+	b.Lock()
+	broken := b.broken[namePageDeadLetter(ns, page)]
+	b.Unlock()
+	if broken {
+		return nil, &statusError{Path: "/v1/namespaces/" + ns + "/names", Code: http.StatusBadGateway, Status: "502 Bad Gateway"}
+	}
+	return b.Core.GetNamesInNamespace(ctx, ns, page)
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	bc := &brokenCore{Core: fc, broken: map[string]bool{"alice.app": true}}
+	idx.BSK = bc
+
+	// One failing name doesn't stop the rest being indexed
+	idx.GetAllZonefiles(ctx)
+	if n := db.ZonefilesCount(ctx); n != len(fc.names())-1 {
+		t.Fatalf("expected every other zonefile to be stored, got %d", n)
+	}
+	dl, err := db.FetchDeadLetter(ctx, "alice.app")
+	if err != nil || dl.Stage != stageNameDetails || dl.Attempts != 1 || dl.Error == "" {
+		t.Fatalf("unexpected dead letter %+v, err %v", dl, err)
+	}
+
+	// Retrying while the name still fails bumps its attempts
+	if n, err := idx.RetryDeadLetters(ctx, nil); err != nil || n != 0 {
+		t.Fatalf("expected no dead letters to succeed, got %d, err %v", n, err)
+	}
+	if dl, _ := db.FetchDeadLetter(ctx, "alice.app"); dl.Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", dl.Attempts)
+	}
+
+	// Once it's fixed a retry indexes it and clears the dead letter
+	bc.setBroken("alice.app", false)
+	if n, err := idx.RetryDeadLetters(ctx, []string{"alice.app"}); err != nil || n != 1 {
+		t.Fatalf("expected the dead letter to succeed, got %d, err %v", n, err)
+	}
+	if _, err := db.FetchDeadLetter(ctx, "alice.app"); err != ErrNotFound {
+		t.Fatalf("expected the dead letter to be removed, got %v", err)
+	}
+	if p, err := db.FetchProfile(ctx, "alice.app"); err != nil || p.Profile.Name != "Alice Appleseed" {
+		t.Fatalf("expected alice.app to be resolved, got %+v, err %v", p, err)
+	}
+}
+
+func TestDeadLettersClearedByLaterPass(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	bc := &brokenCore{Core: fc, broken: map[string]bool{"alice.app": true}}
+	idx.BSK = bc
+	idx.GetAllZonefiles(ctx)
+	if _, err := db.FetchDeadLetter(ctx, "alice.app"); err != nil {
+		t.Fatalf("expected alice.app to be dead lettered, got %v", err)
+	}
+
+	// A normal pass that writes the zonefile clears the dead letter without a retry
+	bc.setBroken("alice.app", false)
+	idx.GetAllZonefiles(ctx)
+	if _, err := db.FetchDeadLetter(ctx, "alice.app"); err != ErrNotFound {
+		t.Fatalf("expected the zonefile write to clear the dead letter, got %v", err)
+	}
+
+	// So does storing a profile, and dead letters already in the database are known about
+	db.UpsertDeadLetter(ctx, DeadLetter{Name: "bob.app", Stage: stageZonefiles, Error: "boom", Attempts: 1})
+	idx = newTestIndexer(t, fc, db, fc.names())
+	idx.ResolveNames(ctx, []string{"bob.app"})
+	if _, err := db.FetchDeadLetter(ctx, "bob.app"); err != ErrNotFound {
+		t.Fatalf("expected the profile write to clear the dead letter, got %v", err)
+	}
+	if c := idx.ST.Count(statDeadLettersCleared); c != 1 {
+		t.Fatalf("expected 1 cleared dead letter, got %d", c)
+	}
+}
+
+func TestNamePageDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	// 450 names are 5 pages, walked by 4 workers from page 1 once page 0 comes back full
+	for i := 0; i < 450; i++ {
+		fc.addName(fmt.Sprintf("name%03d.big", i), "")
+	}
+	page := func(p int) []string {
+		return fixturePage(fc.namespaces["big"], p)
+	}
+	db := NewMemDB()
+	known := make([]string, 0)
+	for _, n := range fc.names() {
+		if n < page(1)[0] || n > page(2)[len(page(2))-1] {
+			known = append(known, n)
+		}
+	}
+	idx := newTestIndexer(t, fc, db, known)
+	bc := &brokenCore{Core: fc, broken: map[string]bool{"big/1": true}}
+	idx.BSK = bc
+
+	// The walk that page 1 fails on carries on, and the pass removes nothing
+	diff, err := idx.GetAllNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, NameDiff{Added: page(2), Removed: []string{}}) {
+		t.Fatalf("expected page 2 added and nothing removed, got %d added and %v removed", len(diff.Added), diff.Removed)
+	}
+	for _, n := range []string{page(3)[0], page(4)[0]} {
+		if !idx.names.has(n) {
+			t.Fatalf("expected %s to be fetched", n)
+		}
+	}
+	dl, err := db.FetchDeadLetter(ctx, "big/1")
+	if err != nil || dl.Stage != stageNamePage {
+		t.Fatalf("unexpected dead letter %+v, err %v", dl, err)
+	}
+	if dls, _ := idx.DeadLetters(ctx); len(dls) != 1 {
+		t.Fatalf("expected only page 1 dead lettered, got %+v", dls)
+	}
+
+	// Retrying the page fetches its names
+	bc.setBroken("big/1", false)
+	if n, err := idx.RetryDeadLetters(ctx, nil); n != 1 || err != nil {
+		t.Fatalf("expected the page to be retried, got %d, %v", n, err)
+	}
+	if !idx.names.has(page(1)[0]) {
+		t.Fatal("expected page 1's names after the retry")
+	}
+
+	// A namespace whose first page fails is left to a retry that walks all of it, as is the
+	// rest of a walk that fails too many pages in a row
+	idx = newTestIndexer(t, fc, NewMemDB(), nil)
+	bc = &brokenCore{Core: fc, broken: map[string]bool{"big/0": true}}
+	idx.BSK = bc
+	idx.GetAllNames(ctx)
+	if idx.names.has(page(1)[0]) {
+		t.Fatal("expected no walk past a failed first page")
+	}
+	bc.setBroken("big/0", false)
+	for _, p := range []int{1, 2, 3} {
+		bc.setBroken(namePageDeadLetter("big", p), true)
+	}
+	if n, _ := idx.RetryDeadLetters(ctx, []string{"big/0+1"}); n != 0 {
+		t.Fatal("expected the walk to fail again")
+	}
+	if !idx.names.has(page(0)[0]) || idx.names.has(page(4)[0]) {
+		t.Fatal("expected the walk to fetch page 0 and stop before page 4")
+	}
+	bc.setBroken("big/1", false)
+	bc.setBroken("big/2", false)
+	bc.setBroken("big/3", false)
+	if n, _ := idx.RetryDeadLetters(ctx, []string{"big/0+1"}); n != 1 {
+		t.Fatal("expected the walk to be retried")
+	}
+	for p := 0; p < 5; p++ {
+		if !idx.names.has(page(p)[0]) {
+			t.Fatalf("expected page %d's names after the retry", p)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package indexer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blockstack/blockstack.go/blockstack"
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// fakeRecord is the fixture for a single name's blockchain record
+type fakeRecord struct {
+	Address     string
+	ValueHash   string
+	ExpireBlock int
+	Revoked     bool
+}
+
+// fakeCore is an httptest backed stand in for a blockstack-core node. It serves
+// namespaces, names, name records with their zonefiles and the profiles the
+// zonefiles point at from fixtures, in the shapes core's REST API answers with.
+// It implements Core with a real core client pointed at itself
+type fakeCore struct {
+	Core
+
+	Server *httptest.Server
+
+	namespaces map[string][]string
+	records    map[string]fakeRecord
+	zonefiles  map[string]string
+	profiles   map[string][]byte
+
+	// subdomain TXT records by domain and the list of sponsored names
+	subdomainTXT map[string][]string
+	sponsored    []string
+
+	// current block height and the names operated on in each block
+	height int
+	ops    map[int][]string
+
+	// key used to sign fixture profiles
+	key *btcec.PrivateKey
+
+	// number of requests served by path prefix
+	calls map[string]int
+
+	sync.Mutex
+}
+
+// newFakeCore starts an empty fake core node that is shut down when the test ends
+func newFakeCore(t *testing.T) *fakeCore {
+	fc := &fakeCore{
+		namespaces: make(map[string][]string),
+		records:    make(map[string]fakeRecord),
+		zonefiles:  make(map[string]string),
+		profiles:   make(map[string][]byte),
+		calls:      make(map[string]int),
+		key:        testKey(1),
+		height:     100,
+		ops:        make(map[int][]string),
+
+		subdomainTXT: make(map[string][]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/namespaces", fc.handleNamespaces)
+	mux.HandleFunc("/v1/namespaces/", fc.handleNamespace)
+	mux.HandleFunc("/v1/names/", fc.handleName)
+	mux.HandleFunc("/v1/subdomains", fc.handleSubdomains)
+	mux.HandleFunc("/v1/info", fc.handleInfo)
+	mux.HandleFunc("/v1/blockchains/bitcoin/name_count", fc.handleNameCount)
+	mux.HandleFunc("/v1/blockchains/bitcoin/operations/", fc.handleOperations)
+	mux.HandleFunc("/hub/", fc.handleProfile)
+	fc.Server = httptest.NewServer(mux)
+	t.Cleanup(fc.Server.Close)
+	fc.Core = NewCoreClient(fc.serverConfig())
+	return fc
+}
+
+// addName registers a name with a zonefile pointing at a profile served by the fake node
+func (fc *fakeCore) addName(name, displayName string) {
+	fc.Lock()
+	defer fc.Unlock()
+	ns := name[strings.LastIndex(name, ".")+1:]
+	fc.namespaces[ns] = append(fc.namespaces[ns], name)
+	sort.Strings(fc.namespaces[ns])
+	fc.records[name] = fakeRecord{Address: testAddress(fc.key)}
+	fc.profiles[name] = fc.signedProfile(fc.key, displayName)
+	fc.setZonefile(name, fc.zonefile(name, ""))
+}
+
+// addSubdomain registers a subdomain of an existing name, owned by key, by adding
+// a TXT record to the domain's zonefile and listing it as a sponsored name
+func (fc *fakeCore) addSubdomain(domain, label, displayName string, key *btcec.PrivateKey) {
+	fc.Lock()
+	defer fc.Unlock()
+	name := label + "." + domain
+	b64 := base64.StdEncoding.EncodeToString([]byte(fc.zonefile(name, "")))
+
+	// TXT strings are limited to 255 bytes so the zonefile is split into parts
+	txt := fmt.Sprintf("%s IN TXT \"owner=%s\" \"seqn=0\"", label, testAddress(key))
+	parts := 0
+	for ; len(b64) > 0; parts++ {
+		n := 200
+		if n > len(b64) {
+			n = len(b64)
+		}
+		txt += fmt.Sprintf(" \"zf%d=%s\"", parts, b64[:n])
+		b64 = b64[n:]
+	}
+	txt += fmt.Sprintf(" \"parts=%d\"", parts)
+
+	fc.subdomainTXT[domain] = append(fc.subdomainTXT[domain], txt)
+	fc.sponsored = append(fc.sponsored, name)
+	fc.profiles[name] = fc.signedProfile(key, displayName)
+	fc.setZonefile(domain, fc.zonefile(domain, strings.Join(fc.subdomainTXT[domain], "\n")))
+}
+
+// updateName gives an existing name a new profile and a zonefile with a new hash
+func (fc *fakeCore) updateName(name, displayName string) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.profiles[name] = fc.signedProfile(fc.key, displayName)
+	fc.setZonefile(name, fc.zonefile(name, fmt.Sprintf("; updated at %d", fc.height+1)))
+}
+
+// removeProfile makes fetching a name's profile 404
+func (fc *fakeCore) removeProfile(name string) {
+	fc.Lock()
+	defer fc.Unlock()
+	delete(fc.profiles, name)
+}
+
+// tamperZonefile changes the zonefile served for a name without changing its record's hash
+func (fc *fakeCore) tamperZonefile(name, zonefile string) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.zonefiles[fc.records[name].ValueHash] = zonefile
+}
+
+// mine adds a block containing an operation on each of the passed names
+func (fc *fakeCore) mine(names ...string) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.height++
+	fc.ops[fc.height] = names
+}
+
+// zonefile builds a zonefile for name pointing at its profile on the fake node, fc must be locked
+func (fc *fakeCore) zonefile(name, extra string) string {
+	return fmt.Sprintf("$ORIGIN %s\n$TTL 3600\n_http._tcp IN URI 10 1 \"%s/hub/%s/profile.json\"\n%s\n", name, fc.Server.URL, name, extra)
+}
+
+// setZonefile stores a zonefile and points the name's record at its hash, fc must be locked
+func (fc *fakeCore) setZonefile(name, zonefile string) {
+	hash := zonefileHash(zonefile)
+	rec := fc.records[name]
+	rec.ValueHash = hash
+	fc.records[name] = rec
+	fc.zonefiles[hash] = zonefile
+}
+
+// signedProfile returns the profile.json body for a profile signed by key
+func (fc *fakeCore) signedProfile(key *btcec.PrivateKey, displayName string) []byte {
+	claim := Profile{Type: "Person", Name: displayName}
+	profile := []*ProfileTokenFile{{
+		Token: signProfileToken(key, claim),
+		DecodedToken: DecodedToken{
+			Payload: Payload{Claim: claim},
+		},
+	}}
+	byt, err := json.Marshal(profile)
+	if err != nil {
+		panic(err)
+	}
+	return byt
+}
+
+// names returns every name on the fake node in sorted order
+func (fc *fakeCore) names() []string {
+	fc.Lock()
+	defer fc.Unlock()
+	out := []string{}
+	for _, names := range fc.namespaces {
+		out = append(out, names...)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// callCount returns the number of requests served under a path prefix
+func (fc *fakeCore) callCount(prefix string) int {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.calls[prefix]
+}
+
+func (fc *fakeCore) record(prefix string) {
+	fc.Lock()
+	fc.calls[prefix]++
+	fc.Unlock()
+}
+
+// setOwner changes the owner address in a name's record
+func (fc *fakeCore) setOwner(name, address string) {
+	fc.Lock()
+	defer fc.Unlock()
+	rec := fc.records[name]
+	rec.Address = address
+	fc.records[name] = rec
+}
+
+// setExpireBlock changes the block a name's record expires after
+func (fc *fakeCore) setExpireBlock(name string, block int) {
+	fc.Lock()
+	defer fc.Unlock()
+	rec := fc.records[name]
+	rec.ExpireBlock = block
+	fc.records[name] = rec
+}
+
+// revoke marks a name's record revoked
+func (fc *fakeCore) revoke(name string) {
+	fc.Lock()
+	defer fc.Unlock()
+	rec := fc.records[name]
+	rec.Revoked = true
+	fc.records[name] = rec
+}
+
+func writeFixture(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleNamespaces serves /v1/namespaces, a plain list of namespace IDs
+func (fc *fakeCore) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+	fc.record("/v1/namespaces")
+	fc.Lock()
+	defer fc.Unlock()
+	out := []string{}
+	for ns := range fc.namespaces {
+		out = append(out, ns)
+	}
+	sort.Strings(out)
+	writeFixture(w, out)
+}
+
+// handleNamespace serves /v1/namespaces/{ns}/names?page={page} in pages of 100 names
+func (fc *fakeCore) handleNamespace(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/namespaces/"), "/")
+	if len(parts) != 2 || parts[1] != "names" {
+		http.NotFound(w, r)
+		return
+	}
+	fc.record("/v1/namespaces/names")
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+	fc.Lock()
+	defer fc.Unlock()
+	names, ok := fc.namespaces[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeFixture(w, fixturePage(names, page))
+}
+
+// fixturePage returns a page of 100 names the way core pages them
+func fixturePage(names []string, page int) []string {
+	out := []string{}
+	for i := page * 100; i < (page+1)*100 && i < len(names); i++ {
+		out = append(out, names[i])
+	}
+	return out
+}
+
+// handleName serves /v1/names/{name}, the name's record along with its current zonefile
+func (fc *fakeCore) handleName(w http.ResponseWriter, r *http.Request) {
+	fc.record("/v1/names")
+	name := strings.TrimPrefix(r.URL.Path, "/v1/names/")
+	fc.Lock()
+	defer fc.Unlock()
+	rec, ok := fc.records[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	status := "registered"
+	switch {
+	case rec.Revoked:
+		status = "revoked"
+	case rec.ExpireBlock > 0 && fc.height > rec.ExpireBlock:
+		status = "expired"
+	}
+	expire := rec.ExpireBlock
+	if expire == 0 {
+		expire = -1
+	}
+	writeFixture(w, map[string]interface{}{
+		"address":       rec.Address,
+		"blockchain":    "bitcoin",
+		"expire_block":  expire,
+		"last_txid":     fmt.Sprintf("%064x", fc.height),
+		"status":        status,
+		"zonefile":      fc.zonefiles[rec.ValueHash],
+		"zonefile_hash": rec.ValueHash,
+	})
+}
+
+// handleSubdomains serves /v1/subdomains?page={page} in pages of 100
+func (fc *fakeCore) handleSubdomains(w http.ResponseWriter, r *http.Request) {
+	fc.record("/v1/subdomains")
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	fc.Lock()
+	defer fc.Unlock()
+	writeFixture(w, fixturePage(fc.sponsored, page))
+}
+
+// handleNameCount serves /v1/blockchains/bitcoin/name_count
+func (fc *fakeCore) handleNameCount(w http.ResponseWriter, r *http.Request) {
+	fc.record("/v1/blockchains")
+	fc.Lock()
+	defer fc.Unlock()
+	count := 0
+	for _, names := range fc.namespaces {
+		count += len(names)
+	}
+	writeFixture(w, map[string]int{"names_count": count})
+}
+
+// handleInfo serves /v1/info
+func (fc *fakeCore) handleInfo(w http.ResponseWriter, r *http.Request) {
+	fc.record("/v1/info")
+	fc.Lock()
+	defer fc.Unlock()
+	writeFixture(w, map[string]int{"last_block_processed": fc.height})
+}
+
+// handleOperations serves /v1/blockchains/bitcoin/operations/{height}
+func (fc *fakeCore) handleOperations(w http.ResponseWriter, r *http.Request) {
+	fc.record("/v1/blockchains")
+	height, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v1/blockchains/bitcoin/operations/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fc.Lock()
+	defer fc.Unlock()
+	out := []map[string]string{}
+	for _, name := range fc.ops[height] {
+		out = append(out, map[string]string{"opcode": "NAME_UPDATE", "name": name})
+	}
+	writeFixture(w, out)
+}
+
+// handleProfile serves /hub/{name}/profile.json
+func (fc *fakeCore) handleProfile(w http.ResponseWriter, r *http.Request) {
+	fc.record("/hub")
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hub/"), "/profile.json")
+	fc.Lock()
+	defer fc.Unlock()
+	byt, ok := fc.profiles[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(byt)
+}
+
+// serverConfig points a core client at the fake node
+func (fc *fakeCore) serverConfig() blockstack.ServerConfig {
+	u, _ := url.Parse(fc.Server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return blockstack.ServerConfig{Scheme: u.Scheme, Address: u.Hostname(), Port: port}
+}
@@ -0,0 +1,122 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// The background work liveness is checked for
+const (
+	loopSync    = "sync"
+	loopUpdate  = "update"
+	loopResync  = "resync"
+	loopRefresh = "refresh"
+)
+
+// healthPingTimeout bounds the database ping made by each health check
+const healthPingTimeout = 5 * time.Second
+
+// HealthCheck is the body of /healthz and /readyz
+type HealthCheck struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// OK reports whether the check passed
+func (hc HealthCheck) OK() bool {
+	return len(hc.Reasons) == 0
+}
+
+func newHealthCheck(reasons []string) HealthCheck {
+	if len(reasons) == 0 {
+		return HealthCheck{Status: "ok"}
+	}
+	return HealthCheck{Status: "unavailable", Reasons: reasons}
+}
+
+// newLoopStates returns a marker for each loop of the background work, keyed by loop
+func newLoopStates() map[string]*atomic.Int64 {
+	return map[string]*atomic.Int64{
+		loopSync:    new(atomic.Int64),
+		loopUpdate:  new(atomic.Int64),
+		loopResync:  new(atomic.Int64),
+		loopRefresh: new(atomic.Int64),
+	}
+}
+
+// loopKey is the context key of the loop a pass is running in
+type loopKey struct{}
+
+// working marks loop as in the middle of a pass until the returned func is called. The
+// returned context carries the loop so the progress made under it is credited to it
+func (idx *Indexer) working(ctx context.Context, loop string) (context.Context, func()) {
+	idx.busy[loop].Store(time.Now().UnixNano())
+	return context.WithValue(ctx, loopKey{}, loop), func() { idx.busy[loop].Store(0) }
+}
+
+// progressed records that the pass running under ctx got a call, name or batch done. Work
+// outside the loops, like an API lookup, isn't tracked
+func (idx *Indexer) progressed(ctx context.Context) {
+	if loop, ok := ctx.Value(loopKey{}).(string); ok {
+		idx.progress[loop].Store(time.Now().UnixNano())
+	}
+}
+
+// caughtUp records that the index is up to date with the chain
+func (idx *Indexer) caughtUp() {
+	idx.updated.Store(time.Now().UnixNano())
+}
+
+// Liveness checks the database can be reached and that no loop has been in the middle of
+// a pass for longer than the LivenessDeadline config without making progress of its own
+func (idx *Indexer) Liveness(ctx context.Context) HealthCheck {
+	reasons := idx.pingReasons(ctx)
+	now := time.Now()
+	for _, loop := range []string{loopSync, loopUpdate, loopResync, loopRefresh} {
+		since := idx.busy[loop].Load()
+		if since == 0 {
+			continue
+		}
+		if progress := idx.progress[loop].Load(); progress > since {
+			since = progress
+		}
+		if stalled := now.Sub(time.Unix(0, since)); stalled > idx.config.LivenessDeadline {
+			reasons = append(reasons, fmt.Sprintf("%s loop has made no progress for %s, deadline %s",
+				loop, stalled.Round(time.Second), idx.config.LivenessDeadline))
+		}
+	}
+	return newHealthCheck(reasons)
+}
+
+// Readiness checks the database can be reached, every stage in the ReadyStages config is
+// ready and, once the index has caught up with the chain, that it last did so within the
+// MaxStaleness config
+func (idx *Indexer) Readiness(ctx context.Context) HealthCheck {
+	reasons := idx.pingReasons(ctx)
+	for _, stage := range idx.config.ReadyStages {
+		status, ok := idx.ST.Status.Stage(stage)
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("unknown stage %q", stage))
+		} else if status != "ready" {
+			reasons = append(reasons, fmt.Sprintf("%s index is %s", stage, status))
+		}
+	}
+	if updated := idx.updated.Load(); updated != 0 {
+		if age := time.Since(time.Unix(0, updated)); age > idx.config.MaxStaleness {
+			reasons = append(reasons, fmt.Sprintf("index last caught up %s ago, older than %s",
+				age.Round(time.Second), idx.config.MaxStaleness))
+		}
+	}
+	return newHealthCheck(reasons)
+}
+
+func (idx *Indexer) pingReasons(ctx context.Context) []string {
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	if err := idx.DB.Ping(ctx); err != nil {
+		return []string{fmt.Sprintf("database unreachable: %s", err)}
+	}
+	return []string{}
+}
@@ -0,0 +1,127 @@
+package indexer
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	fc := newTestNetwork(t)
+	db := newTestBoltDB(t)
+	idx := newTestIndexer(t, fc, db, nil)
+	api := NewAPI(idx, 0)
+
+	var hc HealthCheck
+	if code := apiGet(t, api, "/healthz", &hc); code != http.StatusOK || hc.Status != "ok" {
+		t.Fatalf("expected an idle indexer to be alive, got %d %+v", code, hc)
+	}
+
+	// A loop stuck in a pass past the deadline with nothing getting done isn't alive
+	idx.busy[loopUpdate].Store(time.Now().Add(-2 * idx.config.LivenessDeadline).UnixNano())
+	if code := apiGet(t, api, "/healthz", &hc); code != http.StatusServiceUnavailable || len(hc.Reasons) != 1 || !strings.HasPrefix(hc.Reasons[0], "update loop") {
+		t.Fatalf("expected the stalled loop to fail, got %d %+v", code, hc)
+	}
+
+	// Another loop getting things done doesn't hide it
+	refreshCtx, done := idx.working(context.Background(), loopRefresh)
+	idx.progressed(refreshCtx)
+	done()
+	idx.progressed(context.Background())
+	if code := apiGet(t, api, "/healthz", &hc); code != http.StatusServiceUnavailable || len(hc.Reasons) != 1 || !strings.HasPrefix(hc.Reasons[0], "update loop") {
+		t.Fatalf("expected the update loop to still be stalled, got %d %+v", code, hc)
+	}
+
+	idx.progressed(context.WithValue(context.Background(), loopKey{}, loopUpdate))
+	if code := apiGet(t, api, "/healthz", &hc); code != http.StatusOK {
+		t.Fatalf("expected a loop making progress to be alive, got %d %+v", code, hc)
+	}
+
+	db.Close()
+	if code := apiGet(t, api, "/healthz", &hc); code != http.StatusServiceUnavailable || !strings.HasPrefix(hc.Reasons[0], "database unreachable") {
+		t.Fatalf("expected a closed database to fail, got %d %+v", code, hc)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+	api := NewAPI(idx, 0)
+
+	var hc HealthCheck
+	if code := apiGet(t, api, "/readyz", &hc); code != http.StatusServiceUnavailable || len(hc.Reasons) != 3 {
+		t.Fatalf("expected every stage to be reported before the initial sync, got %d %+v", code, hc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idx.Index(ctx)
+	if code := apiGet(t, api, "/readyz", &hc); code != http.StatusOK || hc.Status != "ok" {
+		t.Fatalf("expected the indexer to be ready after the initial sync, got %d %+v", code, hc)
+	}
+
+	// Data that hasn't caught up with the chain for too long isn't served
+	idx.updated.Store(time.Now().Add(-2 * idx.config.MaxStaleness).UnixNano())
+	if code := apiGet(t, api, "/readyz", &hc); code != http.StatusServiceUnavailable || len(hc.Reasons) != 1 || !strings.Contains(hc.Reasons[0], "older than") {
+		t.Fatalf("expected stale data to fail, got %d %+v", code, hc)
+	}
+}
+
+// heldCore wraps a Core and holds namespace listings, which only full name syncs make, while hold is set
+type heldCore struct {
+	Core
+
+	hold    atomic.Bool
+	release chan struct{}
+}
+
+func (h *heldCore) GetAllNamespaces(ctx context.Context) ([]string, error) {
+	if h.hold.Load() {
+		select {
+		case <-h.release:
+		case <-ctx.Done():
+			return []string{}, ctx.Err()
+		}
+	}
+	return h.Core.GetAllNamespaces(ctx)
+}
+
+func TestReadyzDuringResync(t *testing.T) {
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), fc.names())
+	held := &heldCore{Core: fc, release: make(chan struct{})}
+	idx.BSK = held
+	idx.config.BlockFetchTimeout = 5 * time.Millisecond
+	idx.config.FullResyncInterval = 20 * time.Millisecond
+	api := NewAPI(idx, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	idx.Index(ctx)
+	defer func() {
+		cancel()
+		idx.loops.Wait()
+	}()
+	held.hold.Store(true)
+	defer close(held.release)
+	for deadline := time.Now().Add(time.Second); !idx.resyncing.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a full resync to start")
+		}
+	}
+
+	// Block passes keep the index caught up while the resync is held up
+	idx.updated.Store(time.Now().Add(-2 * idx.config.MaxStaleness).UnixNano())
+	fc.mine("alice.app")
+	var hc HealthCheck
+	for deadline := time.Now().Add(time.Second); apiGet(t, api, "/readyz", &hc) != http.StatusOK; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected block passes to keep the indexer ready during a resync, got %+v", hc)
+		}
+	}
+	if !idx.resyncing.Load() || idx.ST.Count(statBlocksIndexed) == 0 {
+		t.Fatal("expected the new block to be indexed while the resync runs")
+	}
+}
@@ -1,15 +1,16 @@
 package indexer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/blockstack/blockstack.go/blockstack"
 )
 
 const (
@@ -17,43 +18,132 @@ const (
 	idxPrefix    = "[indexer]"
 )
 
-// NewIndexer creates a new Indexer
-func NewIndexer(cfg *Config, names []string) *Indexer {
-	return &Indexer{
-		BSK:  blockstack.NewClient(cfg.BSK.Host),
-		DB:   NewMongoDB(cfg),
+// NewIndexer creates a new Indexer talking to the configured core node and database. It
+// fails if the database can't be opened
+func NewIndexer(cfg *Config, names []string) (*Indexer, error) {
+	db, err := NewDB(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %s", err)
+	}
+	idx := NewIndexerWith(cfg, nil, db, names)
+	// The pool reports per host counts to the indexer's stats
+	idx.BSK = NewCorePool(cfg.BSK, idx.ST)
+	return idx, nil
+}
+
+// NewIndexerWith creates a new Indexer using the passed core client and database
+func NewIndexerWith(cfg *Config, core Core, db DB, names []string) *Indexer {
+	idxCfg := cfg.IDX.withDefaults()
+	st := NewStats(cfg.IDX.StatsPort)
+	idx := &Indexer{
+		BSK:  core,
+		DB:   timedDB{DB: db, st: st},
 		Conc: cfg.IDX.Concurrency,
-		ST:   NewStats(cfg.IDX.StatsPort),
+		ST:   st,
+
+		Search: NewSearchIndex(),
 
-		names: &networkNames{n: make([]string, 0)},
+		names:        newNameSet(idxCfg.Namespaces.filter(names)),
+		deadLettered: newNameSet(nil),
+		sched:        NewScheduler(idxCfg.MinRefreshInterval, idxCfg.MaxRefreshInterval),
+		expiries:     newExpiries(),
+		busy:         newLoopStates(),
+		progress:     newLoopStates(),
 
-		retries: cfg.IDX.Retries,
-		timeout: cfg.IDX.Timeout,
+		retryPolicy: RetryPolicy{
+			MaxAttempts: idxCfg.Retries,
+			BaseDelay:   idxCfg.Timeout,
+			MaxDelay:    idxCfg.MaxRetryDelay,
+			Jitter:      idxCfg.RetryJitter,
+			Deadline:    idxCfg.RetryDeadline,
+			Retryable:   retryableError,
+			ST:          st,
+		},
 
-		config: cfg.IDX,
+		config: idxCfg,
+	}
+	for ns := range idxCfg.Namespaces.Policies {
+		policy := idxCfg.policy(ns)
+		if !*policy.ResolveProfiles {
+			idx.sched.Skip(ns)
+			continue
+		}
+		idx.sched.SetNamespace(ns, policy.MinRefreshInterval, policy.MaxRefreshInterval)
 	}
+	idx.logNamespacePolicies()
+	idx.loadDeadLetters(context.Background())
+	st.GaugeFunc("bsk_idx_names", "Names known to the indexer.", func(ctx context.Context) float64 {
+		return float64(idx.names.length())
+	})
+	// Counting the stored zonefiles and profiles can scan a table so scrapes share a recent count
+	zonefiles := &cachedCount{ttl: storedCountTTL, count: idx.DB.ZonefilesCount}
+	profiles := &cachedCount{ttl: storedCountTTL, count: idx.DB.ProfilesCount}
+	st.GaugeFunc("bsk_idx_zonefiles", "Zonefiles stored.", zonefiles.get)
+	st.GaugeFunc("bsk_idx_profiles", "Profiles stored.", profiles.get)
+	return idx
 }
 
 // Indexer is the main stuct for this application
 type Indexer struct {
-	BSK  *blockstack.Client
+	BSK  Core
 	DB   DB
 	ST   *Stats
 	Conc int
 
-	names *networkNames
+	// Search indexes profiles as they are inserted
+	Search *SearchIndex
+
+	names *nameSet
+
+	// deadLettered holds the names with a dead letter stored so a name indexed successfully
+	// only costs a delete when it has one to clear
+	deadLettered *nameSet
 
-	// Number of retries and backoff time for blockstack calls
-	retries int
-	timeout time.Duration
+	// sched decides when each profile is next re-resolved
+	sched *Scheduler
+
+	// expiries holds when each active name expires, and height the last block height seen
+	expiries *expiries
+	height   atomic.Int64
+
+	// retryPolicy wraps every core call and profile fetch
+	retryPolicy RetryPolicy
 
 	config IDXConfig
 
+	// loops tracks the goroutines Index starts so Shutdown can wait for them, resyncing is
+	// set while a full resync runs
+	loops     sync.WaitGroup
+	resyncing atomic.Bool
+
+	// busy holds when each loop started its current pass, zero while it waits, and progress
+	// when each loop last got something done. updated is when the index last caught up with
+	// the chain. All are unix nanoseconds
+	busy     map[string]*atomic.Int64
+	progress map[string]*atomic.Int64
+	updated  atomic.Int64
+
 	sync.Mutex
 }
 
-// Index is the main operation
-func (idx *Indexer) Index() {
+// Config returns the indexer configuration with defaults filled in
+func (idx *Indexer) Config() IDXConfig {
+	return idx.config
+}
+
+// Index does the initial sync and then starts the update loop in the background. Once ctx
+// is done no new work is started, Index returns and the loop stops after its current pass
+func (idx *Indexer) Index(ctx context.Context) {
+	loopCtx := ctx
+	ctx, done := idx.working(ctx, loopSync)
+	defer done()
+
+	// Load the profiles already in the database into the search index
+	idx.loops.Add(1)
+	go func() {
+		defer idx.loops.Done()
+		idx.loadSearchIndex(ctx)
+	}()
 
 	// First try to pull names from the names.json file
 	if _, err := os.Stat(idx.config.NameFile); err == nil {
@@ -67,82 +157,218 @@ func (idx *Indexer) Index() {
 			idx.log(idxPrefix, "Names file exists but is unparsable, fetching names from network")
 		}
 		idx.log(idxPrefix, "Reading names from file, kicking off update routine...")
-		idx.names.n = names
+		idx.names.add(idx.config.Namespaces.filter(names))
 	}
 
-	nsInfo, _ := idx.GetNSInfo()
+	// Anything that happens on chain while the initial sync runs is picked up by
+	// the first incremental pass, so record where the chain is before starting
+	height, heightErr := idx.GetBlockHeight(ctx)
 
-	// If the names were not loaded from file we need to do an
+	// If the names were not loaded from file, or the file is behind, we need to do an
 	// initial name sync to populate the list of names and write them to the file
-	if idx.names.length() < nsInfo.Count()-50 {
+	// Names the file was missing are indexed as soon as the database is known to be populated
+	var added []string
+	if idx.namesBehind(ctx) {
 		idx.log(idxPrefix, "names file not found, fetching names...")
-		idx.GetAllNames()
+		fromFile := idx.names.length() > 0
+		diff, err := idx.GetAllNames(ctx)
+		if err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("failed to fetch names, continuing with %d: %s", idx.names.length(), err))
+		}
+		if fromFile {
+			added = diff.Added
+		}
 		idx.log(idxPrefix, fmt.Sprintf("names updated, writing names to file %s...", idx.config.NameFile))
 		idx.WriteNamesToFile(idx.config.NameFile)
 	}
+	if ctx.Err() != nil {
+		return
+	}
 	// Set name index status to available
 	idx.ST.UpdateStatus("names.ready")
 	idx.log(idxPrefix, "checking zonefiles...")
 
-	// Kick off name update loop in the background to keep names array current
-	go idx.nameIndexLoop()
-
 	// If the zonefile database hasn't been populated then populate it
-	if idx.DB.ZonefilesCount() < (idx.names.length() * 2 / 3) {
+	if idx.DB.ZonefilesCount(ctx) < (idx.names.length() * 2 / 3) {
 		idx.log(idxPrefix, "zonefiles not populated, fetching...")
-		idx.GetAllZonefiles()
+		idx.GetAllZonefiles(ctx)
+	} else {
+		idx.indexNewNames(ctx, added)
+	}
+	if ctx.Err() != nil {
+		return
 	}
 
 	// Set name index status to available
 	idx.ST.UpdateStatus("zonefiles.ready")
-	idx.log(idxPrefix, "zonefiles available, kicking off update routine...")
-
-	// Kick off zonefile update loop in the background to keep zonefiles in database updated
-	go idx.zonefileIndexLoop()
+	idx.log(idxPrefix, "zonefiles available")
 
 	idx.log(idxPrefix, "Resolving profiles...")
 
-	// Do an initial profile sync then start profile loop
-	if (idx.DB.ZonefilesCount() * 1 / 2) > idx.DB.ProfilesCount() {
+	// Resolve every profile unless the last full pass completed, an interrupted pass picks up where it stopped
+	if idx.resolveNeeded(ctx) {
 		idx.log(idxPrefix, "doing initial profile resolution...")
-		idx.ResolveIndexerNames()
+		idx.ResolveIndexerNames(ctx)
+	}
+	if ctx.Err() != nil {
+		return
 	}
 
 	// Set name index status to available
 	idx.ST.UpdateStatus("profiles.ready")
-	idx.log(idxPrefix, "Kicking off profile update routine")
 
-	// Continually update profiles
-	go idx.profileIndexLoop()
+	// Names resolved by an earlier run are due again based on when that was
+	if err := idx.seedSchedule(ctx); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to load resolution times: %s", err))
+	}
+	if err := idx.seedExpiries(ctx); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to load name expiries: %s", err))
+	}
+
+	// A stored height means a previous run was indexing incrementally and
+	// should carry on from where it stopped
+	if _, err := idx.lastBlock(ctx); err != nil && heightErr == nil {
+		if err := idx.setLastBlock(ctx, height); err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("failed to store block height: %s", err))
+		}
+	}
+	idx.caughtUp()
+	idx.log(idxPrefix, "Kicking off update routine")
+
+	// Keep names, zonefiles and profiles current
+	idx.loops.Add(2)
+	go func() {
+		defer idx.loops.Done()
+		idx.updateLoop(loopCtx)
+	}()
+	go func() {
+		defer idx.loops.Done()
+		idx.refreshLoop(loopCtx)
+	}()
+}
+
+// Shutdown waits for the update loop to finish its current pass, which it does once the
+// context passed to Index is done, then writes out the names file and closes the core pool,
+// the stats server and the database. It gives up waiting on the loop when ctx is done
+func (idx *Indexer) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		idx.loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		idx.log(idxPrefix, "timed out waiting for indexing to stop")
+	}
+	idx.WriteNamesToFile(idx.config.NameFile)
+	// A pool health checks its hosts in the background
+	if c, ok := idx.BSK.(io.Closer); ok {
+		c.Close()
+	}
+	if err := idx.ST.Shutdown(ctx); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to shut down stats server: %s", err))
+	}
+	return idx.DB.Close()
 }
 
 func (idx *Indexer) log(prefix, message string) {
 	log.Printf("%s %s", prefix, message)
 }
 
-func (idx *Indexer) nameIndexLoop() {
-	ticker := time.NewTicker(idx.config.NameFetchTimeout)
-	for _ = range ticker.C {
-		idx.log(idxPrefix, "fetching names...")
-		idx.GetAllNames()
-		idx.log(idxPrefix, fmt.Sprintf("names updated, writing to %s...", idx.config.NameFile))
-		idx.WriteNamesToFile(idx.config.NameFile)
-		idx.log(idxPrefix, "name file updated")
+func (idx *Indexer) loadSearchIndex(ctx context.Context) {
+	idx.log(idxPrefix, "loading profiles into search index...")
+	err := idx.DB.EachProfile(ctx, func(rec ProfileRecord) error {
+		if rec.Verified() {
+			idx.Search.Add(rec.Name, rec.Profile)
+		}
+		return nil
+	})
+	if err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to load search index: %s", err))
+		return
 	}
+	idx.log(idxPrefix, fmt.Sprintf("search index loaded with %d profiles", idx.Search.Len()))
 }
 
-func (idx *Indexer) zonefileIndexLoop() {
-	ticker := time.NewTicker(idx.config.ZonefileFetchTimeout)
-	for _ = range ticker.C {
-		idx.log(idxPrefix, "fetching zonefiles...")
-		idx.GetAllZonefiles()
-		idx.log(idxPrefix, "zonefiles updated...")
+// updateLoop indexes the names changed in each new block and periodically falls back to
+// refetching everything in case anything was missed. Resyncs run in the background so
+// block passes keep the index caught up while they do. It returns once ctx is done
+func (idx *Indexer) updateLoop(ctx context.Context) {
+	blocks := time.NewTicker(idx.config.BlockFetchTimeout)
+	defer blocks.Stop()
+	resync := time.NewTicker(idx.config.FullResyncInterval)
+	defer resync.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-blocks.C:
+			pctx, done := idx.working(ctx, loopUpdate)
+			err := idx.IndexNewBlocks(pctx)
+			done()
+			if err == errFullResync {
+				idx.startResync(ctx)
+			} else if err != nil && ctx.Err() == nil {
+				idx.log(idxPrefix, fmt.Sprintf("failed to index new blocks: %s", err))
+			}
+		case <-resync.C:
+			idx.startResync(ctx)
+		}
 	}
 }
 
-func (idx *Indexer) profileIndexLoop() {
-	for {
-		idx.log(idxPrefix, "resolving all profiles")
-		idx.ResolveIndexerNames()
+// startResync runs FullResync in its own goroutine unless one is already running
+func (idx *Indexer) startResync(ctx context.Context) {
+	if !idx.resyncing.CompareAndSwap(false, true) {
+		return
+	}
+	idx.loops.Add(1)
+	go func() {
+		defer idx.loops.Done()
+		defer idx.resyncing.Store(false)
+		pctx, done := idx.working(ctx, loopResync)
+		defer done()
+		idx.FullResync(pctx)
+	}()
+}
+
+// FullResync refetches every name and zonefile and then resumes incremental indexing
+// from the height the resync started at. Profiles whose zonefile was written are resolved
+// straight away, the rest are left to the refresh loop
+func (idx *Indexer) FullResync(ctx context.Context) {
+	idx.log(idxPrefix, "starting full resync...")
+	height, err := idx.GetBlockHeight(ctx)
+	if err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to fetch block height, skipping full resync: %s", err))
+		return
+	}
+	diff, err := idx.GetAllNames(ctx)
+	if err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to fetch names, skipping full resync: %s", err))
+		return
+	}
+	idx.log(idxPrefix, fmt.Sprintf("names updated, %d added and %d removed, writing to %s...",
+		len(diff.Added), len(diff.Removed), idx.config.NameFile))
+	idx.WriteNamesToFile(idx.config.NameFile)
+	// New names go first, the full pass then skips their zonefiles as unchanged
+	idx.indexNewNames(ctx, diff.Added)
+	names := idx.names.current()
+	idx.ResolveNames(ctx, idx.GetZonefilesFor(ctx, names))
+	for _, name := range names {
+		idx.sched.Add(name, time.Time{})
+	}
+	if ctx.Err() != nil {
+		idx.log(idxPrefix, "full resync interrupted")
+		return
+	}
+	// Block passes may have got further while the resync ran
+	if last, err := idx.lastBlock(ctx); err != nil || last < height {
+		if err := idx.setLastBlock(ctx, height); err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("failed to store block height: %s", err))
+		}
 	}
+	idx.caughtUp()
+	idx.ST.Rec(statBlocksFullResyncs, 1)
+	idx.log(idxPrefix, fmt.Sprintf("full resync done at block %d", height))
 }
@@ -0,0 +1,365 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestNetwork returns a fake core node holding enough names that Index
+// takes the initial sync paths, spread across two namespaces
+func newTestNetwork(t *testing.T) *fakeCore {
+	fc := newFakeCore(t)
+	for i := 0; i < 150; i++ {
+		fc.addName(fmt.Sprintf("user%03d.id", i), fmt.Sprintf("User %03d", i))
+	}
+	fc.addName("alice.app", "Alice Appleseed")
+	fc.addName("bob.app", "Bob Builder")
+	return fc
+}
+
+func newTestIndexer(t *testing.T, fc *fakeCore, db DB, names []string) *Indexer {
+	return newTestIndexerNamespaces(t, fc, db, names, NamespacesConfig{})
+}
+
+// newTestIndexerNamespaces returns a test indexer with namespace filters and policies
+func newTestIndexerNamespaces(t *testing.T, fc *fakeCore, db DB, names []string, nc NamespacesConfig) *Indexer {
+	cfg := &Config{
+		IDX: IDXConfig{
+			Concurrency: 4,
+			Retries:     2,
+			Timeout:     time.Millisecond,
+			NameFile:    filepath.Join(t.TempDir(), "names.json"),
+			// Keep the background loops from ticking during a test
+			BlockFetchTimeout:  time.Hour,
+			FullResyncInterval: time.Hour,
+			Namespaces:         nc,
+		},
+	}
+	return NewIndexerWith(cfg, fc, db, names)
+}
+
+func TestGetAllNames(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+
+	idx.GetAllNames(ctx)
+
+	if got := idx.names.current(); !reflect.DeepEqual(got, fc.names()) {
+		t.Fatalf("expected %d names, got %d", len(fc.names()), len(got))
+	}
+	// app's one short page is fetched alone, id's full first page fans its 50 remaining
+	// names out to its 4 workers, each fetching one page before seeing the end
+	if c := fc.callCount("/v1/namespaces/names"); c != 1+1+4 {
+		t.Fatalf("expected 6 page requests, got %d", c)
+	}
+}
+
+func TestGetAllNamesDiff(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	known := append(fc.names()[1:], "gone.id")
+	idx := newTestIndexer(t, fc, db, known)
+	gone := Profile{Type: "Person", Name: "Gone"}
+	db.UpsertNameZonefile(ctx, "gone.id", "", "$ORIGIN gone.id\n")
+	db.UpsertProfile(ctx, ProfileRecord{Name: "gone.id", Profile: gone, Verification: ProfileVerified})
+	idx.Search.Add("gone.id", gone)
+
+	// Snapshots are sorted copies the set doesn't share
+	snap := idx.names.current()
+	if !sort.StringsAreSorted(snap) {
+		t.Fatal("expected a sorted snapshot")
+	}
+	snap[0] = "changed.id"
+	if idx.names.current()[0] == "changed.id" {
+		t.Fatal("expected the snapshot to be a copy")
+	}
+
+	diff, err := idx.GetAllNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := fc.names()[0]
+	if !reflect.DeepEqual(diff, NameDiff{Added: []string{first}, Removed: []string{"gone.id"}}) {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+	// The removed name's zonefile and profile are purged and it leaves search
+	if _, err := db.FetchZonefile(ctx, "gone.id"); err != ErrNotFound {
+		t.Fatalf("expected the removed name's zonefile purged, got %v", err)
+	}
+	if _, err := db.FetchProfile(ctx, "gone.id"); err != ErrNotFound {
+		t.Fatalf("expected the removed name's profile purged, got %v", err)
+	}
+	if res, _ := idx.Search.Search("gone", 0, 10); len(res) != 0 {
+		t.Fatalf("expected the removed name out of search, got %v", res)
+	}
+	if got := idx.names.current(); !reflect.DeepEqual(got, fc.names()) {
+		t.Fatalf("expected the names on the network, got %d", len(got))
+	}
+
+	// New names are indexed straight away
+	idx.indexNewNames(ctx, diff.Added)
+	if _, err := db.FetchProfile(ctx, first); err != nil {
+		t.Fatalf("expected %s resolved, got %s", first, err)
+	}
+	if diff, _ := idx.GetAllNames(ctx); len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Fatalf("expected no changes on a second sync, got %+v", diff)
+	}
+}
+
+func TestGetAllZonefiles(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+
+	idx.GetAllZonefiles(ctx)
+
+	if c := db.ZonefilesCount(ctx); c != len(fc.names()) {
+		t.Fatalf("expected %d zonefiles, got %d", len(fc.names()), c)
+	}
+	zf, err := db.FetchZonefile(ctx, "alice.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := zf.URL()
+	if err != nil || len(urls) != 1 || urls[0].Path != "/hub/alice.app/profile.json" {
+		t.Fatalf("unexpected zonefile urls %v, err %v", urls, err)
+	}
+}
+
+func TestGetAllZonefilesSkipsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	idx.GetAllZonefiles(ctx)
+	changed := idx.ST.Count(statZonefilesChanged)
+
+	// Nothing changed so nothing should be written
+	idx.GetAllZonefiles(ctx)
+	if c := idx.ST.Count(statZonefilesChanged); c != changed {
+		t.Fatalf("expected no zonefile writes, got %d", c-changed)
+	}
+
+	fc.updateName("alice.app", "Alice Anderson")
+	fc.updateName("bob.app", "Bob Barker")
+	fc.tamperZonefile("bob.app", "$ORIGIN bob.app\n$TTL 3600\n")
+	written := idx.GetZonefilesFor(ctx, fc.names())
+	if !reflect.DeepEqual(written, []string{"alice.app"}) {
+		t.Fatalf("expected only alice.app to be written, got %v", written)
+	}
+	if c := idx.ST.Count(statZonefilesChanged); c != changed+1 {
+		t.Fatalf("expected 1 zonefile write, got %d", c-changed)
+	}
+	zf, err := db.FetchZonefile(ctx, "alice.app")
+	if err != nil || zf.Hash() != fc.records["alice.app"].ValueHash {
+		t.Fatalf("expected alice.app's new zonefile to be stored, got %+v, err %v", zf, err)
+	}
+	zf, err = db.FetchZonefile(ctx, "bob.app")
+	if err != nil || zf.Hash() == fc.records["bob.app"].ValueHash {
+		t.Fatalf("expected bob.app's tampered zonefile to be rejected, got %+v, err %v", zf, err)
+	}
+	if s, m := idx.ST.Count(statZonefilesSkipped), idx.ST.Count(statZonefilesMismatched); s != 2*len(fc.names())-2 || m != 1 {
+		t.Fatalf("expected %d skipped and 1 mismatched zonefile, got %d and %d", 2*len(fc.names())-2, s, m)
+	}
+}
+
+func TestResolveIndexerNames(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	idx.GetAllZonefiles(ctx)
+
+	idx.ResolveIndexerNames(ctx)
+
+	if c := db.ProfilesCount(ctx); c != len(fc.names()) {
+		t.Fatalf("expected %d profiles, got %d", len(fc.names()), c)
+	}
+	p, err := db.FetchProfile(ctx, "bob.app")
+	if err != nil || p.Profile.Name != "Bob Builder" || !p.Verified() {
+		t.Fatalf("unexpected profile %+v, err %v", p, err)
+	}
+	if res, _ := idx.Search.Search("bob", 0, 10); len(res) != 1 || res[0].Name != "bob.app" {
+		t.Fatalf("expected bob.app to be searchable, got %v", res)
+	}
+}
+
+func TestResolveIndexerNamesSkipsUnverified(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	idx.GetAllZonefiles(ctx)
+
+	// Serve a token for bob.app whose signature covers a different payload
+	good := strings.Split(signProfileToken(fc.key, Profile{Type: "Person", Name: "Bob Builder"}), ".")
+	evil := strings.Split(signProfileToken(testKey(9), Profile{Type: "Person", Name: "Mallory"}), ".")
+	byt, _ := json.Marshal([]*ProfileTokenFile{{Token: evil[0] + "." + evil[1] + "." + good[2]}})
+	fc.Lock()
+	fc.profiles["bob.app"] = byt
+	fc.Unlock()
+
+	idx.ResolveIndexerNames(ctx)
+
+	if _, err := db.FetchProfile(ctx, "bob.app"); err != ErrNotFound {
+		t.Fatalf("expected unverified profile to be skipped, got err %v", err)
+	}
+	if c := db.ProfilesCount(ctx); c != len(fc.names())-1 {
+		t.Fatalf("expected %d profiles, got %d", len(fc.names())-1, c)
+	}
+	if c := idx.ST.Count(StatProfiles.Counter("unverified_bad_signature")); c != 1 {
+		t.Fatalf("expected the unverified profile to be counted, got %d", c)
+	}
+}
+
+func TestResolveIndexerNamesOwnerMismatch(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	// bob.app was transferred but still points at a profile signed by the old owner
+	fc.setOwner("bob.app", testAddress(testKey(7)))
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	idx.GetAllZonefiles(ctx)
+
+	idx.ResolveIndexerNames(ctx)
+
+	p, err := db.FetchProfile(ctx, "bob.app")
+	if err != nil || p.Verification != ProfileOwnerMismatch {
+		t.Fatalf("expected an owner_mismatch profile, got %+v, err %v", p, err)
+	}
+	if res, _ := idx.Search.Search("bob", 0, 10); len(res) != 0 {
+		t.Fatalf("expected mismatched profile not to be searchable, got %v", res)
+	}
+}
+
+func TestResolveIndexerNamesInvalidatesStaleProfile(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+	idx.GetAllZonefiles(ctx)
+	idx.ResolveIndexerNames(ctx)
+	api := NewAPI(idx, 0)
+	if p, err := db.FetchProfile(ctx, "bob.app"); err != nil || !p.Verified() {
+		t.Fatalf("expected a verified profile, got %+v, err %v", p, err)
+	}
+
+	// bob.app's token expires, alice.app's profile goes away and user000.id's stops being a person's
+	now := time.Now()
+	expired := signProfileTokenAt(fc.key, Profile{Type: "Person", Name: "Bob Builder"}, now.AddDate(-1, 0, 0), now.Add(-time.Minute))
+	bob, _ := json.Marshal([]*ProfileTokenFile{{Token: expired}})
+	org, _ := json.Marshal([]*ProfileTokenFile{{Token: signProfileToken(fc.key, Profile{Type: "Organization", Name: "User Zero"})}})
+	fc.Lock()
+	fc.profiles["bob.app"] = bob
+	fc.profiles["user000.id"] = org
+	fc.Unlock()
+	fc.removeProfile("alice.app")
+
+	names := []string{"alice.app", "bob.app", "user000.id"}
+	idx.ResolveNames(ctx, names)
+
+	for _, name := range names {
+		if p, err := db.FetchProfile(ctx, name); err != nil || p.Verification != ProfileInvalid {
+			t.Fatalf("expected %s's stored profile marked invalid, got %+v, err %v", name, p, err)
+		}
+		if code := apiGet(t, api, "/v1/users/"+name, nil); code != http.StatusNotFound {
+			t.Fatalf("expected %s not to be served, got %d", name, code)
+		}
+		res, _ := idx.Search.Search(name[:strings.Index(name, ".")], 0, 200)
+		for _, r := range res {
+			if r.Name == name {
+				t.Fatalf("expected %s out of search, got %v", name, res)
+			}
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, nil)
+
+	idx.Index(ctx)
+
+	if c := db.ZonefilesCount(ctx); c != len(fc.names()) {
+		t.Fatalf("expected %d zonefiles, got %d", len(fc.names()), c)
+	}
+	if c := db.ProfilesCount(ctx); c != len(fc.names()) {
+		t.Fatalf("expected %d profiles, got %d", len(fc.names()), c)
+	}
+
+	byt, err := ioutil.ReadFile(idx.config.NameFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	if err := json.Unmarshal(byt, &names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, fc.names()) {
+		t.Fatalf("names file has %d names, expected %d", len(names), len(fc.names()))
+	}
+
+	if idx.ST.Status.ProfilesIndex != "ready" {
+		t.Fatalf("expected the profiles index to be ready, got %q", idx.ST.Status.ProfilesIndex)
+	}
+}
+
+func TestIndexShutdown(t *testing.T) {
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	idx.Index(ctx)
+	os.Remove(idx.config.NameFile)
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+	defer shutdownCancel()
+	if err := idx.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	if shutdownCtx.Err() != nil {
+		t.Fatal("expected the update loop to stop before the shutdown timeout")
+	}
+	if _, err := os.Stat(idx.config.NameFile); err != nil {
+		t.Fatalf("expected the names file to be written on shutdown: %s", err)
+	}
+}
+
+func TestCancelledPassKeepsHeight(t *testing.T) {
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+	idx.FullResync(context.Background())
+
+	fc.updateName("alice.app", "Alice Anderson")
+	fc.mine("alice.app")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nothing is looked up after the context is done and the block is left to be indexed again
+	records := fc.callCount("/v1/names")
+	if err := idx.IndexNewBlocks(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if c := fc.callCount("/v1/names") - records; c != 0 {
+		t.Fatalf("expected no name record lookups, got %d", c)
+	}
+	if last, err := idx.lastBlock(context.Background()); err != nil || last != 100 {
+		t.Fatalf("expected last block to stay at 100, got %d, err %v", last, err)
+	}
+}
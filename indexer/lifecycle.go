@@ -0,0 +1,184 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// nameStatus returns the status of a name from its blockchain record. Core's status is the
+// authority, a name it still has as registered is only taken as expired once a block height
+// past its expire block has been seen. Names in namespaces that never expire have none
+func (idx *Indexer) nameStatus(rec BlockchainRecord) string {
+	switch {
+	case rec.Revoked():
+		return NameRevoked
+	case rec.Expired():
+		return NameExpired
+	case rec.ExpireBlock > 0 && idx.height.Load() > int64(rec.ExpireBlock):
+		return NameExpired
+	}
+	return NameActive
+}
+
+// storeNameRecord stores the record fetched for a name and acts on any change in its
+// status. It returns the record along with whether the name needs resolving again because
+// it changed hands or came back after expiring, which is never the case for inactive names
+func (idx *Indexer) storeNameRecord(ctx context.Context, name string, res BlockchainRecord) (NameRecord, bool) {
+	rec := NameRecord{
+		Name:        name,
+		Owner:       res.Address,
+		Status:      idx.nameStatus(res),
+		ExpireBlock: res.ExpireBlock,
+	}
+	prev, err := idx.DB.FetchNameRecord(ctx, name)
+	known := err == nil
+	if err := idx.DB.UpsertNameRecord(ctx, rec); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to insert or update name record: %s %s", name, err))
+	}
+	idx.expiries.set(rec)
+
+	if !rec.Active() {
+		idx.retire(ctx, rec, !known || prev.Active())
+		return rec, false
+	}
+	switch {
+	case !known:
+		return rec, false
+	case !prev.Active():
+		idx.log(idxPrefix, fmt.Sprintf("%s is active again after being %s", name, prev.Status))
+		return rec, true
+	case prev.Owner != rec.Owner:
+		idx.log(idxPrefix, fmt.Sprintf("%s was transferred from %s to %s", name, prev.Owner, rec.Owner))
+		idx.ST.Rec(statNameDetailsTransferred, 1)
+		idx.disown(ctx, name)
+		idx.sched.Changed(name)
+		return rec, true
+	}
+	return rec, false
+}
+
+// disown marks the stored profile of a name that changed hands as signed by someone other
+// than its owner, so it isn't served while the name waits to be resolved again or when that
+// fails. Resolving verifies it again if the new owner signed it
+func (idx *Indexer) disown(ctx context.Context, name string) {
+	idx.unverify(ctx, name, ProfileOwnerMismatch)
+}
+
+// unverify gives the stored profile of a name a verification status other than verified and
+// drops it from search, it does nothing when there is no stored profile
+func (idx *Indexer) unverify(ctx context.Context, name, verification string) {
+	p, err := idx.DB.FetchProfile(ctx, name)
+	if err != nil || p.Verification == verification {
+		return
+	}
+	p.Verification = verification
+	if err := idx.DB.UpsertProfile(ctx, p); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to mark profile of %s %s: %s", name, verification, err))
+		return
+	}
+	idx.Search.Remove(name)
+}
+
+// retire purges the zonefile and profile of an expired or revoked name so they are no
+// longer served, along with those of the subdomains it defines. Their name records stay
+// behind as tombstones with the status
+func (idx *Indexer) retire(ctx context.Context, rec NameRecord, changed bool) {
+	if !idx.purge(ctx, rec) || !changed {
+		return
+	}
+	// Subdomains only come from an active domain's zonefile, so once is enough
+	subs := idx.retireSubdomains(ctx, rec)
+	idx.log(idxPrefix, fmt.Sprintf("%s is %s, purged its zonefile and profile and %d subdomains", rec.Name, rec.Status, subs))
+	if rec.Status == NameRevoked {
+		idx.ST.Rec(statNameDetailsRevoked, 1)
+	} else {
+		idx.ST.Rec(statNameDetailsExpired, 1)
+	}
+}
+
+// retireSubdomains gives the subdomains of a retired domain the domain's status and purges
+// them. Renewing the domain writes its zonefile again which brings them back. It returns
+// the number of subdomains retired
+func (idx *Indexer) retireSubdomains(ctx context.Context, domain NameRecord) int {
+	if isSubdomain(domain.Name) {
+		return 0
+	}
+	n := 0
+	for _, name := range idx.names.current() {
+		if !isSubdomain(name) || name[strings.Index(name, ".")+1:] != domain.Name {
+			continue
+		}
+		sub := NameRecord{Name: name, Status: domain.Status}
+		if prev, err := idx.DB.FetchNameRecord(ctx, name); err == nil {
+			sub.Owner = prev.Owner
+		}
+		if err := idx.DB.UpsertNameRecord(ctx, sub); err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("failed to insert or update subdomain record: %s %s", name, err))
+			continue
+		}
+		if idx.purge(ctx, sub) {
+			n++
+		}
+	}
+	return n
+}
+
+// purge drops the zonefile and profile of an inactive or removed name and stops resolving it
+func (idx *Indexer) purge(ctx context.Context, rec NameRecord) bool {
+	if err := idx.DB.PurgeName(ctx, rec.Name); err != nil {
+		idx.log(idxPrefix, fmt.Sprintf("failed to purge name %s: %s", rec.Name, err))
+		return false
+	}
+	idx.Search.Remove(rec.Name)
+	idx.sched.Remove(rec.Name)
+	return true
+}
+
+// seedExpiries loads the expire blocks of the active names stored by an earlier run
+func (idx *Indexer) seedExpiries(ctx context.Context) error {
+	return idx.DB.EachNameRecord(ctx, func(rec NameRecord) error {
+		idx.expiries.set(rec)
+		return nil
+	})
+}
+
+// expiries tracks when active names expire. Expiring doesn't take an operation on chain
+// so the block pass asks for the names whose expire block it has gone past
+type expiries struct {
+	blocks map[string]int
+
+	sync.Mutex
+}
+
+func newExpiries() *expiries {
+	return &expiries{blocks: make(map[string]int)}
+}
+
+// set tracks the expire block of an active name, inactive names and names that never
+// expire are dropped
+func (e *expiries) set(rec NameRecord) {
+	e.Lock()
+	defer e.Unlock()
+	if !rec.Active() || rec.ExpireBlock <= 0 {
+		delete(e.blocks, rec.Name)
+		return
+	}
+	e.blocks[rec.Name] = rec.ExpireBlock
+}
+
+// due removes and returns the names that expired before height. Renewed names are
+// tracked again once their record is fetched
+func (e *expiries) due(height int) []string {
+	e.Lock()
+	defer e.Unlock()
+	out := make([]string, 0)
+	for name, block := range e.blocks {
+		if height > block {
+			out = append(out, name)
+			delete(e.blocks, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,185 @@
+package indexer
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNameLifecycle(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	fc.setExpireBlock("alice.app", 105)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, nil)
+	idx.Index(ctx)
+	api := NewAPI(idx, 0)
+
+	out := map[string]UserRecord{}
+	if code := apiGet(t, api, "/v1/users/alice.app", &out); code != http.StatusOK || out["alice.app"].Status != NameActive {
+		t.Fatalf("expected an active name, got %d %+v", code, out)
+	}
+
+	// A transfer re-resolves the name even though its zonefile is the same
+	other := testKey(7)
+	fc.setOwner("user000.id", testAddress(other))
+	if written := idx.GetZonefilesFor(ctx, []string{"user000.id"}); !reflect.DeepEqual(written, []string{"user000.id"}) {
+		t.Fatalf("expected the transferred name to need resolving, got %v", written)
+	}
+	fc.mine("user000.id")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := db.FetchProfile(ctx, "user000.id"); err != nil || p.Verification != ProfileOwnerMismatch {
+		t.Fatalf("expected the old owner's profile to be unverified, got %+v, err %v", p, err)
+	}
+
+	// A revoked name is purged as soon as the revoke is mined
+	fc.revoke("bob.app")
+	fc.mine("bob.app")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FetchProfile(ctx, "bob.app"); err != ErrNotFound {
+		t.Fatalf("expected the revoked name's profile to be purged, got err %v", err)
+	}
+	if _, err := db.FetchZonefile(ctx, "bob.app"); err != ErrNotFound {
+		t.Fatalf("expected the revoked name's zonefile to be purged, got err %v", err)
+	}
+	body := map[string]string{}
+	if code := apiGet(t, api, "/v1/users/bob.app", &body); code != http.StatusGone || body["status"] != NameRevoked {
+		t.Fatalf("expected 410 revoked, got %d %v", code, body)
+	}
+
+	// Expiring takes no operation, the name is checked once the chain passes its expire block
+	for fc.height <= 105 {
+		fc.mine()
+	}
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := db.FetchNameRecord(ctx, "alice.app"); err != nil || rec.Status != NameExpired {
+		t.Fatalf("expected alice.app expired, got %+v, err %v", rec, err)
+	}
+	if res, _ := idx.Search.Search("alice", 0, 10); len(res) != 0 {
+		t.Fatalf("expected the expired name out of search, got %v", res)
+	}
+	if code := apiGet(t, api, "/v1/users/alice.app", &body); code != http.StatusGone || body["status"] != NameExpired {
+		t.Fatalf("expected 410 expired, got %d %v", code, body)
+	}
+
+	// Renewing brings it back
+	fc.setExpireBlock("alice.app", 1000)
+	fc.mine("alice.app")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if code := apiGet(t, api, "/v1/users/alice.app", nil); code != http.StatusOK {
+		t.Fatalf("expected a renewed name to be served again, got %d", code)
+	}
+	if r, e := idx.ST.Count(statNameDetailsRevoked), idx.ST.Count(statNameDetailsExpired); r != 1 || e != 1 {
+		t.Fatalf("expected 1 revoked and 1 expired name, got %d and %d", r, e)
+	}
+}
+
+func TestNameExpiredOnFirstPass(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	fc.setExpireBlock("alice.app", 50)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, fc.names())
+
+	// No block height has been seen yet, core's status says alice.app has expired
+	idx.GetAllZonefiles(ctx)
+	if rec, err := db.FetchNameRecord(ctx, "alice.app"); err != nil || rec.Status != NameExpired {
+		t.Fatalf("expected alice.app expired, got %+v, err %v", rec, err)
+	}
+	if _, err := db.FetchZonefile(ctx, "alice.app"); err != ErrNotFound {
+		t.Fatalf("expected the expired name's zonefile not to be stored, got %v", err)
+	}
+
+	// A record core still has as registered only expires against a height that was seen
+	idx = newTestIndexer(t, fc, NewMemDB(), fc.names())
+	rec := BlockchainRecord{Status: "registered", ExpireBlock: 50}
+	if s := idx.nameStatus(rec); s != NameActive {
+		t.Fatalf("expected an unknown height not to expire the name, got %s", s)
+	}
+	if _, err := idx.GetBlockHeight(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s := idx.nameStatus(rec); s != NameExpired {
+		t.Fatalf("expected the name expired past its expire block, got %s", s)
+	}
+}
+
+func TestTransferUnverifiesProfile(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, nil)
+	idx.Index(ctx)
+	api := NewAPI(idx, 0)
+
+	// The old owner's profile isn't served after a transfer even when fetching it again fails
+	fc.setOwner("user000.id", testAddress(testKey(7)))
+	fc.removeProfile("user000.id")
+	fc.mine("user000.id")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := db.FetchProfile(ctx, "user000.id"); err == nil && p.Verified() {
+		t.Fatalf("expected the old owner's profile to be unverified, got %+v", p)
+	}
+	if code := apiGet(t, api, "/v1/users/user000.id", nil); code == http.StatusOK {
+		t.Fatalf("expected the transferred name not to be served, got %d", code)
+	}
+	res, _ := idx.Search.Search("user000", 0, 10)
+	for _, r := range res {
+		if r.Name == "user000.id" {
+			t.Fatalf("expected the transferred name out of search, got %v", res)
+		}
+	}
+}
+
+func TestRetireSubdomains(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	fc.addSubdomain("alice.app", "sub", "Sub", testKey(3))
+	fc.setExpireBlock("alice.app", 105)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, nil)
+	idx.Index(ctx)
+	api := NewAPI(idx, 0)
+	if code := apiGet(t, api, "/v1/users/sub.alice.app", nil); code != http.StatusOK {
+		t.Fatalf("expected the subdomain to be served, got %d", code)
+	}
+
+	// The subdomains of an expired domain go with it
+	for fc.height <= 105 {
+		fc.mine()
+	}
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FetchProfile(ctx, "sub.alice.app"); err != ErrNotFound {
+		t.Fatalf("expected the subdomain's profile to be purged, got err %v", err)
+	}
+	if _, err := db.FetchZonefile(ctx, "sub.alice.app"); err != ErrNotFound {
+		t.Fatalf("expected the subdomain's zonefile to be purged, got err %v", err)
+	}
+	body := map[string]string{}
+	if code := apiGet(t, api, "/v1/users/sub.alice.app", &body); code != http.StatusGone || body["status"] != NameExpired {
+		t.Fatalf("expected 410 expired, got %d %v", code, body)
+	}
+
+	// and come back when it is renewed
+	fc.setExpireBlock("alice.app", 1000)
+	fc.mine("alice.app")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if code := apiGet(t, api, "/v1/users/sub.alice.app", nil); code != http.StatusOK {
+		t.Fatalf("expected the subdomain to be served again, got %d", code)
+	}
+}
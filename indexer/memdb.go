@@ -0,0 +1,301 @@
+package indexer
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	RegisterDB("memory", func(cfg *Config) (DB, error) {
+		return NewMemDB(), nil
+	})
+}
+
+// NewMemDB returns an empty in memory DB
+func NewMemDB() *MemDB {
+	return &MemDB{
+		zonefiles: make(map[string]NameZonefileMem),
+		profiles:  make(map[string]ProfileRecord),
+		names:     make(map[string]NameRecord),
+		dead:      make(map[string]DeadLetter),
+		resolved:  make(map[string]time.Time),
+		state:     make(map[string]string),
+	}
+}
+
+// MemDB is an in memory implementation of the DB interface. Nothing is
+// persisted, it is meant for tests and trying out the indexer
+type MemDB struct {
+	zonefiles map[string]NameZonefileMem
+	profiles  map[string]ProfileRecord
+	names     map[string]NameRecord
+	dead      map[string]DeadLetter
+	resolved  map[string]time.Time
+	state     map[string]string
+
+	sync.RWMutex
+}
+
+// UpsertNameZonefile takes a name, its zonefile hash and zonefile and stores them under the name
+func (mem *MemDB) UpsertNameZonefile(ctx context.Context, name, hash, zonefile string) error {
+	mem.Lock()
+	mem.zonefiles[name] = NameZonefileMem{Name: name, ZonefileHash: hash, Zonefile: zonefile}
+	mem.Unlock()
+	return nil
+}
+
+// UpsertNameZonefiles stores a batch of zonefiles under their names
+func (mem *MemDB) UpsertNameZonefiles(ctx context.Context, zfs []ZonefileRecord) error {
+	mem.Lock()
+	for _, zf := range zfs {
+		mem.zonefiles[zf.Name] = NameZonefileMem{Name: zf.Name, ZonefileHash: zf.Hash, Zonefile: zf.Zonefile}
+	}
+	mem.Unlock()
+	return nil
+}
+
+// FetchZonefile returns a name/zonefile pairing
+func (mem *MemDB) FetchZonefile(ctx context.Context, name string) (NameZonefile, error) {
+	mem.RLock()
+	zf, ok := mem.zonefiles[name]
+	mem.RUnlock()
+	if !ok {
+		return &NameZonefileMem{Name: name}, ErrNotFound
+	}
+	return &zf, nil
+}
+
+// UpsertProfile stores a profile record under its name
+func (mem *MemDB) UpsertProfile(ctx context.Context, rec ProfileRecord) error {
+	mem.Lock()
+	mem.profiles[rec.Name] = rec
+	mem.Unlock()
+	return nil
+}
+
+// FetchProfile returns the profile record stored for a name
+func (mem *MemDB) FetchProfile(ctx context.Context, name string) (ProfileRecord, error) {
+	mem.RLock()
+	rec, ok := mem.profiles[name]
+	mem.RUnlock()
+	if !ok {
+		return ProfileRecord{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+// EachProfile calls fn with every stored profile record, stopping at the first error
+func (mem *MemDB) EachProfile(ctx context.Context, fn func(rec ProfileRecord) error) error {
+	mem.RLock()
+	recs := make([]ProfileRecord, 0, len(mem.profiles))
+	for _, rec := range mem.profiles {
+		recs = append(recs, rec)
+	}
+	mem.RUnlock()
+	for _, rec := range recs {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertNameRecord stores a name record under its name
+func (mem *MemDB) UpsertNameRecord(ctx context.Context, rec NameRecord) error {
+	mem.Lock()
+	mem.names[rec.Name] = rec
+	mem.Unlock()
+	return nil
+}
+
+// FetchNameRecord returns the name record stored for a name
+func (mem *MemDB) FetchNameRecord(ctx context.Context, name string) (NameRecord, error) {
+	mem.RLock()
+	rec, ok := mem.names[name]
+	mem.RUnlock()
+	if !ok {
+		return NameRecord{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+// EachNameRecord calls fn with every stored name record, stopping at the first error
+func (mem *MemDB) EachNameRecord(ctx context.Context, fn func(rec NameRecord) error) error {
+	mem.RLock()
+	recs := make([]NameRecord, 0, len(mem.names))
+	for _, rec := range mem.names {
+		recs = append(recs, rec)
+	}
+	mem.RUnlock()
+	for _, rec := range recs {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeName removes the zonefile, profile and resolution time stored for a name
+func (mem *MemDB) PurgeName(ctx context.Context, name string) error {
+	mem.Lock()
+	delete(mem.zonefiles, name)
+	delete(mem.profiles, name)
+	delete(mem.resolved, name)
+	mem.Unlock()
+	return nil
+}
+
+// UpsertState stores an indexer state value
+func (mem *MemDB) UpsertState(ctx context.Context, key, value string) error {
+	mem.Lock()
+	mem.state[key] = value
+	mem.Unlock()
+	return nil
+}
+
+// FetchState returns an indexer state value
+func (mem *MemDB) FetchState(ctx context.Context, key string) (string, error) {
+	mem.RLock()
+	value, ok := mem.state[key]
+	mem.RUnlock()
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// UpsertDeadLetter stores a dead letter under its name
+func (mem *MemDB) UpsertDeadLetter(ctx context.Context, dl DeadLetter) error {
+	mem.Lock()
+	mem.dead[dl.Name] = dl
+	mem.Unlock()
+	return nil
+}
+
+// FetchDeadLetter returns the dead letter stored for a name
+func (mem *MemDB) FetchDeadLetter(ctx context.Context, name string) (DeadLetter, error) {
+	mem.RLock()
+	dl, ok := mem.dead[name]
+	mem.RUnlock()
+	if !ok {
+		return DeadLetter{}, ErrNotFound
+	}
+	return dl, nil
+}
+
+// DeleteDeadLetter removes the dead letter for a name, if there is one
+func (mem *MemDB) DeleteDeadLetter(ctx context.Context, name string) error {
+	mem.Lock()
+	delete(mem.dead, name)
+	mem.Unlock()
+	return nil
+}
+
+// EachDeadLetter calls fn with every dead letter in name order, stopping at the first error
+func (mem *MemDB) EachDeadLetter(ctx context.Context, fn func(dl DeadLetter) error) error {
+	mem.RLock()
+	dead := make([]DeadLetter, 0, len(mem.dead))
+	for _, dl := range mem.dead {
+		dead = append(dead, dl)
+	}
+	mem.RUnlock()
+	sort.Slice(dead, func(i, j int) bool { return dead[i].Name < dead[j].Name })
+	for _, dl := range dead {
+		if err := fn(dl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertResolvedAt stores when a name's profile was last resolved
+func (mem *MemDB) UpsertResolvedAt(ctx context.Context, name string, t time.Time) error {
+	mem.Lock()
+	mem.resolved[name] = t
+	mem.Unlock()
+	return nil
+}
+
+// FetchResolvedAt returns when a name's profile was last resolved
+func (mem *MemDB) FetchResolvedAt(ctx context.Context, name string) (time.Time, error) {
+	mem.RLock()
+	t, ok := mem.resolved[name]
+	mem.RUnlock()
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return t, nil
+}
+
+// EachResolvedAt calls fn with every name that has been resolved and when, stopping at the first error
+func (mem *MemDB) EachResolvedAt(ctx context.Context, fn func(name string, t time.Time) error) error {
+	mem.RLock()
+	resolved := make(map[string]time.Time, len(mem.resolved))
+	for name, t := range mem.resolved {
+		resolved[name] = t
+	}
+	mem.RUnlock()
+	for name, t := range resolved {
+		if err := fn(name, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping always succeeds, there is nothing to reach
+func (mem *MemDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, there is nothing to release
+func (mem *MemDB) Close() error {
+	return nil
+}
+
+// ZonefilesCount returns the count of all zonefiles
+func (mem *MemDB) ZonefilesCount(ctx context.Context) int {
+	mem.RLock()
+	defer mem.RUnlock()
+	return len(mem.zonefiles)
+}
+
+// ProfilesCount returns the count of all profiles
+func (mem *MemDB) ProfilesCount(ctx context.Context) int {
+	mem.RLock()
+	defer mem.RUnlock()
+	return len(mem.profiles)
+}
+
+// NameZonefileMem represents a name zonefile pairing
+// Contains methods for pulling out different types of resource records
+type NameZonefileMem struct {
+	Name         string
+	ZonefileHash string
+	Zonefile     string
+}
+
+// Hash returns the hash of the zonefile
+func (nz *NameZonefileMem) Hash() string {
+	return nz.ZonefileHash
+}
+
+// URI returns the URI records from a zonefile
+func (nz *NameZonefileMem) URI() ([]*dns.URI, error) {
+	return zonefileURI(nz.Zonefile)
+}
+
+// TXT returns the TXT records from a zonefile
+func (nz *NameZonefileMem) TXT() ([]*dns.TXT, error) {
+	return zonefileTXT(nz.Zonefile)
+}
+
+// URL returns the URLs from the URI records in a zonefile
+func (nz *NameZonefileMem) URL() ([]*url.URL, error) {
+	return zonefileURL(nz.Zonefile)
+}
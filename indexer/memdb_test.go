@@ -0,0 +1,31 @@
+package indexer
+
+import "testing"
+
+func TestMemDBZonefiles(t *testing.T) {
+	testDBZonefiles(t, NewMemDB())
+}
+
+func TestMemDBProfiles(t *testing.T) {
+	testDBProfiles(t, NewMemDB())
+}
+
+func TestMemDBNameRecords(t *testing.T) {
+	testDBNameRecords(t, NewMemDB())
+}
+
+func TestMemDBState(t *testing.T) {
+	testDBState(t, NewMemDB())
+}
+
+func TestMemDBDeadLetters(t *testing.T) {
+	testDBDeadLetters(t, NewMemDB())
+}
+
+func TestMemDBResolvedAt(t *testing.T) {
+	testDBResolvedAt(t, NewMemDB())
+}
+
+func TestMemDBPurgeName(t *testing.T) {
+	testDBPurgeName(t, NewMemDB())
+}
@@ -0,0 +1,234 @@
+package indexer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The latency histograms Observe records into
+const (
+	LatencyCore    = "core"
+	LatencyStorage = "storage"
+	LatencyDB      = "db"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// newLatencies returns the latency histograms keyed by the kind passed to Observe
+func newLatencies() map[string]*histogramVec {
+	return map[string]*histogramVec{
+		LatencyCore:    newHistogramVec("bsk_idx_core_call_duration_seconds", "Latency of each attempt at a call to core.", "call"),
+		LatencyStorage: newHistogramVec("bsk_idx_storage_fetch_duration_seconds", "Latency of each attempt at fetching a profile from storage.", "host"),
+		LatencyDB:      newHistogramVec("bsk_idx_db_operation_duration_seconds", "Latency of database operations.", "op"),
+	}
+}
+
+// scrapedGauge is a value read when /metrics is scraped
+type scrapedGauge struct {
+	name, help string
+	fn         func(ctx context.Context) float64
+}
+
+// GaugeFunc registers a gauge for /metrics, fn is called on every scrape
+func (stats *Stats) GaugeFunc(name, help string, fn func(ctx context.Context) float64) {
+	stats.Lock()
+	stats.scraped = append(stats.scraped, scrapedGauge{name: name, help: help, fn: fn})
+	stats.Unlock()
+}
+
+// storedCountTTL is how long a count of the stored zonefiles or profiles is served for
+const storedCountTTL = time.Minute
+
+// cachedCount is a database count that is only taken again once it is ttl old. Concurrent
+// scrapes wait for the one taking it
+type cachedCount struct {
+	ttl   time.Duration
+	count func(ctx context.Context) int
+
+	at time.Time
+	v  int
+	sync.Mutex
+}
+
+func (c *cachedCount) get(ctx context.Context) float64 {
+	c.Lock()
+	defer c.Unlock()
+	if c.at.IsZero() || time.Since(c.at) >= c.ttl {
+		c.v, c.at = c.count(ctx), time.Now()
+	}
+	return float64(c.v)
+}
+
+// statGroupMetrics describes how each stat group is exported. Counter groups with a label
+// are recorded with Labeled and export the label and the outcome, gauge groups are keyed by
+// the label alone and the rest label the key as the event
+var statGroupMetrics = [numStatGroups]struct {
+	name, help, typ, label string
+}{
+	StatNamespaces:     {"bsk_idx_namespace_names", "Names registered in each namespace.", "gauge", ""},
+	StatNameFetch:      {"bsk_idx_name_fetch_total", "Name listing events.", "counter", ""},
+	StatNameDetails:    {"bsk_idx_name_details_total", "Name record lookup events.", "counter", ""},
+	StatZonefiles:      {"bsk_idx_zonefiles_total", "Zonefile indexing events.", "counter", ""},
+	StatProfiles:       {"bsk_idx_profiles_total", "Profile resolution events.", "counter", ""},
+	StatBlocks:         {"bsk_idx_blocks_total", "Block indexing events.", "counter", ""},
+	StatHosts:          {"bsk_idx_host_calls_total", "Calls to each core host by outcome.", "counter", "host"},
+	StatRetries:        {"bsk_idx_retries_total", "Retry policy outcomes by call.", "counter", "call"},
+	StatDeadLetters:    {"bsk_idx_dead_letters_total", "Names dead lettered by stage and dead letters retried or cleared.", "counter", ""},
+	StatPipeline:       {"bsk_idx_pipeline_items_total", "Items each pipeline stage processed or failed on.", "counter", "stage"},
+	StatQueues:         {"bsk_idx_pipeline_queue_depth", "Items waiting in each pipeline stage's queue when it last took one.", "gauge", "stage"},
+	StatNamespaceIndex: {"bsk_idx_namespace_indexed_total", "Names, zonefiles and profiles indexed in each namespace.", "counter", "namespace"},
+}
+
+// Observe records the time since start in the kind of latency histogram, one of
+// LatencyCore, LatencyStorage or LatencyDB, under label
+func (stats *Stats) Observe(kind, label string, start time.Time) {
+	h, ok := stats.latencies[kind]
+	if !ok {
+		return
+	}
+	h.observe(label, time.Since(start).Seconds())
+}
+
+// handleMetrics serves the stats in the Prometheus text format
+func (stats *Stats) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	stats.writeMetrics(r.Context(), bw)
+	bw.Flush()
+}
+
+func (stats *Stats) writeMetrics(ctx context.Context, w io.Writer) {
+	// The gauges can query the database so they are read without holding the lock
+	stats.Lock()
+	scraped := append([]scrapedGauge{}, stats.scraped...)
+	stats.Unlock()
+	for _, g := range scraped {
+		writeHeader(w, g.name, g.help, "gauge")
+		fmt.Fprintf(w, "%s %v\n", g.name, g.fn(ctx))
+	}
+
+	stats.Status.Lock()
+	status := [][2]string{
+		{"names", stats.Status.NamesIndex},
+		{"zonefiles", stats.Status.ZonefilesIndex},
+		{"profiles", stats.Status.ProfilesIndex},
+	}
+	stats.Status.Unlock()
+	writeHeader(w, "bsk_idx_index_ready", "Whether the initial sync of each index has finished.", "gauge")
+	for _, st := range status {
+		v := 0
+		if st[1] == "ready" {
+			v = 1
+		}
+		fmt.Fprintf(w, "bsk_idx_index_ready{index=\"%s\"} %d\n", st[0], v)
+	}
+
+	values := stats.values()
+	for g := StatGroup(0); g < numStatGroups; g++ {
+		m := statGroupMetrics[g]
+		writeHeader(w, m.name, m.help, m.typ)
+		for _, v := range values[g] {
+			switch {
+			case g == StatNamespaces:
+				fmt.Fprintf(w, "%s{namespace=\"%s\"} %d\n", m.name, escapeLabel(strings.TrimSuffix(v.key.name, "_count")), v.value)
+			case m.typ == "gauge":
+				fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", m.name, m.label, escapeLabel(v.key.name), v.value)
+			case m.label != "":
+				fmt.Fprintf(w, "%s{%s=\"%s\",outcome=\"%s\"} %d\n", m.name, m.label, escapeLabel(v.key.label), escapeLabel(v.key.name), v.value)
+			default:
+				fmt.Fprintf(w, "%s{event=\"%s\"} %d\n", m.name, escapeLabel(v.key.name), v.value)
+			}
+		}
+	}
+
+	for _, kind := range []string{LatencyCore, LatencyStorage, LatencyDB} {
+		stats.latencies[kind].write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper escapes label values the way the text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// histogramVec is a latency histogram with one series per label value. Observing only
+// takes a lock the first time a label is seen
+type histogramVec struct {
+	name, help, label string
+	series            sync.Map
+}
+
+type histogram struct {
+	// counts[i] is the number of observations no greater than latencyBuckets[i]
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// sum holds the bits of a float64
+	sum atomic.Uint64
+}
+
+func newHistogramVec(name, help, label string) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label}
+}
+
+func (hv *histogramVec) observe(label string, v float64) {
+	s, ok := hv.series.Load(label)
+	if !ok {
+		s, _ = hv.series.LoadOrStore(label, &histogram{counts: make([]atomic.Uint64, len(latencyBuckets))})
+	}
+	h := s.(*histogram)
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i].Add(1)
+		}
+	}
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+	h.count.Add(1)
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	writeHeader(w, hv.name, hv.help, "histogram")
+	labels := make([]string, 0)
+	hv.series.Range(func(l, _ interface{}) bool {
+		labels = append(labels, l.(string))
+		return true
+	})
+	sort.Strings(labels)
+	for _, l := range labels {
+		s, _ := hv.series.Load(l)
+		h := s.(*histogram)
+		lv := escapeLabel(l)
+		// Read the total first so no bucket is ahead of it
+		count := h.count.Load()
+		for i, le := range latencyBuckets {
+			c := h.counts[i].Load()
+			if c > count {
+				c = count
+			}
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%v\"} %d\n", hv.name, hv.label, lv, le, c)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", hv.name, hv.label, lv, count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %v\n", hv.name, hv.label, lv, math.Float64frombits(h.sum.Load()))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", hv.name, hv.label, lv, count)
+	}
+}
@@ -0,0 +1,85 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	names := fc.names()
+	idx := newTestIndexer(t, fc, db, names)
+	idx.GetAllZonefiles(ctx)
+	idx.ResolveNames(ctx, names)
+	idx.ST.UpdateStatus("names.ready")
+	idx.ST.Rec(StatHosts.Labeled("http://core_1:6270", "success"), 2)
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		idx.ST.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		return w.Body.String()
+	}
+	want := []string{
+		fmt.Sprintf("bsk_idx_names %d\n", len(names)),
+		fmt.Sprintf("bsk_idx_zonefiles %d\n", len(names)),
+		fmt.Sprintf("bsk_idx_profiles %d\n", len(names)),
+		"bsk_idx_index_ready{index=\"names\"} 1\n",
+		"bsk_idx_index_ready{index=\"profiles\"} 0\n",
+		fmt.Sprintf("bsk_idx_zonefiles_total{event=\"changed\"} %d\n", len(names)),
+		"bsk_idx_host_calls_total{host=\"http://core_1:6270\",outcome=\"success\"} 2\n",
+		"# TYPE bsk_idx_core_call_duration_seconds histogram\n",
+		fmt.Sprintf("bsk_idx_core_call_duration_seconds_count{call=\"GetNameBlockchainRecord\"} %d\n", len(names)),
+		"bsk_idx_storage_fetch_duration_seconds_bucket{host=",
+		fmt.Sprintf("bsk_idx_db_operation_duration_seconds_count{op=\"UpsertProfile\"} %d\n", len(names)),
+		fmt.Sprintf("bsk_idx_pipeline_items_total{stage=\"nameDetails\",outcome=\"processed\"} %d\n", len(names)),
+		fmt.Sprintf("bsk_idx_pipeline_items_total{stage=\"resolve\",outcome=\"processed\"} %d\n", len(names)),
+		"bsk_idx_pipeline_queue_depth{stage=\"zonefiles\"} ",
+	}
+	body := scrape()
+	for _, w := range want {
+		if !strings.Contains(body, w) {
+			t.Fatalf("expected /metrics to contain %q, got\n%s", w, body)
+		}
+	}
+}
+
+func TestMetricsBoundedLabels(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://gaia.blockstack.org/hub/1abc/profile.json":       "gaia.blockstack.org",
+		"https://GAIA.blockstack.org:443/hub/1abc/0/profile.json": "gaia.blockstack.org",
+		"http://127.0.0.1:8080/hub/alice.app/profile.json":        "other",
+		"https://attacker-42.example.com/profile.json":            "other",
+	} {
+		u, _ := url.Parse(raw)
+		if got := storageHost(u); got != want {
+			t.Fatalf("expected %s to be recorded as %q, got %q", raw, want, got)
+		}
+	}
+
+	// Stored counts are taken once per ttl however often /metrics is scraped
+	calls := 0
+	c := &cachedCount{ttl: time.Hour, count: func(ctx context.Context) int {
+		calls++
+		return calls
+	}}
+	for i := 0; i < 3; i++ {
+		if v := c.get(context.Background()); v != 1 {
+			t.Fatalf("expected the cached count, got %v", v)
+		}
+	}
+	c.ttl = 0
+	if v := c.get(context.Background()); v != 2 || calls != 2 {
+		t.Fatalf("expected a fresh count once the ttl passed, got %v after %d counts", v, calls)
+	}
+}
@@ -1,94 +1,219 @@
 package indexer
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
 )
 
-// returns the publicKey from this signed profile in the following order
-//   - pt.ParentPublicKey
-//   - pt.DecodedToken.Payload.Issuer.PublicKey
-//   - pt.DecodedToken.Payload.Subject.PublicKey
-func (pt *ProfileTokenFile) getPubKey() string {
-	if pt.ParentPublicKey != "" {
-		return pt.ParentPublicKey
-	} else if pt.DecodedToken.Payload.Issuer.PublicKey != "" {
-		return pt.DecodedToken.Payload.Issuer.PublicKey
-	} else if pt.DecodedToken.Payload.Subject.PublicKey != "" {
-		return pt.DecodedToken.Payload.Subject.PublicKey
-	}
-	return ""
+// Reasons a profile token fails verification, recorded in stats as profiles.unverified_{reason}
+const (
+	reasonMalformed      = "malformed"
+	reasonUnsupportedAlg = "unsupported_alg"
+	reasonMissingSubject = "missing_subject"
+	reasonMissingIssuer  = "missing_issuer"
+	reasonMissingClaim   = "missing_claim"
+	reasonBadPublicKey   = "bad_public_key"
+	reasonBadSignature   = "bad_signature"
+	reasonExpired        = "expired"
+	reasonNotYetIssued   = "not_yet_issued"
+	reasonOwnerUnknown   = ProfileOwnerUnknown
+	reasonOwnerMismatch  = ProfileOwnerMismatch
+)
+
+// VerifyError is returned when a profile token fails verification
+type VerifyError struct {
+	Reason string
+	Err    error
+}
+
+func (ve *VerifyError) Error() string {
+	return fmt.Sprintf("profile token %s: %s", ve.Reason, ve.Err)
+}
+
+func verifyErr(reason string, format string, args ...interface{}) error {
+	return &VerifyError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// verifyReason returns the reason code for a Validate error
+func verifyReason(err error) string {
+	if ve, ok := err.(*VerifyError); ok {
+		return ve.Reason
+	}
+	return reasonMalformed
 }
 
-// Validate if the profile is valid
+// tokenClockSkew is how far in the future a token can say it was issued, for clocks that differ
+const tokenClockSkew = 5 * time.Minute
+
+// Validate decodes pt.Token and verifies its ES256K signature against the issuer public key
+// the way blockstack.js verifyProfileToken does, and that it has been issued and hasn't
+// expired. On success pt.DecodedToken is replaced with the contents of the signed token,
+// the decodedToken served alongside it is not trusted. Errors are *VerifyError
 func (pt *ProfileTokenFile) Validate() error {
-	dt := &Payload{}
-	out := strings.Split(pt.Token, ".")
-	err := json.Unmarshal([]byte(out[1]), dt)
+	return pt.validateAt(time.Now())
+}
 
+// validateAt is Validate with the token's times checked against now
+func (pt *ProfileTokenFile) validateAt(now time.Time) error {
+	parts := strings.Split(pt.Token, ".")
+	if len(parts) != 3 {
+		return verifyErr(reasonMalformed, "expected 3 token segments, got %d", len(parts))
+	}
+
+	dt := DecodedToken{Signature: parts[2]}
+	if err := decodeSegment(parts[0], &dt.Header); err != nil {
+		return verifyErr(reasonMalformed, "error unmarshalling token header %s", err)
+	}
+	if err := decodeSegment(parts[1], &dt.Payload); err != nil {
+		return verifyErr(reasonMalformed, "error unmarshalling token payload %s", err)
+	}
+	// blockstack.js sets the registered iat and exp claims as ISO 8601 strings
+	times := struct {
+		IssuedAt  interface{} `json:"iat"`
+		ExpiresAt interface{} `json:"exp"`
+	}{}
+	if err := decodeSegment(parts[1], &times); err != nil {
+		return verifyErr(reasonMalformed, "error unmarshalling token payload %s", err)
+	}
+	iat, err := tokenTime(times.IssuedAt)
 	if err != nil {
-		return fmt.Errorf("Error unmarshalling tokenPayload %s", err)
+		return verifyErr(reasonMalformed, "token iat: %s", err)
 	}
-	if dt.Subject.PublicKey == "" {
-		return fmt.Errorf("Token doesn't have a subject public key")
+	exp, err := tokenTime(times.ExpiresAt)
+	if err != nil {
+		return verifyErr(reasonMalformed, "token exp: %s", err)
 	}
-	if dt.Issuer.PublicKey == "" {
-		return fmt.Errorf("Token doesn't have an issuer public key")
+
+	if dt.Header.Alg != "ES256K" {
+		return verifyErr(reasonUnsupportedAlg, "token algorithm %q is not ES256K", dt.Header.Alg)
 	}
-	if dt.Claim.Type == "" {
-		return fmt.Errorf("Token doesn't have a claim")
+	if dt.Payload.Subject.PublicKey == "" {
+		return verifyErr(reasonMissingSubject, "token doesn't have a subject public key")
+	}
+	if dt.Payload.Issuer.PublicKey == "" {
+		return verifyErr(reasonMissingIssuer, "token doesn't have an issuer public key")
+	}
+	if dt.Payload.Claim.Type == "" {
+		return verifyErr(reasonMissingClaim, "token doesn't have a claim")
 	}
 
 	// Decode hex-encoded serialized public key.
-	pubKeyBytes, err := hex.DecodeString(dt.Issuer.PublicKey)
+	pubKeyBytes, err := hex.DecodeString(dt.Payload.Issuer.PublicKey)
 	if err != nil {
-		return err
+		return verifyErr(reasonBadPublicKey, "%s", err)
+	}
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	if err != nil {
+		return verifyErr(reasonBadPublicKey, "%s", err)
 	}
 
-	// const issuerPublicKey = payload.issuer.publicKey
-	// const publicKeyBuffer = new Buffer(issuerPublicKey, 'hex')
-	//
-	// const Q = ecurve.Point.decodeFrom(secp256k1, publicKeyBuffer)
-	// const compressedKeyPair = new ECPair(null, Q, { compressed: true })
-	// const compressedAddress = compressedKeyPair.getAddress()
-	// const uncompressedKeyPair = new ECPair(null, Q, { compressed: false })
-	// const uncompressedAddress = uncompressedKeyPair.getAddress()
+	sig, err := decodeSignature(parts[2])
+	if err != nil {
+		return verifyErr(reasonBadSignature, "%s", err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !sig.Verify(hash[:], pubKey) {
+		return verifyErr(reasonBadSignature, "signature does not match issuer public key")
+	}
 
-	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	// The times are only trusted once the signature is
+	if !exp.IsZero() && !now.Before(exp) {
+		return verifyErr(reasonExpired, "token expired at %s", exp.Format(time.RFC3339))
+	}
+	if !iat.IsZero() && iat.After(now.Add(tokenClockSkew)) {
+		return verifyErr(reasonNotYetIssued, "token issued at %s, in the future", iat.Format(time.RFC3339))
+	}
+
+	pt.DecodedToken = dt
+	return nil
+}
+
+// VerifyOwner checks that the key which signed the token belongs to the name owner. The
+// issuer public key is hashed into both its compressed and uncompressed P2PKH address
+// forms, like blockstack.js does, and either has to match ownerAddress, which has to be a
+// mainnet P2PKH address. Validate must have succeeded first. Errors are *VerifyError
+func (pt *ProfileTokenFile) VerifyOwner(ownerAddress string) error {
+	if ownerAddress == "" {
+		return verifyErr(reasonOwnerUnknown, "name has no owner address")
+	}
+	owner, version, err := base58.CheckDecode(ownerAddress)
 	if err != nil {
-		return err
+		return verifyErr(reasonOwnerUnknown, "owner address %s: %s", ownerAddress, err)
+	}
+	// Any other version byte is a different address for the same hash, e.g. a P2SH script
+	// or a testnet key, which the issuer key doesn't prove control of
+	if version != chaincfg.MainNetParams.PubKeyHashAddrID {
+		return verifyErr(reasonOwnerMismatch, "owner %s is not a mainnet P2PKH address", ownerAddress)
 	}
 
-	if pt.getPubKey() == string(pubKey.SerializeCompressed()) {
-		// pass
-	} else if pt.getPubKey() == string(pubKey.SerializeUncompressed()) {
-		// pass
-	} else {
-		return fmt.Errorf("Token issuer public key does not match the verifying value")
-	}
-
-	// // Decode hex-encoded serialized signature.
-	// sigBytes, err := hex.DecodeString("30450220090ebfb3690a0ff115bb1b38b" +
-	// 	"8b323a667b7653454f1bccb06d4bbdca42c2079022100ec95778b51e707" +
-	// 	"1cb1205f8bde9af6592fc978b0452dafe599481c46d6b2e479")
-	//
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return
-	// }
-	// signature, err := btcec.ParseSignature(sigBytes, btcec.S256())
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return
-	// }
+	pubKeyBytes, err := hex.DecodeString(pt.DecodedToken.Payload.Issuer.PublicKey)
+	if err != nil {
+		return verifyErr(reasonBadPublicKey, "%s", err)
+	}
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	if err != nil {
+		return verifyErr(reasonBadPublicKey, "%s", err)
+	}
 
+	compressed := btcutil.Hash160(pubKey.SerializeCompressed())
+	uncompressed := btcutil.Hash160(pubKey.SerializeUncompressed())
+	if !bytes.Equal(owner, compressed) && !bytes.Equal(owner, uncompressed) {
+		return verifyErr(reasonOwnerMismatch, "token issuer is not owner %s", ownerAddress)
+	}
 	return nil
 }
 
+// tokenTime parses a token's iat or exp claim, an ISO 8601 string like blockstack.js sets or
+// seconds since the epoch like other JWTs. A missing claim is the zero time
+func tokenTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case string:
+		return time.Parse(time.RFC3339, t)
+	case float64:
+		return time.Unix(int64(t), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected value %v", v)
+}
+
+// decodeSegment base64url decodes a JWT segment and unmarshals the JSON inside
+func decodeSegment(seg string, v interface{}) error {
+	byt, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byt, v)
+}
+
+// decodeSignature decodes an ES256K JWT signature. JOSE signatures are the
+// 32 byte R and S values concatenated, DER encoded signatures are also accepted
+func decodeSignature(seg string) (*btcec.Signature, error) {
+	byt, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(byt) == 64 {
+		return &btcec.Signature{
+			R: new(big.Int).SetBytes(byt[:32]),
+			S: new(big.Int).SetBytes(byt[32:]),
+		}, nil
+	}
+	return btcec.ParseDERSignature(byt, btcec.S256())
+}
+
 // JSON Marshals things
 func (pt *ProfileTokenFile) JSON() string {
 	byt, err := json.Marshal(pt)
@@ -0,0 +1,208 @@
+package indexer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+)
+
+// testKey returns a deterministic private key for signing fixtures
+func testKey(seed byte) *btcec.PrivateKey {
+	b := make([]byte, 32)
+	for i := range b {
+		b[i] = seed
+	}
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+	return priv
+}
+
+// testAddress returns the compressed P2PKH mainnet address for a key
+func testAddress(priv *btcec.PrivateKey) string {
+	addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(priv.PubKey().SerializeCompressed()), &chaincfg.MainNetParams)
+	if err != nil {
+		panic(err)
+	}
+	return addr.EncodeAddress()
+}
+
+// signProfileToken produces a token the same way blockstack.js signProfileToken does,
+// issued now and expiring in a year
+func signProfileToken(priv *btcec.PrivateKey, claim Profile) string {
+	return signProfileTokenAt(priv, claim, time.Now(), time.Now().AddDate(1, 0, 0))
+}
+
+// signProfileTokenAt produces a token issued at iat that expires at exp
+func signProfileTokenAt(priv *btcec.PrivateKey, claim Profile, iat, exp time.Time) string {
+	pub := hex.EncodeToString(priv.PubKey().SerializeCompressed())
+	payload, _ := json.Marshal(map[string]interface{}{
+		"jti":     "fixture",
+		"iat":     iat.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"exp":     exp.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"subject": PublicKey{PublicKey: pub},
+		"issuer":  PublicKey{PublicKey: pub},
+		"claim":   claim,
+	})
+	return signJWT(priv, string(payload))
+}
+
+// signJWT signs a payload as an ES256K JWT with a JOSE signature
+func signJWT(priv *btcec.PrivateKey, payload string) string {
+	header, _ := json.Marshal(Header{Typ: "JWT", Alg: "ES256K"})
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	hash := sha256.Sum256([]byte(input))
+	sig, err := priv.Sign(hash[:])
+	if err != nil {
+		panic(err)
+	}
+	jose := make([]byte, 64)
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	copy(jose[32-len(r):32], r)
+	copy(jose[64-len(s):], s)
+	return input + "." + base64.RawURLEncoding.EncodeToString(jose)
+}
+
+func TestValidate(t *testing.T) {
+	priv := testKey(1)
+	token := signProfileToken(priv, Profile{Type: "Person", Name: "Signed"})
+	parts := strings.Split(token, ".")
+
+	// A payload signed by a different key under the original issuer
+	forged := strings.Split(signProfileToken(testKey(2), Profile{Type: "Person", Name: "Forged"}), ".")
+
+	now := time.Now()
+	expired := signProfileTokenAt(priv, Profile{Type: "Person"}, now.AddDate(-1, 0, 0), now.Add(-time.Minute))
+	future := signProfileTokenAt(priv, Profile{Type: "Person"}, now.Add(time.Hour), now.AddDate(1, 0, 0))
+	skewed := signProfileTokenAt(priv, Profile{Type: "Person", Name: "Signed"}, now.Add(time.Minute), now.AddDate(1, 0, 0))
+	badExp := signJWT(priv, `{"iat":"2018-01-01T00:00:00.000Z","exp":"next year","subject":{"publicKey":"00"},"issuer":{"publicKey":"00"},"claim":{"@type":"Person"}}`)
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"valid", token, ""},
+		{"segments", parts[0] + "." + parts[1], reasonMalformed},
+		{"payload encoding", parts[0] + ".{}." + parts[2], reasonMalformed},
+		{"swapped signature", forged[0] + "." + forged[1] + "." + parts[2], reasonBadSignature},
+		{"truncated payload", parts[0] + "." + parts[1][:len(parts[1])-4] + "." + parts[2], reasonMalformed},
+		{"algorithm", base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"none"}`)) + "." + parts[1] + "." + parts[2], reasonUnsupportedAlg},
+		{"expired", expired, reasonExpired},
+		{"issued in the future", future, reasonNotYetIssued},
+		{"clock skew", skewed, ""},
+		{"expiry encoding", badExp, reasonMalformed},
+	}
+	for _, tc := range tests {
+		// The decodedToken served next to the token must not be trusted
+		pt := &ProfileTokenFile{
+			Token:        tc.token,
+			DecodedToken: DecodedToken{Payload: Payload{Claim: Profile{Type: "Person", Name: "Unsigned"}}},
+		}
+		err := pt.Validate()
+		if tc.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tc.name, err)
+			} else if pt.DecodedToken.Payload.Claim.Name != "Signed" {
+				t.Errorf("%s: expected the signed claim, got %+v", tc.name, pt.DecodedToken.Payload.Claim)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected %s error", tc.name, tc.reason)
+		} else if r := verifyReason(err); r != tc.reason {
+			t.Errorf("%s: expected reason %s, got %s (%s)", tc.name, tc.reason, r, err)
+		}
+	}
+}
+
+func TestValidateDERSignature(t *testing.T) {
+	priv := testKey(3)
+	parts := strings.Split(signProfileToken(priv, Profile{Type: "Person"}), ".")
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	sig, _ := priv.Sign(hash[:])
+	pt := &ProfileTokenFile{Token: parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig.Serialize())}
+	if err := pt.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyOwner(t *testing.T) {
+	priv := testKey(4)
+	pt := &ProfileTokenFile{Token: signProfileToken(priv, Profile{Type: "Person"})}
+	if err := pt.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	uncompressed, _ := btcutil.NewAddressPubKeyHash(btcutil.Hash160(priv.PubKey().SerializeUncompressed()), &chaincfg.MainNetParams)
+	testnet, _ := btcutil.NewAddressPubKeyHash(btcutil.Hash160(priv.PubKey().SerializeCompressed()), &chaincfg.TestNet3Params)
+	// A P2SH address whose script hash happens to be the key's hash
+	script, _ := btcutil.NewAddressScriptHashFromHash(btcutil.Hash160(priv.PubKey().SerializeCompressed()), &chaincfg.MainNetParams)
+
+	tests := []struct {
+		name   string
+		owner  string
+		reason string
+	}{
+		{"compressed", testAddress(priv), ""},
+		{"uncompressed", uncompressed.EncodeAddress(), ""},
+		{"testnet", testnet.EncodeAddress(), reasonOwnerMismatch},
+		{"p2sh", script.EncodeAddress(), reasonOwnerMismatch},
+		{"other owner", testAddress(testKey(5)), reasonOwnerMismatch},
+		{"no owner", "", reasonOwnerUnknown},
+		{"bad owner", "not-an-address", reasonOwnerUnknown},
+	}
+	for _, tc := range tests {
+		err := pt.VerifyOwner(tc.owner)
+		if tc.reason == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		} else if tc.reason != "" && (err == nil || verifyReason(err) != tc.reason) {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.reason, err)
+		}
+	}
+}
+
+// testdata/blockstackjs_profile.json is a token file as a Gaia hub serves it. The token was
+// signed outside Go, with node's secp256k1 ECDSA following jsontokens TokenSigner and the
+// payload laid out by blockstack.js signProfileToken, so it checks the JSON and signature
+// encodings against the JavaScript ones rather than against signProfileToken above
+func TestValidateBlockstackJSToken(t *testing.T) {
+	byt, err := ioutil.ReadFile(filepath.Join("testdata", "blockstackjs_profile.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []*ProfileTokenFile{}
+	if err := json.Unmarshal(byt, &files); err != nil || len(files) != 1 {
+		t.Fatalf("expected one token file, got %d, err %v", len(files), err)
+	}
+	pt := files[0]
+	// The token expired in 2019, it was valid when it was signed
+	if err := (&ProfileTokenFile{Token: pt.Token}).Validate(); verifyReason(err) != reasonExpired {
+		t.Fatalf("expected the token to have expired, got %v", err)
+	}
+	if err := pt.validateAt(time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if name := pt.DecodedToken.Payload.Claim.Name; name != "Zoë Ångström & Co <test>" {
+		t.Fatalf("unexpected claim name %q", name)
+	}
+	if err := pt.VerifyOwner("1NZNxhoxobqwsNvTb16pdeiqvFvce3Yg8U"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Go escapes & < > where JSON.stringify doesn't, re-encoding the payload breaks the signature
+	parts := strings.Split(pt.Token, ".")
+	payload, _ := json.Marshal(pt.DecodedToken.Payload)
+	reencoded := &ProfileTokenFile{Token: parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]}
+	if err := reencoded.validateAt(time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)); verifyReason(err) != reasonBadSignature {
+		t.Fatalf("expected a re-encoded payload to fail, got %v", err)
+	}
+}
@@ -1,10 +1,11 @@
 package indexer
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/url"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
@@ -12,21 +13,31 @@ import (
 )
 
 const (
-	profilesCollection  = "profiles"
-	zonefilesCollection = "zonefiles"
+	profilesCollection    = "profiles"
+	zonefilesCollection   = "zonefiles"
+	namesCollection       = "names"
+	stateCollection       = "state"
+	deadLettersCollection = "dead_letters"
+	resolvedCollection    = "resolved"
 )
 
+func init() {
+	RegisterDB("mongo", func(cfg *Config) (DB, error) {
+		return NewMongoDB(cfg)
+	})
+}
+
 // NewMongoDB returns a connected instance of the MongoDB Driver
-func NewMongoDB(cfg *Config) *MongoDB {
+func NewMongoDB(cfg *Config) (*MongoDB, error) {
 	session, err := mgo.Dial(cfg.DB.Connection)
 	if err != nil {
-		log.Fatal("Failed to connect to mongodb at", cfg.DB.Connection, "...")
+		return nil, fmt.Errorf("failed to connect to mongodb at %s: %s", cfg.DB.Connection, err)
 	}
 	return &MongoDB{
 		Connection: cfg.DB.Connection,
 		Database:   cfg.DB.Database,
 		Session:    session,
-	}
+	}, nil
 }
 
 // MongoDB is an implementation of the DB interface
@@ -38,46 +49,334 @@ type MongoDB struct {
 	sync.Mutex
 }
 
-// UpsertNameZonefile takes a name and a zonefile and inserts it as {"_id": name, "zonefile": zonefile}
-func (mdb *MongoDB) UpsertNameZonefile(name, zonefile string) error {
+// Close closes the session to mongo
+func (mdb *MongoDB) Close() error {
+	mdb.Session.Close()
+	return nil
+}
+
+// Ping checks the server can be reached
+func (mdb *MongoDB) Ping(ctx context.Context) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Ping()
+}
+
+// session returns a copy of the session for one operation with ctx's deadline as its socket
+// timeout. mgo doesn't take a context so cancellation is only checked before starting
+func (mdb *MongoDB) session(ctx context.Context) (*mgo.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	session := mdb.Session.Clone()
+	if deadline, ok := ctx.Deadline(); ok {
+		session.SetSocketTimeout(time.Until(deadline))
+	}
+	return session, nil
+}
+
+// UpsertNameZonefile takes a name, its zonefile hash and zonefile and inserts it as {"_id": name, "hash": hash, "zonefile": zonefile}
+func (mdb *MongoDB) UpsertNameZonefile(ctx context.Context, name, hash, zonefile string) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
 	defer session.Close()
-	_, err := session.DB(mdb.Database).C(zonefilesCollection).Upsert(bson.M{"_id": name}, bson.M{"_id": name, "zonefile": zonefile})
+	_, err = session.DB(mdb.Database).C(zonefilesCollection).Upsert(bson.M{"_id": name}, bson.M{"_id": name, "hash": hash, "zonefile": zonefile})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// UpsertNameZonefiles inserts a batch of zonefiles as {"_id": name, "hash": hash, "zonefile": zonefile}
+// in one bulk write
+func (mdb *MongoDB) UpsertNameZonefiles(ctx context.Context, zfs []ZonefileRecord) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	bulk := session.DB(mdb.Database).C(zonefilesCollection).Bulk()
+	bulk.Unordered()
+	for _, zf := range zfs {
+		bulk.Upsert(bson.M{"_id": zf.Name}, bson.M{"_id": zf.Name, "hash": zf.Hash, "zonefile": zf.Zonefile})
+	}
+	_, err = bulk.Run()
+	return err
+}
+
 // FetchZonefile returns a name/zonefile pairing
-func (mdb *MongoDB) FetchZonefile(name string) (NameZonefile, error) {
-	session := mdb.Session.Clone()
+func (mdb *MongoDB) FetchZonefile(ctx context.Context, name string) (NameZonefile, error) {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer session.Close()
 	zf := &NameZonefileMongo{}
 	findFilter := bson.M{"_id": name}
-	err := session.DB(mdb.Database).C(zonefilesCollection).Find(findFilter).One(zf)
-	if err != nil {
-		return zf, err
+	err = session.DB(mdb.Database).C(zonefilesCollection).Find(findFilter).One(zf)
+	if err == mgo.ErrNotFound {
+		return zf, ErrNotFound
 	}
 	return zf, err
 }
 
-// UpsertProfile takes a name and a profile and inserts it as {"_id": name, "profile": profile}
-func (mdb *MongoDB) UpsertProfile(name string, profile Profile) error {
-	session := mdb.Session.Clone()
+// UpsertProfile takes a profile record and inserts it as {"_id": name, "profile": profile, "verification": verification}
+func (mdb *MongoDB) UpsertProfile(ctx context.Context, rec ProfileRecord) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
 	defer session.Close()
-	upsertFilter := bson.M{"_id": name}
-	upsertData := bson.M{"_id": name, "profile": profile}
-	_, err := session.DB(mdb.Database).C(profilesCollection).Upsert(upsertFilter, upsertData)
+	upsertFilter := bson.M{"_id": rec.Name}
+	_, err = session.DB(mdb.Database).C(profilesCollection).Upsert(upsertFilter, rec)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// FetchProfile returns the profile record stored for a name
+func (mdb *MongoDB) FetchProfile(ctx context.Context, name string) (ProfileRecord, error) {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return ProfileRecord{}, err
+	}
+	defer session.Close()
+	rec := ProfileRecord{}
+	err = session.DB(mdb.Database).C(profilesCollection).Find(bson.M{"_id": name}).One(&rec)
+	if err == mgo.ErrNotFound {
+		return rec, ErrNotFound
+	}
+	return rec, err
+}
+
+// EachProfile calls fn with every stored profile record, stopping at the first error
+func (mdb *MongoDB) EachProfile(ctx context.Context, fn func(rec ProfileRecord) error) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	iter := session.DB(mdb.Database).C(profilesCollection).Find(nil).Iter()
+	rec := ProfileRecord{}
+	for iter.Next(&rec) {
+		if err := fn(rec); err != nil {
+			iter.Close()
+			return err
+		}
+		rec = ProfileRecord{}
+	}
+	return iter.Close()
+}
+
+// UpsertNameRecord takes a name record and inserts it as {"_id": name, ...}
+func (mdb *MongoDB) UpsertNameRecord(ctx context.Context, rec NameRecord) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	_, err = session.DB(mdb.Database).C(namesCollection).Upsert(bson.M{"_id": rec.Name}, rec)
+	return err
+}
+
+// FetchNameRecord returns the name record stored for a name
+func (mdb *MongoDB) FetchNameRecord(ctx context.Context, name string) (NameRecord, error) {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return NameRecord{}, err
+	}
+	defer session.Close()
+	rec := NameRecord{}
+	err = session.DB(mdb.Database).C(namesCollection).Find(bson.M{"_id": name}).One(&rec)
+	if err == mgo.ErrNotFound {
+		return rec, ErrNotFound
+	}
+	return rec, err
+}
+
+// EachNameRecord calls fn with every stored name record, stopping at the first error
+func (mdb *MongoDB) EachNameRecord(ctx context.Context, fn func(rec NameRecord) error) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	iter := session.DB(mdb.Database).C(namesCollection).Find(nil).Iter()
+	rec := NameRecord{}
+	for iter.Next(&rec) {
+		if err := fn(rec); err != nil {
+			iter.Close()
+			return err
+		}
+		rec = NameRecord{}
+	}
+	return iter.Close()
+}
+
+// PurgeName removes the zonefile, profile and resolution time stored for a name
+func (mdb *MongoDB) PurgeName(ctx context.Context, name string) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	for _, c := range []string{zonefilesCollection, profilesCollection, resolvedCollection} {
+		err = session.DB(mdb.Database).C(c).RemoveId(name)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertState stores an indexer state value as {"_id": key, "value": value}
+func (mdb *MongoDB) UpsertState(ctx context.Context, key, value string) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	_, err = session.DB(mdb.Database).C(stateCollection).Upsert(bson.M{"_id": key}, bson.M{"_id": key, "value": value})
+	return err
+}
+
+// FetchState returns an indexer state value
+func (mdb *MongoDB) FetchState(ctx context.Context, key string) (string, error) {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out := struct {
+		Value string `bson:"value"`
+	}{}
+	err = session.DB(mdb.Database).C(stateCollection).Find(bson.M{"_id": key}).One(&out)
+	if err == mgo.ErrNotFound {
+		return "", ErrNotFound
+	}
+	return out.Value, err
+}
+
+// UpsertDeadLetter takes a dead letter and inserts it as {"_id": name, ...}
+func (mdb *MongoDB) UpsertDeadLetter(ctx context.Context, dl DeadLetter) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	_, err = session.DB(mdb.Database).C(deadLettersCollection).Upsert(bson.M{"_id": dl.Name}, dl)
+	return err
+}
+
+// FetchDeadLetter returns the dead letter stored for a name
+func (mdb *MongoDB) FetchDeadLetter(ctx context.Context, name string) (DeadLetter, error) {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	defer session.Close()
+	dl := DeadLetter{}
+	err = session.DB(mdb.Database).C(deadLettersCollection).Find(bson.M{"_id": name}).One(&dl)
+	if err == mgo.ErrNotFound {
+		return dl, ErrNotFound
+	}
+	return dl, err
+}
+
+// DeleteDeadLetter removes the dead letter for a name, if there is one
+func (mdb *MongoDB) DeleteDeadLetter(ctx context.Context, name string) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	err = session.DB(mdb.Database).C(deadLettersCollection).RemoveId(name)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// EachDeadLetter calls fn with every dead letter in name order, stopping at the first error
+func (mdb *MongoDB) EachDeadLetter(ctx context.Context, fn func(dl DeadLetter) error) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	iter := session.DB(mdb.Database).C(deadLettersCollection).Find(nil).Sort("_id").Iter()
+	dl := DeadLetter{}
+	for iter.Next(&dl) {
+		if err := fn(dl); err != nil {
+			iter.Close()
+			return err
+		}
+		dl = DeadLetter{}
+	}
+	return iter.Close()
+}
+
+// UpsertResolvedAt stores when a name's profile was last resolved as {"_id": name, "time": t}
+func (mdb *MongoDB) UpsertResolvedAt(ctx context.Context, name string, t time.Time) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	_, err = session.DB(mdb.Database).C(resolvedCollection).Upsert(bson.M{"_id": name}, bson.M{"_id": name, "time": t})
+	return err
+}
+
+// FetchResolvedAt returns when a name's profile was last resolved
+func (mdb *MongoDB) FetchResolvedAt(ctx context.Context, name string) (time.Time, error) {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer session.Close()
+	out := struct {
+		Time time.Time `bson:"time"`
+	}{}
+	err = session.DB(mdb.Database).C(resolvedCollection).Find(bson.M{"_id": name}).One(&out)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, ErrNotFound
+	}
+	return out.Time, err
+}
+
+// EachResolvedAt calls fn with every name that has been resolved and when, stopping at the first error
+func (mdb *MongoDB) EachResolvedAt(ctx context.Context, fn func(name string, t time.Time) error) error {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	iter := session.DB(mdb.Database).C(resolvedCollection).Find(nil).Iter()
+	out := struct {
+		Name string    `bson:"_id"`
+		Time time.Time `bson:"time"`
+	}{}
+	for iter.Next(&out) {
+		if err := fn(out.Name, out.Time); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
 // ZonefilesCount returns the count of all zonefiles
-func (mdb *MongoDB) ZonefilesCount() int {
-	session := mdb.Session.Clone()
+func (mdb *MongoDB) ZonefilesCount(ctx context.Context) int {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return 0
+	}
 	defer session.Close()
 	count, err := session.DB(mdb.Database).C(zonefilesCollection).Count()
 	if err != nil {
@@ -87,8 +386,11 @@ func (mdb *MongoDB) ZonefilesCount() int {
 }
 
 // ProfilesCount returns the count of all zonefiles
-func (mdb *MongoDB) ProfilesCount() int {
-	session := mdb.Session.Clone()
+func (mdb *MongoDB) ProfilesCount(ctx context.Context) int {
+	session, err := mdb.session(ctx)
+	if err != nil {
+		return 0
+	}
 	defer session.Close()
 	count, err := session.DB(mdb.Database).C(profilesCollection).Count()
 	if err != nil {
@@ -97,61 +399,30 @@ func (mdb *MongoDB) ProfilesCount() int {
 	return count
 }
 
-// NameProfileMongo models a name profile pairing
-type NameProfileMongo struct {
-	Name    string  `bson:"_id"`
-	Profile Profile `bson:"profile"`
-}
-
 // NameZonefileMongo represents a name zonefile pairing
 // Contains methods for pulling out different types of resource records
 type NameZonefileMongo struct {
-	Name     string `bson:"_id"`
-	Zonefile string `bson:"zonefile"`
+	Name         string `bson:"_id"`
+	ZonefileHash string `bson:"hash"`
+	Zonefile     string `bson:"zonefile"`
+}
+
+// Hash returns the hash of the zonefile
+func (nz *NameZonefileMongo) Hash() string {
+	return nz.ZonefileHash
 }
 
 // URI returns the URI records from a zonefile
 func (nz *NameZonefileMongo) URI() ([]*dns.URI, error) {
-	out := make([]*dns.URI, 0)
-	for x := range dns.ParseZone(strings.NewReader(nz.Zonefile), "", "") {
-		if x.Error != nil {
-			return out, x.Error
-		}
-		uri, ok := x.RR.(*dns.URI)
-		if ok {
-			out = append(out, uri)
-		}
-	}
-	return out, nil
+	return zonefileURI(nz.Zonefile)
 }
 
 // TXT returns the TXT records from a zonefile
 func (nz *NameZonefileMongo) TXT() ([]*dns.TXT, error) {
-	out := make([]*dns.TXT, 0)
-	for x := range dns.ParseZone(strings.NewReader(nz.Zonefile), "", "") {
-		if x.Error != nil {
-			return out, x.Error
-		}
-		txt, ok := x.RR.(*dns.TXT)
-		if ok {
-			out = append(out, txt)
-		}
-	}
-	return out, nil
+	return zonefileTXT(nz.Zonefile)
 }
 
+// URL returns the URLs from the URI records in a zonefile
 func (nz *NameZonefileMongo) URL() ([]*url.URL, error) {
-	out := make([]*url.URL, 0)
-	uri, err := nz.URI()
-	if err != nil {
-		return out, err
-	}
-	for _, u := range uri {
-		ur, err := url.Parse(u.Target)
-		if err != nil {
-			continue
-		}
-		out = append(out, ur)
-	}
-	return out, nil
+	return zonefileURL(nz.Zonefile)
 }
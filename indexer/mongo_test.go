@@ -0,0 +1,52 @@
+package indexer
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestMongoDB connects to the server in BSK_IDX_MONGO and empties its bsk_idx_test
+// database. Point it at a scratch server, e.g. mongodb://localhost:27017
+func newTestMongoDB(t *testing.T) *MongoDB {
+	conn := os.Getenv("BSK_IDX_MONGO")
+	if conn == "" {
+		t.Skip("BSK_IDX_MONGO not set, skipping mongo integration test")
+	}
+	mdb, err := NewMongoDB(&Config{DB: DBConfig{Driver: "mongo", Connection: conn, Database: "bsk_idx_test"}})
+	if err != nil {
+		t.Fatalf("connecting to mongo: %s", err)
+	}
+	if err := mdb.Session.DB(mdb.Database).DropDatabase(); err != nil {
+		t.Fatalf("dropping database: %s", err)
+	}
+	t.Cleanup(func() { mdb.Close() })
+	return mdb
+}
+
+func TestMongoZonefiles(t *testing.T) {
+	testDBZonefiles(t, newTestMongoDB(t))
+}
+
+func TestMongoProfiles(t *testing.T) {
+	testDBProfiles(t, newTestMongoDB(t))
+}
+
+func TestMongoNameRecords(t *testing.T) {
+	testDBNameRecords(t, newTestMongoDB(t))
+}
+
+func TestMongoState(t *testing.T) {
+	testDBState(t, newTestMongoDB(t))
+}
+
+func TestMongoDeadLetters(t *testing.T) {
+	testDBDeadLetters(t, newTestMongoDB(t))
+}
+
+func TestMongoResolvedAt(t *testing.T) {
+	testDBResolvedAt(t, newTestMongoDB(t))
+}
+
+func TestMongoPurgeName(t *testing.T) {
+	testDBPurgeName(t, newTestMongoDB(t))
+}
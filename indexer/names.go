@@ -1,113 +1,335 @@
 package indexer
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackzampolin/bsk-idx/internal/pipeline"
 )
 
-type networkNames struct {
-	n []string
+// nameSet is the set of names on the network. Inserts are O(1) and the sorted list the
+// snapshots are copied from is only rebuilt after the set changes
+type nameSet struct {
+	m map[string]struct{}
+	// sorted is the names in order, nil once the set has changed since it was built
+	sorted []string
 
 	sync.Mutex
 }
 
-func (nn *networkNames) current() []string {
-	var out []string
-	nn.Lock()
-	out = nn.n
-	nn.Unlock()
-	return out
+func newNameSet(names []string) *nameSet {
+	ns := &nameSet{m: make(map[string]struct{}, len(names))}
+	ns.add(names)
+	return ns
 }
 
-func (nn *networkNames) length() int {
-	var out int
-	nn.Lock()
-	out = len(nn.n)
-	nn.Unlock()
+// current returns a sorted copy of the names, they can be added to while the copy is in use
+func (ns *nameSet) current() []string {
+	ns.Lock()
+	defer ns.Unlock()
+	if ns.sorted == nil {
+		ns.sorted = make([]string, 0, len(ns.m))
+		for n := range ns.m {
+			ns.sorted = append(ns.sorted, n)
+		}
+		sort.Strings(ns.sorted)
+	}
+	out := make([]string, len(ns.sorted))
+	copy(out, ns.sorted)
 	return out
 }
 
-func (nn *networkNames) add(names []string) {
-	nn.Lock()
+// has reports whether name is in the set
+func (ns *nameSet) has(name string) bool {
+	ns.Lock()
+	defer ns.Unlock()
+	_, ok := ns.m[name]
+	return ok
+}
+
+func (ns *nameSet) length() int {
+	ns.Lock()
+	defer ns.Unlock()
+	return len(ns.m)
+}
+
+// add inserts names and returns the ones that weren't in the set already
+func (ns *nameSet) add(names []string) []string {
+	ns.Lock()
+	defer ns.Unlock()
+	added := make([]string, 0)
 	for _, n := range names {
-		nn.n = append(nn.n, n)
+		if _, ok := ns.m[n]; ok {
+			continue
+		}
+		ns.m[n] = struct{}{}
+		added = append(added, n)
 	}
-	sort.Strings(nn.n)
-	nn.n = uniq(nn.n)
-	nn.Unlock()
+	if len(added) > 0 {
+		ns.sorted = nil
+	}
+	return added
+}
+
+// remove takes names out of the set
+func (ns *nameSet) remove(names []string) {
+	ns.Lock()
+	defer ns.Unlock()
+	for _, n := range names {
+		if _, ok := ns.m[n]; ok {
+			delete(ns.m, n)
+			ns.sorted = nil
+		}
+	}
+}
+
+// NameDiff is what changed in the set of names between two syncs
+type NameDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// sync adds every name in next to the set and, when complete is set, removes the names next
+// doesn't have, other than subdomains of a domain it does. A sync that missed pages of names
+// is not complete and only adds
+func (ns *nameSet) sync(next []string, complete bool) NameDiff {
+	diff := NameDiff{Added: ns.add(next), Removed: make([]string, 0)}
+	if !complete {
+		return diff
+	}
+	keep := make(map[string]struct{}, len(next))
+	for _, n := range next {
+		keep[n] = struct{}{}
+	}
+	for _, n := range ns.current() {
+		if _, ok := keep[n]; ok {
+			continue
+		}
+		// Subdomains defined in a zonefile aren't listed by core, they go with their domain
+		if isSubdomain(n) {
+			if _, ok := keep[n[strings.Index(n, ".")+1:]]; ok {
+				continue
+			}
+		}
+		diff.Removed = append(diff.Removed, n)
+	}
+	ns.remove(diff.Removed)
+	return diff
 }
 
 // WriteNamesToFile writes the names on the Indexer into a file
 func (idx *Indexer) WriteNamesToFile(file string) {
-	idx.names.Lock()
-	n := idx.names.n
-	idx.names.Unlock()
-	out, err := json.Marshal(n)
-	if err != nil {
-		panic(err)
+	out, err := json.Marshal(idx.names.current())
+	if err == nil {
+		err = ioutil.WriteFile(file, out, 0644)
 	}
-	err = ioutil.WriteFile(file, out, 0644)
 	if err != nil {
-		panic(err)
+		idx.log(idxPrefix, fmt.Sprintf("failed to write names to %s: %s", file, err))
 	}
 }
 
-// GetAllNames fetches all the names from the blockstack network and stores them on the Indexer
-func (idx *Indexer) GetAllNames() {
-	if len(idx.names.n) < 10 {
-		// fetch Namespace info first then the names from the namespace
-		nsInfo, err := idx.GetNSInfo()
-		if err != nil {
-			panic(err)
-		}
-
-		// Create concurrency control
-		namesChan := make(chan []string, 0)
-		var wg sync.WaitGroup
-		sem := make(chan struct{}, idx.Conc)
-		go idx.handleNameChan(namesChan)
+// GetAllNames fetches all the names in the indexed namespaces, stores them on the Indexer
+// and returns the names that were added and removed since the last sync. Pages of names that
+// can't be fetched are dead lettered and no names are removed, it only fails if the namespaces
+// can't be listed or ctx is done. Pages already being fetched when ctx is done are still added
+func (idx *Indexer) GetAllNames(ctx context.Context) (NameDiff, error) {
+	namespaces, err := idx.GetNamespaces(ctx)
+	if err != nil {
+		idx.deadLetter(ctx, stageNamespaces, deadLetterNamespaces, err)
+		return NameDiff{}, err
+	}
 
-		// Range over the namespaces fetching the names in seperate goroutines
-		for _, ns := range nsInfo.Namespaces() {
-			for page := 0; page < nsInfo.Pages(ns); page++ {
-				sem <- struct{}{}
-				go idx.namePage(ns, page, namesChan, &wg, sem)
+	// Core doesn't say how many pages of names a namespace has. Each namespace's first page
+	// is fetched on its own and only a full one, which says there are more, fans the rest out
+	// to as many workers as the namespace gets, idx.Conc or its policy's. Each of them takes
+	// every one of them pages until it reaches the end. The names are collected as they come in
+	var missed atomic.Bool
+	fetched := make([]string, 0)
+	counts := make(map[string]int)
+	collect := func(names []string) {
+		fetched = append(fetched, names...)
+		if len(names) > 0 {
+			counts[namespaceOf(names[0])] += len(names)
+		}
+	}
+	first := make([]*nameWalk, 0, len(namespaces))
+	for _, ns := range namespaces {
+		first = append(first, &nameWalk{ns: ns, step: 1})
+	}
+	walks := make([]*nameWalk, 0)
+	p := idx.pipeline(ctx)
+	firstPages := namespaceStage(idx, p, first, func(w *nameWalk) string { return w.ns }, stageNamePage,
+		func(ctx context.Context, w *nameWalk, emit func([]string)) error {
+			names, err := idx.fetchNamePage(ctx, w.ns, w.page)
+			if err != nil {
+				missed.Store(true)
+				return err
 			}
+			emit(names)
+			return nil
+		})
+	pipeline.Sink(firstPages, func(names []string) {
+		collect(names)
+		if len(names) < namePageSize {
+			return
 		}
-
-		// Wait for all name pages to return before updating the database
-		wg.Wait()
-		close(namesChan)
+		ns := namespaceOf(names[0])
+		workers := idx.config.policy(ns).Concurrency
+		if workers < 1 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			walks = append(walks, &nameWalk{ns: ns, page: 1 + i, step: workers})
+		}
+	})
+	p.Wait()
+	if len(walks) > 0 {
+		p = idx.pipeline(ctx)
+		names := namespaceStage(idx, p, walks, func(w *nameWalk) string { return w.ns }, stageNamePage,
+			func(ctx context.Context, w *nameWalk, emit func([]string)) error {
+				err := idx.walkNamePages(ctx, w, emit)
+				if err != nil || w.missed {
+					missed.Store(true)
+				}
+				return err
+			})
+		pipeline.Sink(names, collect)
+		p.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		idx.names.add(fetched)
+		return NameDiff{}, err
+	}
+	if !missed.Load() {
+		for _, ns := range namespaces {
+			idx.ST.Set(StatNamespaces.Gauge(ns+"_count"), counts[ns])
+		}
+	}
+	sponsored, err := idx.GetAllSponsoredNames(ctx)
+	if err != nil {
+		missed.Store(true)
+	}
+	sponsored = idx.config.Namespaces.filter(sponsored)
+	for _, name := range sponsored {
+		idx.ST.Rec(namespaceCounter(namespaceOf(name), "names"), 1)
+	}
+	diff := idx.names.sync(append(fetched, sponsored...), !missed.Load())
+	idx.ST.Rec(statNameFetchAdded, len(diff.Added))
+	idx.ST.Rec(statNameFetchRemoved, len(diff.Removed))
+	for _, name := range diff.Removed {
+		// A name gone from the network is purged like a retired one, without a tombstone
+		// status. Its zero record stops its expiry being tracked
+		idx.expiries.set(NameRecord{Name: name})
+		idx.purge(ctx, NameRecord{Name: name})
+	}
+	if len(diff.Removed) > 0 {
+		idx.log(idxPrefix, fmt.Sprintf("%d names are no longer on the network", len(diff.Removed)))
 	}
+	return diff, nil
 }
 
-func (idx *Indexer) namePage(ns string, page int, namesChan chan []string, wg *sync.WaitGroup, sem chan struct{}) {
-	// Increment the WaitGroup
-	wg.Add(1)
+// GetAllSponsoredNames pages through the subdomains sponsored by on-chain names and returns
+// them. Their zonefiles come from the TXT records in their domain's zonefile
+func (idx *Indexer) GetAllSponsoredNames(ctx context.Context) ([]string, error) {
+	out := make([]string, 0)
+	for page := 0; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		names, err := idx.GetSponsoredNames(ctx, page)
+		if err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("failed to fetch sponsored names page %d: %s", page, err))
+			return out, err
+		}
+		if len(names) == 0 {
+			return out, nil
+		}
+		out = append(out, names...)
+		idx.ST.Rec(statNameFetchSponsored, len(names))
+	}
+}
 
-	// Fetch the page of names
-	names, err := idx.GetNamesInNamespace(ns, page*namePageSize, namePageSize)
-	if err != nil {
-		// NOTE: The above call is retried
-		panic(err)
+// indexNewNames fetches the zonefiles and profiles of names that just joined the index
+// rather than leaving them to the next full pass
+func (idx *Indexer) indexNewNames(ctx context.Context, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	idx.log(idxPrefix, fmt.Sprintf("indexing %d new names...", len(names)))
+	written := idx.GetZonefilesFor(ctx, names)
+	idx.ResolveNames(ctx, uniq(append(names, written...)))
+	for _, name := range names {
+		idx.sched.Add(name, time.Time{})
 	}
+}
+
+// maxFailedNamePages is how many pages in a row a walk skips before it stops and leaves
+// the rest of the namespace to a retry
+const maxFailedNamePages = 3
 
-	// Send the names to get processed
-	namesChan <- names.Names
+// nameWalk fetches every step'th page of names in a namespace starting at page
+type nameWalk struct {
+	ns   string
+	page int
+	step int
+	// missed is set once a page the walk skipped has been dead lettered
+	missed bool
+}
 
-	// Read from semaphore chan
-	<-sem
+// deadLetterNames returns the walk from the page it stopped at, so a retry resumes it
+func (w *nameWalk) deadLetterNames() []string {
+	return []string{nameWalkDeadLetter(w.ns, w.page, w.step)}
+}
 
-	// Decrement the waitgroup
-	wg.Done()
+// walkNamePages fetches the walk's pages and emits their names until core answers with a
+// page that isn't full. A page that can't be fetched is skipped and dead lettered once a
+// page after it comes back. After maxFailedNamePages in a row the walk stops at the first
+// of them and returns the error, leaving the walk itself to be dead lettered
+func (idx *Indexer) walkNamePages(ctx context.Context, w *nameWalk, emit func([]string)) error {
+	type failedPage struct {
+		page int
+		err  error
+	}
+	failed := make([]failedPage, 0)
+	for ; ctx.Err() == nil; w.page += w.step {
+		names, err := idx.fetchNamePage(ctx, w.ns, w.page)
+		if err != nil {
+			failed = append(failed, failedPage{w.page, err})
+			if len(failed) == maxFailedNamePages {
+				w.page = failed[0].page
+				return err
+			}
+			continue
+		}
+		for _, f := range failed {
+			idx.deadLetter(ctx, stageNamePage, namePageDeadLetter(w.ns, f.page), f.err)
+			w.missed = true
+		}
+		failed = failed[:0]
+		emit(names)
+		if len(names) < namePageSize {
+			return nil
+		}
+	}
+	return nil
 }
 
-func (idx *Indexer) handleNameChan(namesChan chan []string) {
-	for names := range namesChan {
-		idx.names.add(names)
+// fetchNamePage fetches a page of names in a namespace
+func (idx *Indexer) fetchNamePage(ctx context.Context, ns string, page int) ([]string, error) {
+	// NOTE: The call is retried
+	names, err := idx.GetNamesInNamespace(ctx, ns, page)
+	if err != nil {
+		return nil, err
 	}
+	idx.ST.Rec(namespaceCounter(ns, "names"), len(names))
+	return names, nil
 }
 
 // uniq takes a string array and returns the array with any duplicate values removed
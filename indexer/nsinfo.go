@@ -1,53 +1,95 @@
 package indexer
 
 import (
+	"context"
 	"fmt"
-)
+	"strings"
 
-// GetNSInfo returns information about all the namespaces
-func (idx *Indexer) GetNSInfo() (NSInfo, error) {
-	out := make(map[string]int, 0)
+	"github.com/jackzampolin/bsk-idx/internal/pipeline"
+)
 
-	// Fetch the list of namespaces
-	ns, err := idx.GetAllNamespaces()
+// GetNamespaces returns the namespaces on the network that pass the namespace filters
+func (idx *Indexer) GetNamespaces(ctx context.Context) ([]string, error) {
+	all, err := idx.GetAllNamespaces(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	// Fetch the number of names in each namespace
-	for _, namespace := range ns.Namespaces {
-		num, err := idx.GetNumNamesInNamespace(namespace)
-		if err != nil {
-			return nil, err
+	out := make([]string, 0, len(all))
+	for _, ns := range all {
+		if idx.config.Namespaces.indexed(ns) {
+			out = append(out, ns)
 		}
-		out[namespace] = num.Count
-		idx.ST.Rec(fmt.Sprintf("namespaces.%s_count", namespace), num.Count)
 	}
-	return NSInfo(out), nil
+	return out, nil
 }
 
-// NSInfo contains information about all the namespace in Blockstack
-type NSInfo map[string]int
-
-// Namespaces returns the list of namespaces
-func (ns NSInfo) Namespaces() []string {
-	out := []string{}
-	for k := range ns {
-		out = append(out, k)
+// namesBehind reports whether the names known so far, e.g. from the names file, are missing
+// or well behind the names on the network. Core only counts the names across every namespace,
+// so with namespaces filtered out only missing names count as behind
+func (idx *Indexer) namesBehind(ctx context.Context) bool {
+	if idx.names.length() == 0 {
+		return true
+	}
+	if !idx.config.Namespaces.everything() {
+		return false
 	}
-	return out
+	count, err := idx.GetNameCount(ctx)
+	return err == nil && idx.names.length() < count-50
+}
+
+// namespaceOf returns the namespace of a name, the last label of names and subdomains alike
+func namespaceOf(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// resolves reports whether a name's namespace is indexed and its profiles resolved
+func (idx *Indexer) resolves(name string) bool {
+	ns := namespaceOf(name)
+	return idx.config.Namespaces.indexed(ns) && *idx.config.policy(ns).ResolveProfiles
 }
 
-// Count returns the total count of all names in all namespaces
-func (ns NSInfo) Count() int {
-	out := 0
-	for _, v := range ns {
-		out += v
+// namespaceCounter returns the counter of names, zonefiles or profiles indexed in a namespace
+func namespaceCounter(ns, what string) CounterKey {
+	return StatNamespaceIndex.Labeled(ns, what)
+}
+
+// logNamespacePolicies logs the namespace filters and any patterns in them that can't match
+func (idx *Indexer) logNamespacePolicies() {
+	nc := idx.config.Namespaces
+	if len(nc.Include) > 0 || len(nc.Exclude) > 0 {
+		idx.log(idxPrefix, fmt.Sprintf("indexing namespaces matching %v, excluding %v", nc.Include, nc.Exclude))
+	}
+	for _, pattern := range nc.badNamespacePatterns() {
+		idx.log(idxPrefix, fmt.Sprintf("namespace pattern %q is malformed and matches nothing", pattern))
 	}
-	return out
 }
 
-// Pages returns the number of pages of names in a namespace
-func (ns NSInfo) Pages(namespace string) int {
-	return ns[namespace]/namePageSize + 2
+// namespaceStage runs fn over items like pipeline.Stage. Items in a namespace whose policy
+// sets a concurrency go through a stage with that many workers of their own, the rest share
+// a stage with idx.Conc workers. The outputs of the stages are merged
+func namespaceStage[In, Out any](idx *Indexer, p *pipeline.Pipeline, items []In, namespace func(In) string, name string,
+	fn func(ctx context.Context, item In, emit func(Out)) error) *pipeline.Stream[Out] {
+	shared := make([]In, 0, len(items))
+	own := make(map[string][]In)
+	order := make([]string, 0)
+	for _, item := range items {
+		ns := namespace(item)
+		if idx.config.Namespaces.Policies[ns].Concurrency <= 0 {
+			shared = append(shared, item)
+			continue
+		}
+		if _, ok := own[ns]; !ok {
+			order = append(order, ns)
+		}
+		own[ns] = append(own[ns], item)
+	}
+
+	streams := []*pipeline.Stream[Out]{
+		pipeline.Stage(pipeline.From(p, shared), name, pipeline.Options{Workers: idx.Conc, Buffer: idx.Conc}, fn),
+	}
+	for _, ns := range order {
+		workers := idx.config.policy(ns).Concurrency
+		streams = append(streams, pipeline.Stage(pipeline.From(p, own[ns]), name, pipeline.Options{Workers: workers, Buffer: workers}, fn))
+	}
+	return pipeline.Merge(p, streams...)
 }
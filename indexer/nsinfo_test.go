@@ -0,0 +1,108 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNamespaceFilters(t *testing.T) {
+	for _, tc := range []struct {
+		nc   NamespacesConfig
+		ns   string
+		want bool
+	}{
+		{NamespacesConfig{}, "id", true},
+		{NamespacesConfig{Include: []string{".id", "app*"}}, "id", true},
+		{NamespacesConfig{Include: []string{".id", "app*"}}, "apps", true},
+		{NamespacesConfig{Include: []string{".id", "app*"}}, "btc", false},
+		{NamespacesConfig{Exclude: []string{"test*"}}, "test2", false},
+		{NamespacesConfig{Include: []string{"app*"}, Exclude: []string{"apps"}}, "apps", false},
+		{NamespacesConfig{Exclude: []string{"[id"}}, "id", true},
+	} {
+		if got := tc.nc.indexed(tc.ns); got != tc.want {
+			t.Errorf("expected %s indexed %t with %+v", tc.ns, tc.want, tc.nc)
+		}
+	}
+
+	no := false
+	cfg := IDXConfig{
+		Concurrency: 4,
+		Namespaces: NamespacesConfig{Policies: map[string]NamespacePolicy{
+			"app": {Concurrency: 1, MinRefreshInterval: 10 * 24 * time.Hour, ResolveProfiles: &no},
+		}},
+	}.withDefaults()
+	if p := cfg.policy("app"); p.Concurrency != 1 || p.MaxRefreshInterval != p.MinRefreshInterval || *p.ResolveProfiles {
+		t.Fatalf("unexpected app policy %+v", p)
+	}
+	if p := cfg.policy("id"); p.Concurrency != 4 || p.MinRefreshInterval != time.Hour || !*p.ResolveProfiles {
+		t.Fatalf("expected the defaults for id, got %+v", p)
+	}
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	fc.addName("carol.test", "Carol Tester")
+	no := false
+	db := NewMemDB()
+	idx := newTestIndexerNamespaces(t, fc, db, []string{"dave.test"}, NamespacesConfig{
+		Exclude: []string{"test*"},
+		Policies: map[string]NamespacePolicy{
+			"id":  {Concurrency: 2, MinRefreshInterval: 2 * time.Hour},
+			"app": {ResolveProfiles: &no},
+		},
+	})
+	idx.Index(ctx)
+
+	// Excluded namespaces are never listed, looked up or resolved
+	if n := idx.names.length(); n != 152 {
+		t.Fatalf("expected the id and app names, got %d", n)
+	}
+	if _, err := db.FetchNameRecord(ctx, "carol.test"); err != ErrNotFound {
+		t.Fatalf("expected no record for an excluded name, got err %v", err)
+	}
+
+	// Profiles of app names aren't resolved or scheduled but their zonefiles are indexed
+	if c := db.ZonefilesCount(ctx); c != 152 {
+		t.Fatalf("expected 152 zonefiles, got %d", c)
+	}
+	if _, err := db.FetchProfile(ctx, "alice.app"); err != ErrNotFound {
+		t.Fatalf("expected no profile for alice.app, got err %v", err)
+	}
+	if c := db.ProfilesCount(ctx); c != 150 {
+		t.Fatalf("expected the 150 id profiles, got %d", c)
+	}
+	idx.sched.Lock()
+	_, scheduled := idx.sched.items["alice.app"]
+	interval := idx.sched.items["user000.id"].interval
+	idx.sched.Unlock()
+	if scheduled || interval != 2*time.Hour {
+		t.Fatalf("expected app names unscheduled and id names at 2h, got %t and %s", scheduled, interval)
+	}
+
+	for _, tc := range []struct {
+		ns, what string
+		want     int
+	}{
+		{"id", "names", 150}, {"id", "zonefiles", 150}, {"id", "profiles", 150},
+		{"app", "names", 2}, {"app", "zonefiles", 2}, {"app", "profiles", 0},
+		{"test", "names", 0},
+	} {
+		if c := idx.ST.Count(namespaceCounter(tc.ns, tc.what)); c != tc.want {
+			t.Errorf("expected %d %s %s, got %d", tc.want, tc.ns, tc.what, c)
+		}
+	}
+	if c := idx.ST.Count(statProfilesNotResolved); c != 2 {
+		t.Fatalf("expected the app names counted as not resolved, got %d", c)
+	}
+
+	// Nor are excluded names picked up from new blocks
+	fc.mine("carol.test", "alice.app")
+	if err := idx.IndexNewBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FetchNameRecord(ctx, "carol.test"); err != ErrNotFound {
+		t.Fatalf("expected an excluded name in a block skipped, got err %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"context"
+
+	"github.com/jackzampolin/bsk-idx/internal/pipeline"
+)
+
+// The pipeline stages that never dead letter, the rest are named after their dead letter stage
+const (
+	stageZonefileBatch = "zonefileBatch"
+	stageResolve       = "resolve"
+)
+
+// deadLetterer is a pipeline item that stands for one or more dead letters
+type deadLetterer interface {
+	deadLetterNames() []string
+}
+
+// pipelineMetrics records each stage's throughput and queue depth in the StatPipeline
+// counters {stage}_processed and {stage}_failed and the StatQueues gauges
+type pipelineMetrics struct {
+	st *Stats
+}
+
+func (m pipelineMetrics) Processed(stage string) {
+	m.st.Rec(StatPipeline.Labeled(stage, "processed"), 1)
+}
+
+func (m pipelineMetrics) Failed(stage string) {
+	m.st.Rec(StatPipeline.Labeled(stage, "failed"), 1)
+}
+
+func (m pipelineMetrics) Queued(stage string, depth int) {
+	m.st.Set(StatQueues.Gauge(stage), depth)
+}
+
+// pipeline returns a pipeline for one pass that dead letters the items its stages fail on
+func (idx *Indexer) pipeline(ctx context.Context) *pipeline.Pipeline {
+	return pipeline.New(ctx, pipeline.Config{
+		Metrics: pipelineMetrics{idx.ST},
+		OnError: idx.routeError,
+	})
+}
+
+// routeError dead letters the name or names a failed item stands for at its stage
+func (idx *Indexer) routeError(ctx context.Context, err *pipeline.Error) {
+	switch item := err.Item.(type) {
+	case string:
+		idx.deadLetter(ctx, err.Stage, item, err.Err)
+	case deadLetterer:
+		for _, name := range item.deadLetterNames() {
+			idx.deadLetter(ctx, err.Stage, name, err.Err)
+		}
+	default:
+		idx.log(idxPrefix, err.Error())
+	}
+}
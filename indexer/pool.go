@@ -0,0 +1,251 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewCorePool returns a CorePool over every configured core node and starts health checking them
+func NewCorePool(cfg BSKConfig, st *Stats) *CorePool {
+	cfg = cfg.withDefaults()
+	names := make([]string, 0)
+	cores := make([]Core, 0)
+	for _, s := range cfg.servers() {
+		names = append(names, fmt.Sprintf("%s:%d", s.Address, s.Port))
+		cores = append(cores, NewCoreClient(s))
+	}
+	pool := newCorePool(names, cores, cfg.EjectTimeout, st)
+	pool.Quorum = cfg.Quorum
+	go pool.healthLoop(cfg.HealthCheckInterval)
+	return pool
+}
+
+func newCorePool(names []string, cores []Core, ejectTimeout time.Duration, st *Stats) *CorePool {
+	pool := &CorePool{ejectTimeout: ejectTimeout, ST: st, stop: make(chan struct{})}
+	for i := range cores {
+		pool.hosts = append(pool.hosts, &poolHost{name: names[i], core: cores[i]})
+	}
+	return pool
+}
+
+// CorePool spreads Core calls round robin across a set of core nodes. A node
+// that fails a call or a health check is ejected from the rotation until
+// ejectTimeout passes or it passes a health check
+type CorePool struct {
+	ST *Stats
+
+	// Quorum is the number of hosts asked for each name record, see getRecordQuorum
+	Quorum int
+
+	hosts        []*poolHost
+	next         uint64
+	ejectTimeout time.Duration
+
+	// most recent quorum disagreements, oldest first
+	disagreements []Disagreement
+
+	// stop is closed by Close to end the health checks
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	sync.Mutex
+}
+
+// Close stops health checking the hosts. Calls already made aren't affected
+func (p *CorePool) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
+
+type poolHost struct {
+	name         string
+	core         Core
+	ejectedUntil time.Time
+
+	sync.Mutex
+}
+
+// until returns when the host is due back in the rotation
+func (h *poolHost) until() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.ejectedUntil
+}
+
+// pick returns the next host in the rotation that isn't ejected. If every
+// host is ejected the one due back soonest is used rather than failing
+func (p *CorePool) pick() *poolHost {
+	return p.pickN(1)[0]
+}
+
+// pickN returns n distinct hosts, or every host if there are fewer. Hosts in
+// the rotation come first in round robin order, then ejected hosts by how
+// soon they are due back
+func (p *CorePool) pickN(n int) []*poolHost {
+	now := time.Now()
+	start := atomic.AddUint64(&p.next, 1)
+	healthy := make([]*poolHost, 0, len(p.hosts))
+	ejected := make([]*poolHost, 0)
+	for i := range p.hosts {
+		h := p.hosts[(start+uint64(i))%uint64(len(p.hosts))]
+		if now.Before(h.until()) {
+			ejected = append(ejected, h)
+		} else {
+			healthy = append(healthy, h)
+		}
+	}
+	sort.Slice(ejected, func(i, j int) bool {
+		return ejected[i].until().Before(ejected[j].until())
+	})
+	out := append(healthy, ejected...)
+	if n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+// do runs fn against the next host and records the outcome
+func (p *CorePool) do(fn func(c Core) error) error {
+	return p.call(p.pick(), fn)
+}
+
+// call runs fn against a host and records the outcome, ejecting the host if it failed
+func (p *CorePool) call(h *poolHost, fn func(c Core) error) error {
+	err := fn(h.core)
+	if err == nil {
+		p.ST.Rec(StatHosts.Labeled(h.name, "success"), 1)
+		return nil
+	}
+	p.ST.Rec(StatHosts.Labeled(h.name, "error"), 1)
+	if hostFailure(err) {
+		p.eject(h, err)
+	}
+	return err
+}
+
+func (p *CorePool) eject(h *poolHost, err error) {
+	h.Lock()
+	h.ejectedUntil = time.Now().Add(p.ejectTimeout)
+	h.Unlock()
+	log.Printf("[pool] ejecting %s for %s: %s\n", h.name, p.ejectTimeout, err)
+	p.ST.Rec(StatHosts.Labeled(h.name, "ejected"), 1)
+}
+
+// hostFailure reports whether an error is the node's fault rather than the request's. Only
+// 5xx answers and errors reaching the node or reading its answer count, a node answering
+// that a name doesn't exist is healthy
+func hostFailure(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code >= 500
+	}
+	return true
+}
+
+// healthLoop checks every host on each tick until the pool is closed. A check still
+// waiting on a host when the pool is closed, or when the next tick is due, is abandoned
+func (p *CorePool) healthLoop(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stop
+		cancel()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, checkCancel := context.WithTimeout(ctx, interval)
+			p.checkHealth(checkCtx)
+			checkCancel()
+		}
+	}
+}
+
+// checkHealth ejects the hosts that can't report their block height and
+// returns ejected hosts that can to the rotation
+func (p *CorePool) checkHealth(ctx context.Context) {
+	for _, h := range p.hosts {
+		_, err := h.core.GetBlockHeight(ctx)
+		if err != nil {
+			p.eject(h, err)
+			continue
+		}
+		h.Lock()
+		wasEjected := !h.ejectedUntil.IsZero()
+		h.ejectedUntil = time.Time{}
+		h.Unlock()
+		if wasEjected {
+			log.Printf("[pool] %s passed its health check, returning it to rotation\n", h.name)
+			p.ST.Rec(StatHosts.Labeled(h.name, "restored"), 1)
+		}
+	}
+}
+
+func (p *CorePool) GetAllNamespaces(ctx context.Context) (out []string, err error) {
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetAllNamespaces(ctx)
+		return
+	})
+	return
+}
+
+func (p *CorePool) GetNamesInNamespace(ctx context.Context, ns string, page int) (out []string, err error) {
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetNamesInNamespace(ctx, ns, page)
+		return
+	})
+	return
+}
+
+func (p *CorePool) GetNameCount(ctx context.Context) (out int, err error) {
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetNameCount(ctx)
+		return
+	})
+	return
+}
+
+func (p *CorePool) GetNameBlockchainRecord(ctx context.Context, name string) (out BlockchainRecord, err error) {
+	if p.Quorum > 1 && len(p.hosts) > 1 {
+		return p.getRecordQuorum(ctx, name)
+	}
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetNameBlockchainRecord(ctx, name)
+		return
+	})
+	return
+}
+
+func (p *CorePool) GetSponsoredNames(ctx context.Context, page int) (out []string, err error) {
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetSponsoredNames(ctx, page)
+		return
+	})
+	return
+}
+
+func (p *CorePool) GetBlockHeight(ctx context.Context) (out int, err error) {
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetBlockHeight(ctx)
+		return
+	})
+	return
+}
+
+func (p *CorePool) GetNamesAtBlock(ctx context.Context, height int) (out []string, err error) {
+	err = p.do(func(c Core) (err error) {
+		out, err = c.GetNamesAtBlock(ctx, height)
+		return
+	})
+	return
+}
@@ -0,0 +1,220 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockstack/blockstack.go/blockstack"
+)
+
+// downCore wraps a Core and fails namespace and block height calls while down is set
+type downCore struct {
+	Core
+
+	down bool
+	sync.Mutex
+}
+
+func (d *downCore) setDown(down bool) {
+	d.Lock()
+	d.down = down
+	d.Unlock()
+}
+
+func (d *downCore) err() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (d *downCore) GetAllNamespaces(ctx context.Context) ([]string, error) {
+	if err := d.err(); err != nil {
+		return []string{}, err
+	}
+	return d.Core.GetAllNamespaces(ctx)
+}
+
+func (d *downCore) GetBlockHeight(ctx context.Context) (int, error) {
+	if err := d.err(); err != nil {
+		return 0, err
+	}
+	return d.Core.GetBlockHeight(ctx)
+}
+
+func TestCorePool(t *testing.T) {
+	ctx := context.Background()
+	a, b := newTestNetwork(t), newTestNetwork(t)
+	da := &downCore{Core: a}
+	st := NewStats(0)
+	pool := newCorePool([]string{"a", "b"}, []Core{da, b}, time.Hour, st)
+
+	// Calls are spread across both hosts
+	for i := 0; i < 10; i++ {
+		if _, err := pool.GetAllNamespaces(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ca, cb := a.callCount("/v1/namespaces"), b.callCount("/v1/namespaces"); ca != 5 || cb != 5 {
+		t.Fatalf("expected 5 calls to each host, got %d and %d", ca, cb)
+	}
+
+	// A failing host is ejected after its first error and skipped after that
+	da.setDown(true)
+	failures := 0
+	for i := 0; i < 10; i++ {
+		if _, err := pool.GetAllNamespaces(ctx); err != nil {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Fatalf("expected 1 failed call, got %d", failures)
+	}
+	if cb := b.callCount("/v1/namespaces"); cb != 14 {
+		t.Fatalf("expected the other host to take the remaining calls, got %d", cb-5)
+	}
+
+	// A missing name is the request's fault, not the host's
+	if _, err := pool.GetNameBlockchainRecord(ctx, "missing.app"); err == nil {
+		t.Fatal("expected an error for a missing name")
+	}
+	if pool.hosts[1].until().After(time.Now()) {
+		t.Fatal("expected a not found response not to eject the host")
+	}
+
+	// Passing a health check returns the host to the rotation
+	da.setDown(false)
+	pool.checkHealth(ctx)
+	for i := 0; i < 10; i++ {
+		if _, err := pool.GetAllNamespaces(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ca := a.callCount("/v1/namespaces"); ca != 10 {
+		t.Fatalf("expected 5 more calls to the restored host, got %d", ca-5)
+	}
+
+	for k, want := range map[[2]string]int{{"a", "ejected"}: 1, {"a", "restored"}: 1, {"a", "error"}: 1, {"b", "error"}: 1, {"a", "success"}: 10} {
+		if c := st.Count(StatHosts.Labeled(k[0], k[1])); c != want {
+			t.Fatalf("expected hosts.%s_%s to be %d, got %d", k[0], k[1], want, c)
+		}
+	}
+}
+
+func TestCorePoolQuorum(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := newTestNetwork(t), newTestNetwork(t), newTestNetwork(t)
+	// Zonefiles point at each fake node so copy a's record to make them agree
+	b.records["alice.app"] = a.records["alice.app"]
+	c.records["alice.app"] = a.records["alice.app"]
+	pool := newCorePool([]string{"a", "b", "c"}, []Core{a, b, c}, time.Hour, NewStats(0))
+	pool.Quorum = 3
+
+	res, err := pool.GetNameBlockchainRecord(ctx, "alice.app")
+	if err != nil || res.ZonefileHash != a.records["alice.app"].ValueHash {
+		t.Fatalf("unexpected record %+v, err %v", res, err)
+	}
+	if d := pool.Disagreements(); len(d) != 0 {
+		t.Fatalf("expected no disagreements, got %+v", d)
+	}
+
+	// One lagging node is outvoted
+	c.setOwner("alice.app", testAddress(testKey(7)))
+	res, err = pool.GetNameBlockchainRecord(ctx, "alice.app")
+	if err != nil || res.Address != testAddress(a.key) {
+		t.Fatalf("expected the majority record, got %+v, err %v", res, err)
+	}
+
+	// With every node saying something different nothing is accepted
+	b.setOwner("alice.app", testAddress(testKey(8)))
+	if _, err := pool.GetNameBlockchainRecord(ctx, "alice.app"); err != errNoQuorum {
+		t.Fatalf("expected errNoQuorum, got %v", err)
+	}
+
+	// A name every node says is missing keeps the error the hosts gave
+	_, err = pool.GetNameBlockchainRecord(ctx, "missing.id")
+	se := &statusError{}
+	if !errors.As(err, &se) || se.Code != http.StatusNotFound || retryableError(err) || hostFailure(err) {
+		t.Fatalf("expected the hosts' 404, got %v", err)
+	}
+
+	d := pool.Disagreements()
+	if len(d) != 2 || d[0].Accepted || !d[1].Accepted || d[1].Answers["c"].Address != testAddress(testKey(7)) {
+		t.Fatalf("unexpected disagreements %+v", d)
+	}
+
+	idx := newTestIndexer(t, a, NewMemDB(), nil)
+	idx.BSK = pool
+	out := map[string][]Disagreement{}
+	if code := apiGet(t, NewAPI(idx, 0), "/v1/disagreements", &out); code != http.StatusOK || len(out["disagreements"]) != 2 {
+		t.Fatalf("unexpected /v1/disagreements response %d %+v", code, out)
+	}
+}
+
+func TestCorePoolClassifiesThroughClient(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "core is down", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	bu, _ := url.Parse(broken.URL)
+	port, _ := strconv.Atoi(bu.Port())
+	bad := blockstack.ServerConfig{Scheme: "http", Address: bu.Hostname(), Port: port}
+
+	st := NewStats(0)
+	pool := NewCorePool(BSKConfig{Hosts: []blockstack.ServerConfig{fc.serverConfig()}, HealthCheckInterval: time.Hour}, st)
+	defer pool.Close()
+	good := pool.hosts[0].name
+
+	// A node answering that a name doesn't exist is healthy
+	for i := 0; i < 3; i++ {
+		if _, err := pool.GetNameBlockchainRecord(ctx, "missing.id"); err == nil {
+			t.Fatal("expected a missing name to fail")
+		}
+	}
+	if c := st.Count(StatHosts.Labeled(good, "ejected")); c != 0 {
+		t.Fatalf("expected 404s not to eject the host, got %d ejections", c)
+	}
+
+	// A node answering with a 5xx isn't
+	pool = NewCorePool(BSKConfig{Hosts: []blockstack.ServerConfig{bad}, HealthCheckInterval: time.Hour}, st)
+	defer pool.Close()
+	if _, err := pool.GetNameBlockchainRecord(ctx, "alice.app"); err == nil {
+		t.Fatal("expected the broken host to fail")
+	}
+	if c := st.Count(StatHosts.Labeled(pool.hosts[0].name, "ejected")); c != 1 {
+		t.Fatalf("expected a 500 to eject the host, got %d ejections", c)
+	}
+}
+
+func TestCorePoolClose(t *testing.T) {
+	fc := newTestNetwork(t)
+	pool := NewCorePool(BSKConfig{Hosts: []blockstack.ServerConfig{fc.serverConfig()}, HealthCheckInterval: time.Millisecond}, NewStats(0))
+	for fc.callCount("/v1/info") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Shutting the indexer down stops the health checks
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+	idx.BSK = pool
+	if err := idx.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	checks := fc.callCount("/v1/info")
+	time.Sleep(20 * time.Millisecond)
+	if c := fc.callCount("/v1/info"); c != checks {
+		t.Fatalf("expected no health checks after shutdown, got %d", c-checks)
+	}
+	pool.Close()
+}
@@ -0,0 +1,52 @@
+package indexer
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestPostgresDB connects to the database in BSK_IDX_POSTGRES and empties it.
+// Point it at a scratch database, e.g. postgres://postgres@localhost/bsk_idx_test?sslmode=disable
+func newTestPostgresDB(t *testing.T) *PostgresDB {
+	conn := os.Getenv("BSK_IDX_POSTGRES")
+	if conn == "" {
+		t.Skip("BSK_IDX_POSTGRES not set, skipping postgres integration test")
+	}
+	pdb, err := NewPostgresDB(&Config{DB: DBConfig{Driver: "postgres", Connection: conn}})
+	if err != nil {
+		t.Fatalf("connecting to postgres: %s", err)
+	}
+	if _, err := pdb.DB.Exec(`TRUNCATE zonefiles, profiles, names, state, dead_letters, resolved`); err != nil {
+		t.Fatalf("truncating tables: %s", err)
+	}
+	t.Cleanup(func() { pdb.Close() })
+	return pdb
+}
+
+func TestPostgresZonefiles(t *testing.T) {
+	testDBZonefiles(t, newTestPostgresDB(t))
+}
+
+func TestPostgresProfiles(t *testing.T) {
+	testDBProfiles(t, newTestPostgresDB(t))
+}
+
+func TestPostgresNameRecords(t *testing.T) {
+	testDBNameRecords(t, newTestPostgresDB(t))
+}
+
+func TestPostgresState(t *testing.T) {
+	testDBState(t, newTestPostgresDB(t))
+}
+
+func TestPostgresDeadLetters(t *testing.T) {
+	testDBDeadLetters(t, newTestPostgresDB(t))
+}
+
+func TestPostgresResolvedAt(t *testing.T) {
+	testDBResolvedAt(t, newTestPostgresDB(t))
+}
+
+func TestPostgresPurgeName(t *testing.T) {
+	testDBPurgeName(t, newTestPostgresDB(t))
+}
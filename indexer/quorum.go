@@ -0,0 +1,126 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxDisagreements is the number of recent disagreements kept for the API
+const maxDisagreements = 100
+
+// errNoQuorum is returned when the hosts asked for a name record don't agree on it
+var errNoQuorum = errors.New("no majority of hosts agree on the name record")
+
+// Disagreement records the hosts asked for a name record not all giving the same answer
+type Disagreement struct {
+	Name     string                  `json:"name"`
+	Time     time.Time               `json:"time"`
+	Accepted bool                    `json:"accepted"`
+	Answers  map[string]QuorumAnswer `json:"answers"`
+}
+
+// QuorumAnswer is the part of a host's answer for a name record that has to agree. The
+// zonefile itself is checked against the agreed hash when it is written
+type QuorumAnswer struct {
+	Address      string `json:"address,omitempty"`
+	ZonefileHash string `json:"zonefile_hash,omitempty"`
+	ExpireBlock  int    `json:"expire_block,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// String describes the answer for logs
+func (a QuorumAnswer) String() string {
+	if a.Error != "" {
+		return fmt.Sprintf("error: %s", a.Error)
+	}
+	return fmt.Sprintf("address %s, zonefile hash %s, expire block %d, status %s", a.Address, a.ZonefileHash, a.ExpireBlock, a.Status)
+}
+
+func quorumAnswer(res BlockchainRecord, err error) QuorumAnswer {
+	if err != nil {
+		return QuorumAnswer{Error: err.Error()}
+	}
+	return QuorumAnswer{
+		Address:      res.Address,
+		ZonefileHash: res.ZonefileHash,
+		ExpireBlock:  res.ExpireBlock,
+		Status:       res.Status,
+	}
+}
+
+// getRecordQuorum asks Quorum hosts for a name record and returns the record a majority
+// of them agree on. A lagging or malicious host can't change the result on its own
+func (p *CorePool) getRecordQuorum(ctx context.Context, name string) (BlockchainRecord, error) {
+	hosts := p.pickN(p.Quorum)
+	results := make([]BlockchainRecord, len(hosts))
+	errs := make([]error, len(hosts))
+	answers := make([]QuorumAnswer, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h *poolHost) {
+			defer wg.Done()
+			errs[i] = p.call(h, func(c Core) (err error) {
+				results[i], err = c.GetNameBlockchainRecord(ctx, name)
+				return
+			})
+			answers[i] = quorumAnswer(results[i], errs[i])
+		}(i, h)
+	}
+	wg.Wait()
+
+	// Errors count as votes too, a majority of hosts saying the name is missing is an answer
+	votes := make(map[QuorumAnswer]int)
+	best := 0
+	for i, a := range answers {
+		votes[a]++
+		if votes[a] > votes[answers[best]] {
+			best = i
+		}
+	}
+	agreed := votes[answers[best]]*2 > len(hosts)
+	if votes[answers[best]] != len(hosts) {
+		p.disagree(name, hosts, answers, agreed)
+	}
+	if !agreed {
+		return BlockchainRecord{}, errNoQuorum
+	}
+	// An agreed error is returned as the host gave it so it is still classified by its status
+	return results[best], errs[best]
+}
+
+// disagree logs and keeps a record of hosts giving different answers
+func (p *CorePool) disagree(name string, hosts []*poolHost, answers []QuorumAnswer, accepted bool) {
+	d := Disagreement{Name: name, Time: time.Now(), Accepted: accepted, Answers: make(map[string]QuorumAnswer)}
+	for i, h := range hosts {
+		d.Answers[h.name] = answers[i]
+	}
+	log.Printf("[pool] hosts disagree on the record for %s (accepted: %t): %+v\n", name, accepted, d.Answers)
+	p.ST.Rec(statNameDetailsDisagreements, 1)
+	if !accepted {
+		p.ST.Rec(statNameDetailsNoQuorum, 1)
+	}
+
+	p.Lock()
+	p.disagreements = append(p.disagreements, d)
+	if len(p.disagreements) > maxDisagreements {
+		p.disagreements = p.disagreements[len(p.disagreements)-maxDisagreements:]
+	}
+	p.Unlock()
+}
+
+// Disagreements returns the most recent quorum disagreements, newest first
+func (p *CorePool) Disagreements() []Disagreement {
+	p.Lock()
+	defer p.Unlock()
+	out := make([]Disagreement, 0, len(p.disagreements))
+	for i := len(p.disagreements) - 1; i >= 0; i-- {
+		out = append(out, p.disagreements[i])
+	}
+	return out
+}
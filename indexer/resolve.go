@@ -1,76 +1,166 @@
 package indexer
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"sync"
+	"strings"
 	"time"
 )
 
-// ResolveIndexerNames loops through the `names` array on the indexer struct and pulls all the profiles for those names.s
-func (idx *Indexer) ResolveIndexerNames() {
-	// Limit concurrency to idx.Conc and wait for all names to resolve before exiting
-	sem := make(chan struct{}, idx.Conc)
-	var wg sync.WaitGroup
-
-	// Loop over names and insert them
-	for _, n := range idx.names.current() {
-		if n != "" {
-			sem <- struct{}{}
-			wg.Add(1)
-			go resolveAndInsert(idx, n, &wg, sem)
-		}
+// ResolveNames pulls and stores the profiles for the passed names. It stops starting
+// new names once ctx is done and waits for the ones in flight
+func (idx *Indexer) ResolveNames(ctx context.Context, names []string) {
+	idx.resolveNames(ctx, names, nil)
+}
+
+// resolveNames resolves idx.Conc names at a time, or as many as a namespace's policy says,
+// and calls done, when set, with the index of each name that finished resolving before ctx
+// was done. Names in namespaces whose profiles aren't resolved are done straight away
+func (idx *Indexer) resolveNames(ctx context.Context, names []string, done func(ctx context.Context, i int)) {
+	items := make([]int, len(names))
+	for i := range names {
+		items[i] = i
 	}
+	p := idx.pipeline(ctx)
+	namespaceStage(idx, p, items, func(i int) string { return namespaceOf(names[i]) }, stageResolve,
+		func(ctx context.Context, i int, _ func(struct{})) error {
+			switch {
+			case names[i] == "":
+			case !idx.resolves(names[i]):
+				idx.ST.Rec(statProfilesNotResolved, 1)
+			default:
+				resolveAndInsert(ctx, idx, names[i])
+			}
+			if done != nil && ctx.Err() == nil {
+				done(ctx, i)
+			}
+			return nil
+		})
 
 	// Wait for all names to be resolved
-	wg.Wait()
+	p.Wait()
 }
 
-// resolveAndInsert fetches the profile from storage and then inserts that profile into configured DB driver
-func resolveAndInsert(idx *Indexer, name string, wg *sync.WaitGroup, sem chan struct{}) {
-	profile := idx.GetProfile(name)
+// resolveAndInsert fetches the profile from storage, verifies its signature and then
+// inserts that profile into configured DB driver along with whether the name owner signed it
+func resolveAndInsert(ctx context.Context, idx *Indexer, name string) {
+	profile, fetchErr := idx.GetProfile(ctx, name)
+	// A fetch that failed for now says nothing about the profile already stored
+	transient := profile == nil && fetchErr != nil && retryableError(fetchErr)
+	if profile != nil {
+		if err := profile.Validate(); err != nil {
+			idx.ST.Rec(StatProfiles.Counter("unverified_"+verifyReason(err)), 1)
+			profile = nil
+		} else {
+			idx.ST.Rec(statProfilesVerified, 1)
+		}
+	}
 	if profile != nil && profile.DecodedToken.Payload.Claim.Type == "Person" {
-		err := idx.DB.UpsertProfile(name, profile.DecodedToken.Payload.Claim)
+		rec := ProfileRecord{
+			Name:         name,
+			Profile:      profile.DecodedToken.Payload.Claim,
+			Verification: idx.ownerVerification(ctx, name, profile),
+		}
+		err := idx.DB.UpsertProfile(ctx, rec)
 		if err != nil {
-			idx.ST.Rec("profiles.insert_error", 1)
+			idx.ST.Rec(statProfilesInsertError, 1)
+		} else {
+			// Only profiles signed by the owner are searchable
+			if rec.Verified() {
+				idx.Search.Add(name, rec.Profile)
+			} else {
+				idx.Search.Remove(name)
+			}
+			idx.ST.Rec(statProfilesInserted, 1)
+			idx.clearDeadLetter(ctx, name)
+		}
+	} else if !transient && ctx.Err() == nil {
+		// The profile is gone, no longer verifies or isn't a person's, so the one stored
+		// before isn't served any more
+		idx.unverify(ctx, name, ProfileInvalid)
+	}
+	// A name cut short by a shutdown hasn't been resolved
+	if ctx.Err() == nil {
+		if err := idx.DB.UpsertResolvedAt(ctx, name, time.Now()); err != nil {
+			idx.log(idxPrefix, fmt.Sprintf("failed to store resolution time for %s: %s", name, err))
+		}
+		if profile == nil && fetchErr != nil && retryableError(fetchErr) {
+			idx.sched.Failed(name)
+		} else {
+			idx.sched.Resolved(name, profileHash(profile))
 		}
-		idx.ST.Rec("profiles.inserted", 1)
 	}
-	<-sem
-	wg.Done()
-	idx.ST.Rec("zonefiles.resolved", 1)
+	idx.ST.Rec(statZonefilesResolved, 1)
+	idx.ST.Rec(namespaceCounter(namespaceOf(name), "profiles"), 1)
+	idx.progressed(ctx)
+}
+
+// profileHash identifies a fetched profile so the scheduler can tell when it changes, it
+// is empty when there was no profile
+func profileHash(p *ProfileTokenFile) string {
+	if p == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(p.Token + p.DecodedToken.Signature))
+	return hex.EncodeToString(sum[:])
+}
+
+// ownerVerification checks a validated profile against the owner stored for the name
+// and returns the verification status to store with it
+func (idx *Indexer) ownerVerification(ctx context.Context, name string, profile *ProfileTokenFile) string {
+	owner := ""
+	if rec, err := idx.DB.FetchNameRecord(ctx, name); err == nil {
+		owner = rec.Owner
+	}
+	err := profile.VerifyOwner(owner)
+	if err == nil {
+		idx.ST.Rec(statProfilesOwnerVerified, 1)
+		return ProfileVerified
+	}
+	reason := verifyReason(err)
+	idx.ST.Rec(StatProfiles.Counter(reason), 1)
+	if reason == reasonOwnerUnknown {
+		return ProfileOwnerUnknown
+	}
+	return ProfileOwnerMismatch
 }
 
-// GetProfile takes a name and returns the profile associated
+// GetProfile takes a name and returns the profile associated. When none of the
+// zonefile's URLs gave back a profile the error is the last fetch error, if there was one
 // NOTE: This method makes a DB query and an HTTP request
-func (idx *Indexer) GetProfile(n string) *ProfileTokenFile {
+func (idx *Indexer) GetProfile(ctx context.Context, n string) (*ProfileTokenFile, error) {
 	// First fetch the zonefile data from the databse
-	zf, err := idx.DB.FetchZonefile(n)
+	zf, err := idx.DB.FetchZonefile(ctx, n)
 	if err != nil {
-		idx.ST.Rec("profiles.zf_invalid", 1)
-		return nil
+		idx.ST.Rec(statProfilesZfInvalid, 1)
+		return nil, nil
 	}
-	idx.ST.Rec("profiles.zf_valid", 1)
+	idx.ST.Rec(statProfilesZfValid, 1)
 
 	// Pull the URI's URLs from the Zonefile
 	urls, err := zf.URL()
 	if err != nil {
-		idx.ST.Rec("profiles.zf_parse_error", 1)
-		return nil
+		idx.ST.Rec(statProfilesZfParseError, 1)
+		return nil, nil
 	}
 
-	idx.ST.Rec("profiles.zf_parsed", 1)
+	idx.ST.Rec(statProfilesZfParsed, 1)
 
 	// Loop over all URLs from URI records
 	profiles := []*ProfileTokenFile{}
+	var fetchErr error
 	for _, url := range urls {
-		p, err := fetchProfile(url)
+		p, err := idx.fetchProfile(ctx, url)
 		// This error could be an http, ioutil, or unmarshal
 		if err != nil {
-			idx.ST.Rec("profiles.fetch_error", 1)
+			fetchErr = err
+			idx.ST.Rec(statProfilesFetchError, 1)
 			continue
 		}
 
@@ -79,40 +169,80 @@ func (idx *Indexer) GetProfile(n string) *ProfileTokenFile {
 		if len(p) > 0 {
 			if p[0].ParentPublicKey != "" {
 				profiles = append(profiles, p[0])
-				idx.ST.Rec("profiles.fetch_success", 1)
+				idx.ST.Rec(statProfilesFetchSuccess, 1)
 			} else if p[0].Token != "" {
 				profiles = append(profiles, p[0])
-				idx.ST.Rec("profiles.fetch_success", 1)
+				idx.ST.Rec(statProfilesFetchSuccess, 1)
 			}
 			continue
 		}
 
-		log.Println(p, err)
-		panic("Supposedly Unreachable")
+		// An empty list isn't a profile
+		idx.ST.Rec(statProfilesFetchEmpty, 1)
 	}
 
 	// Handle conditions
 	if len(profiles) > 1 {
-		idx.ST.Rec("profiles.multiple_profiles", 1)
+		idx.ST.Rec(statProfilesMultipleProfiles, 1)
 	} else if len(profiles) == 0 {
 		// If there is no profile, then return nil
-		return nil
+		return nil, fetchErr
 	}
 
 	// Otherwise return the profile
-	return profiles[0]
+	return profiles[0], nil
+}
+
+// profileClient is shared by every profile fetch
+var profileClient = &http.Client{Timeout: 30 * time.Second}
+
+// storageHosts are the storage hosts profile fetch latency is recorded under by name. Any
+// zonefile can point anywhere so the rest are recorded together as other
+var storageHosts = map[string]bool{
+	"gaia.blockstack.org":         true,
+	"blockstack.s3.amazonaws.com": true,
+	"s3.amazonaws.com":            true,
+	"storage.googleapis.com":      true,
+	"www.dropbox.com":             true,
+	"dl.dropboxusercontent.com":   true,
+	"raw.githubusercontent.com":   true,
+	"gist.githubusercontent.com":  true,
+}
+
+// storageHost returns the label profile fetch latency from u is recorded under
+func storageHost(u *url.URL) string {
+	if h := strings.ToLower(u.Hostname()); storageHosts[h] {
+		return h
+	}
+	return "other"
+}
+
+// fetchProfile wraps getProfileJSON in the retry policy and records the latency of each attempt by host
+func (idx *Indexer) fetchProfile(ctx context.Context, u *url.URL) (out []*ProfileTokenFile, err error) {
+	host := storageHost(u)
+	err = idx.retryPolicy.Do(ctx, "fetchProfile", func(ctx context.Context) (err error) {
+		defer idx.ST.Observe(LatencyStorage, host, time.Now())
+		out, err = getProfileJSON(ctx, u)
+		return
+	})
+	return
 }
 
-// fetchProfile takes a URL and returns the JSON that was recieved back
-func fetchProfile(u *url.URL) ([]*ProfileTokenFile, error) {
+// getProfileJSON takes a URL and returns the JSON that was recieved back, the request is abandoned if ctx is done
+func getProfileJSON(ctx context.Context, u *url.URL) ([]*ProfileTokenFile, error) {
 	p := make([]*ProfileTokenFile, 0)
-	client := http.DefaultClient
-	client.Timeout = 30 * time.Second
-	res, err := client.Get(u.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return p, err
+	}
+	res, err := profileClient.Do(req)
 	if err != nil {
 		return p, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return p, &statusError{Path: u.String(), Code: res.StatusCode, Status: res.Status}
+	}
 	bodyBytes, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return p, err
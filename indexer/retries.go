@@ -1,98 +1,186 @@
 package indexer
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
 	"time"
-
-	"github.com/blockstack/blockstack.go/blockstack"
 )
 
-// GetNamesInNamespace wraps the function by the same name from blockstack.go in a retry wrapper
-func (idx *Indexer) GetNamesInNamespace(ns string, offset int, count int) (blockstack.GetNamesInNamespaceResult, error) {
-	return idx.retryGetNamesInNamespace(idx.retries, idx.timeout, ns, offset, count, idx.BSK.GetNamesInNamespace)
+// RetryPolicy retries failed calls with capped, jittered exponential backoff
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries including the first
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, it doubles for each one after up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction of each delay that is randomized, 0.2 waits between 80% and 120% of it
+	Jitter float64
+	// Deadline bounds the total time spent on a call including retries
+	Deadline time.Duration
+	// Retryable reports whether an error is worth retrying, nil retries everything
+	Retryable func(err error) bool
+
+	// ST receives the per call retry metrics when set
+	ST *Stats
 }
 
-func (idx *Indexer) retryGetNamesInNamespace(attempts int, sleep time.Duration, ns string, offset int, count int, fn func(string, int, int) (blockstack.GetNamesInNamespaceResult, blockstack.Error)) (blockstack.GetNamesInNamespaceResult, error) {
-	names, err := fn(ns, offset, count)
-	if err != nil {
-		if attempts--; attempts > 0 {
-			time.Sleep(sleep)
-			log.Printf("[blockstack] GetNamesInNamespaces failed for %s, retrying %d times\n", ns, attempts)
-			return idx.retryGetNamesInNamespace(attempts, 2*sleep, ns, offset, count, fn)
+// Do calls fn until it succeeds, returns an error that isn't retryable, runs out of
+// attempts or ctx is done. fn is passed ctx bounded by the deadline so an attempt in
+// flight is abandoned too. Retries and failures are recorded under the call's name
+func (rp RetryPolicy) Do(ctx context.Context, call string, fn func(ctx context.Context) error) error {
+	if rp.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rp.Deadline)
+		defer cancel()
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			rp.rec(call, "deadline")
+			return fmt.Errorf("%s: %s after %d attempts: %w", call, ctx.Err(), attempt, err)
+		}
+		if rp.Retryable != nil && !rp.Retryable(err) {
+			rp.rec(call, "permanent")
+			return err
+		}
+		if attempt >= rp.MaxAttempts {
+			rp.rec(call, "exhausted")
+			return err
+		}
+		delay := rp.delay(attempt)
+		log.Printf("[retry] %s failed (attempt %d of %d), retrying in %s: %s\n", call, attempt, rp.MaxAttempts, delay, err)
+		rp.rec(call, "retries")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			rp.rec(call, "deadline")
+			return fmt.Errorf("%s: %s after %d attempts: %w", call, ctx.Err(), attempt, err)
 		}
-		return blockstack.GetNamesInNamespaceResult{}, err
 	}
-	return names, nil
 }
 
-// GetAllNamespaces wraps the function by the same name from blockstack.go in a retry wrapper
-func (idx *Indexer) GetAllNamespaces() (blockstack.GetAllNamespacesResult, error) {
-	return idx.retryGetAllNamespaces(idx.retries, idx.timeout, idx.BSK.GetAllNamespaces)
+// delay returns the jittered wait after the given attempt
+func (rp RetryPolicy) delay(attempt int) time.Duration {
+	d := rp.BaseDelay
+	for i := 1; i < attempt && (rp.MaxDelay == 0 || d < rp.MaxDelay); i++ {
+		d *= 2
+	}
+	if rp.MaxDelay > 0 && d > rp.MaxDelay {
+		d = rp.MaxDelay
+	}
+	if rp.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + rp.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
 }
 
-func (idx *Indexer) retryGetAllNamespaces(attempts int, sleep time.Duration, fn func() (blockstack.GetAllNamespacesResult, blockstack.Error)) (blockstack.GetAllNamespacesResult, error) {
-	namespaces, err := fn()
-	if err != nil {
-		if attempts--; attempts > 0 {
-			time.Sleep(sleep)
-			log.Printf("[blockstack] GetAllNamespaces failed, retrying %d times\n", attempts)
-			return idx.retryGetAllNamespaces(attempts, 2*sleep, fn)
-		}
-		return blockstack.GetAllNamespacesResult{}, err
+func (rp RetryPolicy) rec(call, outcome string) {
+	if rp.ST != nil {
+		rp.ST.Rec(StatRetries.Labeled(call, outcome), 1)
 	}
-	return namespaces, nil
 }
 
-// GetNumNamesInNamespace wraps the function by the same name from blockstack.go in a retry wrapper
-func (idx *Indexer) GetNumNamesInNamespace(namespace string) (blockstack.CountResult, error) {
-	return idx.retryGetNumNamesInNamespace(idx.retries, idx.timeout, namespace, idx.BSK.GetNumNamesInNamespace)
+// retryableError is the default classifier. Client errors other than timeouts and
+// rate limiting won't go away by asking again, e.g. a 404 for a name that doesn't
+// exist, and neither will a response that doesn't decode
+func retryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) && se.Code >= 400 && se.Code < 500 {
+		return se.Code == http.StatusRequestTimeout || se.Code == http.StatusTooManyRequests
+	}
+	// The same bytes will fail to decode the same way
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr)
 }
 
-func (idx *Indexer) retryGetNumNamesInNamespace(attempts int, sleep time.Duration, namespace string, fn func(namespace string) (blockstack.CountResult, blockstack.Error)) (blockstack.CountResult, error) {
-	namespaces, err := fn(namespace)
-	if err != nil {
-		if attempts--; attempts > 0 {
-			time.Sleep(sleep)
-			log.Printf("[blockstack] GetNumNamesInNamespace for %s failed, retrying %d times\n", namespace, attempts)
-			return idx.retryGetNumNamesInNamespace(attempts, 2*sleep, namespace, fn)
-		}
-		return blockstack.CountResult{}, err
+// retry runs a core call under the indexer's retry policy and records the latency of each
+// attempt. It stops waiting to retry once ctx is done
+func (idx *Indexer) retry(ctx context.Context, call string, fn func(ctx context.Context) error) error {
+	err := idx.retryPolicy.Do(ctx, call, func(ctx context.Context) error {
+		defer idx.ST.Observe(LatencyCore, call, time.Now())
+		return fn(ctx)
+	})
+	if err == nil {
+		idx.progressed(ctx)
 	}
-	return namespaces, nil
+	return err
 }
 
-// GetZonefiles wraps the function by the same name from blockstack.go in a retry wrapper
-func (idx *Indexer) GetZonefiles(zonefiles []string) (blockstack.GetZonefilesResult, error) {
-	return idx.retryGetZonefiles(idx.retries, idx.timeout, zonefiles, idx.BSK.GetZonefiles)
+// GetNamesInNamespace wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetNamesInNamespace(ctx context.Context, ns string, page int) (out []string, err error) {
+	err = idx.retry(ctx, "GetNamesInNamespace", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetNamesInNamespace(ctx, ns, page)
+		return
+	})
+	return
 }
 
-func (idx *Indexer) retryGetZonefiles(attempts int, sleep time.Duration, zonefiles []string, fn func(zonefiles []string) (blockstack.GetZonefilesResult, blockstack.Error)) (blockstack.GetZonefilesResult, error) {
-	zfs, err := fn(zonefiles)
-	if err != nil {
-		if attempts--; attempts > 0 {
-			time.Sleep(sleep)
-			log.Printf("[blockstack] GetZonefiles for %d zonefiles failed, retrying %d times\n", len(zonefiles), attempts)
-			return idx.retryGetZonefiles(attempts, 2*sleep, zonefiles, fn)
-		}
-		return blockstack.GetZonefilesResult{}, err
-	}
-	return zfs, nil
+// GetAllNamespaces wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetAllNamespaces(ctx context.Context) (out []string, err error) {
+	err = idx.retry(ctx, "GetAllNamespaces", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetAllNamespaces(ctx)
+		return
+	})
+	return
 }
 
-// GetNameBlockchainRecord wraps the function by the same name from blockstack.go in a retry wrapper
-func (idx *Indexer) GetNameBlockchainRecord(name string) (blockstack.GetNameBlockchainRecordResult, error) {
-	return idx.retryGetNameBlockchainRecord(idx.retries, idx.timeout, name, idx.BSK.GetNameBlockchainRecord)
+// GetNameCount wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetNameCount(ctx context.Context) (out int, err error) {
+	err = idx.retry(ctx, "GetNameCount", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetNameCount(ctx)
+		return
+	})
+	return
 }
 
-func (idx *Indexer) retryGetNameBlockchainRecord(attempts int, sleep time.Duration, name string, fn func(name string) (blockstack.GetNameBlockchainRecordResult, blockstack.Error)) (blockstack.GetNameBlockchainRecordResult, error) {
-	zfs, err := fn(name)
-	if err != nil {
-		if attempts--; attempts > 0 {
-			time.Sleep(sleep)
-			log.Printf("[blockstack] GetNameBlockchainRecord for %s failed, retrying %d times\n", name, attempts)
-			return idx.retryGetNameBlockchainRecord(attempts, 2*sleep, name, fn)
-		}
-		return blockstack.GetNameBlockchainRecordResult{}, err
+// GetNameBlockchainRecord wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetNameBlockchainRecord(ctx context.Context, name string) (out BlockchainRecord, err error) {
+	err = idx.retry(ctx, "GetNameBlockchainRecord", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetNameBlockchainRecord(ctx, name)
+		return
+	})
+	return
+}
+
+// GetSponsoredNames wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetSponsoredNames(ctx context.Context, page int) (out []string, err error) {
+	err = idx.retry(ctx, "GetSponsoredNames", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetSponsoredNames(ctx, page)
+		return
+	})
+	return
+}
+
+// GetBlockHeight wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetBlockHeight(ctx context.Context) (out int, err error) {
+	err = idx.retry(ctx, "GetBlockHeight", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetBlockHeight(ctx)
+		return
+	})
+	// Name expiry is judged against the latest height seen
+	if err == nil {
+		idx.height.Store(int64(out))
 	}
-	return zfs, nil
+	return
+}
+
+// GetNamesAtBlock wraps the Core call by the same name in the retry policy
+func (idx *Indexer) GetNamesAtBlock(ctx context.Context, height int) (out []string, err error) {
+	err = idx.retry(ctx, "GetNamesAtBlock", func(ctx context.Context) (err error) {
+		out, err = idx.BSK.GetNamesAtBlock(ctx, height)
+		return
+	})
+	return
 }
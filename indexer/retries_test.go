@@ -0,0 +1,146 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blockstack/blockstack.go/blockstack"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	st := NewStats(0)
+	rp := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Retryable: retryableError, ST: st}
+
+	calls := 0
+	err := rp.Do(context.Background(), "flaky", func(ctx context.Context) error {
+		if calls++; calls < 3 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on the third attempt, got %d attempts, err %v", calls, err)
+	}
+
+	calls = 0
+	err = rp.Do(context.Background(), "missing", func(ctx context.Context) error {
+		calls++
+		return &statusError{Path: "/v1/names/missing.id", Code: http.StatusNotFound, Status: "404 Not Found"}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("expected a 404 not to be retried, got %d attempts, err %v", calls, err)
+	}
+
+	calls = 0
+	err = rp.Do(context.Background(), "down", func(ctx context.Context) error {
+		calls++
+		return &statusError{Path: "/v1/info", Code: http.StatusBadGateway, Status: "502 Bad Gateway"}
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d, err %v", calls, err)
+	}
+
+	// The deadline stops retrying before the attempts run out
+	rp = RetryPolicy{MaxAttempts: 100, BaseDelay: 20 * time.Millisecond, Deadline: 50 * time.Millisecond, ST: st}
+	calls = 0
+	err = rp.Do(context.Background(), "slow", func(ctx context.Context) error {
+		calls++
+		return errors.New("timeout")
+	})
+	if err == nil || !strings.Contains(err.Error(), "deadline") || calls > 3 {
+		t.Fatalf("expected the deadline to stop retries, got %d attempts, err %v", calls, err)
+	}
+
+	for k, want := range map[[2]string]int{{"flaky", "retries"}: 2, {"missing", "permanent"}: 1, {"down", "exhausted"}: 1, {"slow", "deadline"}: 1} {
+		if c := st.Count(StatRetries.Labeled(k[0], k[1])); c != want {
+			t.Fatalf("expected retries.%s_%s to be %d, got %d", k[0], k[1], want, c)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	rp := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.2}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 50: 10 * time.Second} {
+		for i := 0; i < 20; i++ {
+			d := rp.delay(attempt)
+			if d < want*8/10 || d > want*12/10 {
+				t.Fatalf("attempt %d: delay %s outside 20%% of %s", attempt, d, want)
+			}
+		}
+	}
+}
+
+func TestCoreClientErrors(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+
+	res, err := idx.GetNameBlockchainRecord(ctx, "alice.app")
+	if err != nil || res.ZonefileHash != fc.records["alice.app"].ValueHash || res.Zonefile == "" {
+		t.Fatalf("expected alice.app's record and zonefile through the client, got %+v, err %v", res, err)
+	}
+
+	// Core's 404 for a name that doesn't exist comes back with its code and isn't retried
+	calls := fc.callCount("/v1/names")
+	_, err = idx.GetNameBlockchainRecord(ctx, "missing.id")
+	se := &statusError{}
+	if !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("expected a 404 status error, got %v", err)
+	}
+	if c := fc.callCount("/v1/names") - calls; c != 1 {
+		t.Fatalf("expected a missing name to be asked for once, got %d", c)
+	}
+}
+
+func TestRetryableErrorUnwraps(t *testing.T) {
+	notFound := &statusError{Path: "/v1/names/missing.id", Code: http.StatusNotFound, Status: "404 Not Found"}
+	for err, want := range map[error]bool{
+		errors.New("connection reset"):                                              true,
+		fmt.Errorf("GetNameBlockchainRecord: %w", notFound):                         false,
+		fmt.Errorf("fetch: %w", &url.Error{Op: "Get", Err: context.Canceled}):       false,
+		fmt.Errorf("fetch: %w", context.DeadlineExceeded):                           false,
+		fmt.Errorf("decode: %w", &json.SyntaxError{}):                               false,
+		fmt.Errorf("GetBlockHeight: %w", &statusError{Code: http.StatusBadGateway}): true,
+	} {
+		if got := retryableError(err); got != want {
+			t.Fatalf("expected retryableError(%v) to be %t", err, want)
+		}
+	}
+}
+
+func TestRetryPolicyAbandonsCallInFlight(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hung.Close()
+	hu, _ := url.Parse(hung.URL)
+	port, _ := strconv.Atoi(hu.Port())
+	core := NewCoreClient(blockstack.ServerConfig{Scheme: "http", Address: hu.Hostname(), Port: port})
+
+	// The deadline reaches the request so a node that never answers doesn't hold the call up
+	st := NewStats(0)
+	rp := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Deadline: 50 * time.Millisecond, Retryable: retryableError, ST: st}
+	start := time.Now()
+	err := rp.Do(context.Background(), "hung", func(ctx context.Context) error {
+		_, err := core.GetBlockHeight(ctx)
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("expected the call to be abandoned at the deadline, got %v after %s", err, time.Since(start))
+	}
+	if c := st.Count(StatRetries.Labeled("hung", "deadline")); c != 1 {
+		t.Fatalf("expected retries.hung_deadline to be 1, got %d", c)
+	}
+}
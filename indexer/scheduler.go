@@ -0,0 +1,330 @@
+package indexer
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// refreshBatchSize is the most names the refresh loop resolves before checking the schedule again
+const refreshBatchSize = 100
+
+// seedSchedule adds every name to the scheduler, names resolved by an earlier run are due
+// min after that and the rest are due now
+func (idx *Indexer) seedSchedule(ctx context.Context) error {
+	err := idx.DB.EachResolvedAt(ctx, func(name string, t time.Time) error {
+		idx.sched.Add(name, t)
+		return nil
+	})
+	for _, name := range idx.names.current() {
+		idx.sched.Add(name, time.Time{})
+	}
+	return err
+}
+
+// refreshLoop re-resolves profiles as the scheduler says they are due. It returns once ctx is done
+func (idx *Indexer) refreshLoop(ctx context.Context) {
+	for {
+		wait := idx.config.MinRefreshInterval
+		if next := idx.sched.Next(); !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-idx.sched.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+		names := idx.sched.Due(time.Now(), refreshBatchSize)
+		if len(names) == 0 {
+			continue
+		}
+		idx.log(idxPrefix, fmt.Sprintf("refreshing %d profiles, %d scheduled", len(names), idx.sched.Len()))
+		pctx, done := idx.working(ctx, loopRefresh)
+		idx.ResolveNames(pctx, names)
+		done()
+		// A batch cut short leaves the names it didn't get to out of the queue
+		if ctx.Err() != nil {
+			idx.sched.Requeue(names)
+			return
+		}
+		idx.ST.Rec(statProfilesRefreshed, len(names))
+	}
+}
+
+// Scheduler decides when each name's profile is next re-resolved. Names are kept in a
+// priority queue by when they are due. A profile that comes back unchanged has its
+// interval doubled up to max, while a changed zonefile or profile drops it back to min.
+// A transient failure brings the name back after min and lookups through the API
+// shorten the wait for popular names. Namespaces can have their own min and max, or be
+// skipped altogether
+type Scheduler struct {
+	min, max time.Duration
+	// bounds holds the min and max of namespaces that override them, skip the namespaces
+	// that are never scheduled
+	bounds map[string][2]time.Duration
+	skip   map[string]bool
+
+	queue schedQueue
+	items map[string]*schedItem
+
+	// wake is signalled when a name becomes due sooner than the queue head was
+	wake chan struct{}
+
+	sync.Mutex
+}
+
+type schedItem struct {
+	name     string
+	due      time.Time
+	last     time.Time
+	interval time.Duration
+	// hits counts API lookups since the name was last resolved
+	hits int
+	// profile is a hash of the last profile resolved, empty if there wasn't one
+	profile string
+	// changed is set when the zonefile changed since the name was last resolved
+	changed bool
+
+	index int
+}
+
+// NewScheduler returns an empty Scheduler with refresh intervals between min and max
+func NewScheduler(min, max time.Duration) *Scheduler {
+	return &Scheduler{
+		min:    min,
+		max:    max,
+		bounds: make(map[string][2]time.Duration),
+		skip:   make(map[string]bool),
+		items:  make(map[string]*schedItem),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// SetNamespace gives the names in a namespace their own min and max refresh intervals
+func (s *Scheduler) SetNamespace(namespace string, min, max time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.bounds[namespace] = [2]time.Duration{min, max}
+}
+
+// Skip stops scheduling the names in a namespace, for namespaces whose profiles aren't resolved
+func (s *Scheduler) Skip(namespace string) {
+	s.Lock()
+	defer s.Unlock()
+	s.skip[namespace] = true
+}
+
+// intervals returns the min and max refresh intervals of a name
+func (s *Scheduler) intervals(name string) (time.Duration, time.Duration) {
+	if b, ok := s.bounds[namespaceOf(name)]; ok {
+		return b[0], b[1]
+	}
+	return s.min, s.max
+}
+
+// Add schedules a name that isn't scheduled yet, min after it was last resolved. A
+// name that has never been resolved is due now
+func (s *Scheduler) Add(name string, lastResolved time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.items[name]; ok || s.skip[namespaceOf(name)] {
+		return
+	}
+	min, _ := s.intervals(name)
+	it := &schedItem{name: name, last: lastResolved, interval: min, due: time.Now()}
+	if !lastResolved.IsZero() {
+		it.due = lastResolved.Add(min)
+	}
+	s.items[name] = it
+	heap.Push(&s.queue, it)
+	s.signal(it)
+}
+
+// Changed drops a name's interval back to min because its zonefile changed. Whatever
+// wrote the zonefile resolves the name straight away, so it is due no later than min from
+// now rather than now, and the next resolution doesn't back off
+func (s *Scheduler) Changed(name string) {
+	s.update(name, func(it *schedItem, min, max time.Duration) {
+		it.interval = min
+		it.changed = true
+		if due := time.Now().Add(min); it.due.IsZero() || due.Before(it.due) {
+			it.due = due
+		}
+	})
+}
+
+// Failed brings a name whose profile fetch failed with a transient error back after min
+func (s *Scheduler) Failed(name string) {
+	s.update(name, func(it *schedItem, min, max time.Duration) {
+		it.last = time.Now()
+		it.hits = 0
+		it.due = it.last.Add(min)
+	})
+}
+
+// Resolved reschedules a name after resolving its profile. profile is a hash of what was
+// resolved, the interval doubles if it is the same as last time and resets if it isn't
+func (s *Scheduler) Resolved(name, profile string) {
+	s.update(name, func(it *schedItem, min, max time.Duration) {
+		if it.profile == profile && !it.last.IsZero() && !it.changed {
+			it.interval *= 2
+			if it.interval > max {
+				it.interval = max
+			}
+		} else {
+			it.interval = min
+		}
+		it.profile = profile
+		it.changed = false
+		it.last = time.Now()
+		it.hits = 0
+		it.due = it.last.Add(it.interval)
+	})
+}
+
+// Hit records a lookup of a name, each one shortens its wait down to no less than min
+func (s *Scheduler) Hit(name string) {
+	s.Lock()
+	defer s.Unlock()
+	it, ok := s.items[name]
+	if !ok || it.last.IsZero() {
+		return
+	}
+	it.hits++
+	// A name handed out by Due is being resolved right now
+	if it.index < 0 {
+		return
+	}
+	wait := it.interval / time.Duration(1+it.hits)
+	if min, _ := s.intervals(name); wait < min {
+		wait = min
+	}
+	if due := it.last.Add(wait); due.Before(it.due) {
+		it.due = due
+		heap.Fix(&s.queue, it.index)
+		s.signal(it)
+	}
+}
+
+// Due removes and returns up to limit names that are due by now. They are scheduled
+// again once they are resolved
+func (s *Scheduler) Due(now time.Time, limit int) []string {
+	s.Lock()
+	defer s.Unlock()
+	out := make([]string, 0)
+	for len(s.queue) > 0 && len(out) < limit && !s.queue[0].due.After(now) {
+		it := heap.Pop(&s.queue).(*schedItem)
+		it.index = -1
+		out = append(out, it.name)
+	}
+	return out
+}
+
+// Requeue puts back names handed out by Due that weren't scheduled again because resolving
+// them was cut short. They keep the due time they had
+func (s *Scheduler) Requeue(names []string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, name := range names {
+		if it, ok := s.items[name]; ok && it.index < 0 {
+			heap.Push(&s.queue, it)
+			s.signal(it)
+		}
+	}
+}
+
+// Remove stops scheduling a name that has left the network
+func (s *Scheduler) Remove(name string) {
+	s.Lock()
+	defer s.Unlock()
+	it, ok := s.items[name]
+	if !ok {
+		return
+	}
+	delete(s.items, name)
+	if it.index >= 0 {
+		heap.Remove(&s.queue, it.index)
+	}
+}
+
+// Next returns when the next name is due, the zero time if nothing is scheduled
+func (s *Scheduler) Next() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queue) == 0 {
+		return time.Time{}
+	}
+	return s.queue[0].due
+}
+
+// Len returns the number of names known to the scheduler
+func (s *Scheduler) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.items)
+}
+
+// update applies fn to a name's schedule with its min and max, adding the name if it is new
+// and putting it back in the queue if it was handed out by Due. Skipped names are left alone
+func (s *Scheduler) update(name string, fn func(it *schedItem, min, max time.Duration)) {
+	s.Lock()
+	defer s.Unlock()
+	if s.skip[namespaceOf(name)] {
+		return
+	}
+	min, max := s.intervals(name)
+	it, ok := s.items[name]
+	if !ok {
+		it = &schedItem{name: name, interval: min, index: -1}
+		s.items[name] = it
+	}
+	fn(it, min, max)
+	if it.index < 0 {
+		heap.Push(&s.queue, it)
+	} else {
+		heap.Fix(&s.queue, it.index)
+	}
+	s.signal(it)
+}
+
+// signal wakes the refresh loop if it is the new head of the queue
+func (s *Scheduler) signal(it *schedItem) {
+	if it.index != 0 {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedQueue is a min heap of names by due time
+type schedQueue []*schedItem
+
+func (q schedQueue) Len() int           { return len(q) }
+func (q schedQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q schedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *schedQueue) Push(x interface{}) {
+	it := x.(*schedItem)
+	it.index = len(*q)
+	*q = append(*q, it)
+}
+
+func (q *schedQueue) Pop() interface{} {
+	old := *q
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,182 @@
+package indexer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBackoff(t *testing.T) {
+	s := NewScheduler(time.Hour, 4*time.Hour)
+	s.Add("alice.id", time.Time{})
+	if due := s.Due(time.Now(), 10); len(due) != 1 || due[0] != "alice.id" {
+		t.Fatalf("expected a name never resolved to be due, got %v", due)
+	}
+
+	// The same profile each time doubles the interval up to max
+	for _, want := range []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 4 * time.Hour} {
+		s.Resolved("alice.id", "a")
+		if it := s.items["alice.id"]; it.interval != want {
+			t.Fatalf("expected interval %s, got %s", want, it.interval)
+		}
+	}
+
+	// A new profile drops it back to min
+	s.Resolved("alice.id", "b")
+	if it := s.items["alice.id"]; it.interval != time.Hour {
+		t.Fatalf("expected interval back at min, got %s", it.interval)
+	}
+
+	// So does a changed zonefile, even when the profile comes back the same
+	s.Resolved("alice.id", "b")
+	s.Changed("alice.id")
+	s.Resolved("alice.id", "b")
+	if it := s.items["alice.id"]; it.interval != time.Hour {
+		t.Fatalf("expected interval at min after a zonefile change, got %s", it.interval)
+	}
+}
+
+func TestSchedulerOrdering(t *testing.T) {
+	now := time.Now()
+	s := NewScheduler(time.Hour, 8*time.Hour)
+	for _, name := range []string{"failed.id", "popular.id", "stable.id"} {
+		s.Add(name, now)
+		s.Due(now.Add(time.Hour), 10)
+		for i := 0; i < 4; i++ {
+			s.Resolved(name, "p")
+		}
+	}
+	if s.Len() != 3 {
+		t.Fatalf("expected 3 names, got %d", s.Len())
+	}
+	if due := s.Due(time.Now(), 10); len(due) != 0 {
+		t.Fatalf("expected nothing due, got %v", due)
+	}
+
+	// A failure comes back after min, lookups shorten the wait but never below min
+	s.Failed("failed.id")
+	for i := 0; i < 10; i++ {
+		s.Hit("popular.id")
+	}
+	if it := s.items["popular.id"]; it.due.Sub(it.last) != time.Hour {
+		t.Fatalf("expected a popular name due after min, got %s", it.due.Sub(it.last))
+	}
+	if it := s.items["stable.id"]; it.due.Sub(it.last) != 8*time.Hour {
+		t.Fatalf("expected a stable name due after max, got %s", it.due.Sub(it.last))
+	}
+
+	due := s.Due(time.Now().Add(2*time.Hour), 1)
+	if len(due) != 1 || due[0] != "popular.id" {
+		t.Fatalf("expected only popular.id within the limit, got %v", due)
+	}
+	due = s.Due(time.Now().Add(2*time.Hour), 10)
+	if len(due) != 1 || due[0] != "failed.id" {
+		t.Fatalf("expected failed.id next, got %v", due)
+	}
+	if next := s.Next(); !next.Equal(s.items["stable.id"].due) {
+		t.Fatalf("expected stable.id to be next, got %s", next)
+	}
+}
+
+func TestResolveNamesSchedules(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	names := fc.names()
+	idx := newTestIndexer(t, fc, db, names)
+	idx.GetAllZonefiles(ctx)
+	idx.ResolveNames(ctx, names[:10])
+
+	// A restart starts from the resolution times in the database
+	idx.sched = NewScheduler(time.Hour, 2*time.Hour)
+	if err := idx.seedSchedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resolved names wait out the interval, the rest are due now
+	due := idx.sched.Due(time.Now(), len(names))
+	if len(due) != len(names)-10 {
+		t.Fatalf("expected %d names due, got %d", len(names)-10, len(due))
+	}
+	for _, name := range due {
+		if name == names[0] {
+			t.Fatalf("expected %s not to be due", name)
+		}
+	}
+	idx.ResolveNames(ctx, due)
+	if idx.sched.Len() != len(names) {
+		t.Fatalf("expected every name scheduled, got %d", idx.sched.Len())
+	}
+	if due := idx.sched.Due(time.Now(), len(names)); len(due) != 0 {
+		t.Fatalf("expected nothing due after resolving, got %v", due)
+	}
+}
+
+func TestSchedulerNamespaces(t *testing.T) {
+	s := NewScheduler(time.Hour, 4*time.Hour)
+	s.SetNamespace("app", time.Minute, 2*time.Minute)
+	s.Skip("test")
+	for _, name := range []string{"alice.id", "alice.app", "alice.test"} {
+		s.Add(name, time.Time{})
+	}
+	s.Changed("bob.test")
+	if n := s.Len(); n != 2 {
+		t.Fatalf("expected the skipped namespace left out, got %d names", n)
+	}
+	s.Due(time.Now(), 10)
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 2 * time.Minute} {
+		s.Resolved("alice.app", "a")
+		s.Resolved("alice.id", "a")
+		if it := s.items["alice.app"]; it.interval != want {
+			t.Fatalf("expected the namespace's interval %s, got %s", want, it.interval)
+		}
+	}
+	if it := s.items["alice.id"]; it.interval != 4*time.Hour {
+		t.Fatalf("expected the default intervals elsewhere, got %s", it.interval)
+	}
+}
+
+// cancellingDB wraps a DB and cancels a context once the first zonefile is fetched
+type cancellingDB struct {
+	DB
+
+	cancel context.CancelFunc
+	calls  atomic.Int32
+}
+
+func (c *cancellingDB) FetchZonefile(ctx context.Context, name string) (NameZonefile, error) {
+	if c.calls.Add(1) == 1 {
+		c.cancel()
+	}
+	return c.DB.FetchZonefile(ctx, name)
+}
+
+func TestRefreshLoopRequeuesCancelledBatch(t *testing.T) {
+	fc := newTestNetwork(t)
+	db := NewMemDB()
+	names := fc.names()
+	idx := newTestIndexer(t, fc, db, names)
+	idx.GetAllZonefiles(context.Background())
+	// Writing the zonefiles put off resolving them, start again with every name due
+	idx.sched = NewScheduler(time.Hour, 2*time.Hour)
+	for _, name := range names {
+		idx.sched.Add(name, time.Time{})
+	}
+
+	// Shutting down partway through a batch stops the loop before the batch is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idx.DB = &cancellingDB{DB: db, cancel: cancel}
+	idx.refreshLoop(ctx)
+	profiles := db.ProfilesCount(context.Background())
+	if profiles >= refreshBatchSize {
+		t.Fatalf("expected the batch to be cut short, got %d profiles", profiles)
+	}
+
+	// Every name it didn't get to is still scheduled and due
+	if due := idx.sched.Due(time.Now(), len(names)); len(due) != len(names) {
+		t.Fatalf("expected all %d names due again, got %d", len(names), len(due))
+	}
+}
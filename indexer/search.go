@@ -0,0 +1,291 @@
+package indexer
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Weights given to each profile field in the search index
+const (
+	searchWeightName       = 4.0
+	searchWeightProfile    = 3.0
+	searchWeightIdentifier = 2.0
+	searchWeightService    = 1.0
+	searchWeightWebsite    = 1.0
+)
+
+// How much a non-exact term match is worth relative to an exact one
+const (
+	searchMatchExact  = 1.0
+	searchMatchPrefix = 0.6
+	searchMatchFuzzy  = 0.4
+)
+
+// NewSearchIndex returns an empty SearchIndex
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[string]float64),
+		docs:     make(map[string][]string),
+	}
+}
+
+// SearchIndex is an in memory inverted index over profiles. It supports
+// exact, prefix and fuzzy term matching and ranks results by field weight
+// and term rarity
+type SearchIndex struct {
+	// map[term]map[name]weight
+	postings map[string]map[string]float64
+	// map[name][]term, used to remove stale terms when a profile is reindexed
+	docs map[string][]string
+
+	// sorted list of all terms for prefix lookups, rebuilt lazily
+	terms []string
+	dirty bool
+
+	sync.RWMutex
+}
+
+// SearchResult is a single ranked match
+type SearchResult struct {
+	Name  string
+	Score float64
+}
+
+// Add indexes the profile for a name, replacing anything previously indexed for it
+func (si *SearchIndex) Add(name string, profile Profile) {
+	fields := make(map[string]float64)
+	addTerms := func(text string, weight float64) {
+		for _, t := range tokenize(text) {
+			if weight > fields[t] {
+				fields[t] = weight
+			}
+		}
+	}
+
+	// The first label of the name (e.g. "muneeb" in "muneeb.id") is what users type
+	addTerms(strings.SplitN(name, ".", 2)[0], searchWeightName)
+	addTerms(profile.Name, searchWeightProfile)
+	for _, a := range profile.Account {
+		addTerms(a.Identifier, searchWeightIdentifier)
+		addTerms(a.Service, searchWeightService)
+	}
+	for _, w := range profile.Website {
+		addTerms(w.URL, searchWeightWebsite)
+	}
+
+	si.Lock()
+	defer si.Unlock()
+	si.remove(name)
+	terms := make([]string, 0, len(fields))
+	for t, w := range fields {
+		if _, ok := si.postings[t]; !ok {
+			si.postings[t] = make(map[string]float64)
+			si.dirty = true
+		}
+		si.postings[t][name] = w
+		terms = append(terms, t)
+	}
+	si.docs[name] = terms
+}
+
+// Remove drops a name from the index
+func (si *SearchIndex) Remove(name string) {
+	si.Lock()
+	si.remove(name)
+	si.Unlock()
+}
+
+func (si *SearchIndex) remove(name string) {
+	for _, t := range si.docs[name] {
+		delete(si.postings[t], name)
+		if len(si.postings[t]) == 0 {
+			delete(si.postings, t)
+			si.dirty = true
+		}
+	}
+	delete(si.docs, name)
+}
+
+// Len returns the number of names in the index
+func (si *SearchIndex) Len() int {
+	si.RLock()
+	defer si.RUnlock()
+	return len(si.docs)
+}
+
+// Search returns the names matching every term in the query ordered by score.
+// It returns at most count results after skipping offset and the total number of matches
+func (si *SearchIndex) Search(query string, offset, count int) ([]SearchResult, int) {
+	qterms := tokenize(query)
+	if len(qterms) == 0 {
+		return []SearchResult{}, 0
+	}
+
+	// A query that finds the term list out of date rebuilds it and searches under the
+	// same write lock, so an Add can't make it stale again in between
+	si.RLock()
+	if si.dirty {
+		si.RUnlock()
+		si.Lock()
+		defer si.Unlock()
+		si.rebuildTerms()
+	} else {
+		defer si.RUnlock()
+	}
+
+	var scores map[string]float64
+	for _, qt := range qterms {
+		termScores := si.matchTerm(qt)
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		// Every query term has to match
+		for n := range scores {
+			if s, ok := termScores[n]; ok {
+				scores[n] += s
+			} else {
+				delete(scores, n)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for n, s := range scores {
+		results = append(results, SearchResult{Name: n, Score: s})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+
+	total := len(results)
+	if offset >= total {
+		return []SearchResult{}, total
+	}
+	end := offset + count
+	if end > total {
+		end = total
+	}
+	return results[offset:end], total
+}
+
+// rebuildTerms sorts the terms again if any were added or removed, si must be write locked
+func (si *SearchIndex) rebuildTerms() {
+	if !si.dirty {
+		return
+	}
+	si.terms = make([]string, 0, len(si.postings))
+	for t := range si.postings {
+		si.terms = append(si.terms, t)
+	}
+	sort.Strings(si.terms)
+	si.dirty = false
+}
+
+// matchTerm returns the best score for each name matching a single query term
+func (si *SearchIndex) matchTerm(qt string) map[string]float64 {
+	out := make(map[string]float64)
+	score := func(term string, match float64) {
+		postings := si.postings[term]
+		// Rare terms are worth more than common ones
+		idf := math.Log(1 + float64(len(si.docs))/float64(len(postings)))
+		for n, w := range postings {
+			if s := match * w * idf; s > out[n] {
+				out[n] = s
+			}
+		}
+	}
+
+	// Exact and prefix matches come from a range of the sorted term list
+	for i := sort.SearchStrings(si.terms, qt); i < len(si.terms) && strings.HasPrefix(si.terms[i], qt); i++ {
+		if si.terms[i] == qt {
+			score(qt, searchMatchExact)
+		} else {
+			score(si.terms[i], searchMatchPrefix)
+		}
+	}
+
+	// Fuzzy matches tolerate typos in longer terms. They have to share the first letter
+	// so only the range of terms starting with it is scanned. Terms are compared by rune
+	// so letters outside ASCII count once
+	maxDist := fuzzyDistance(qt)
+	if maxDist == 0 {
+		return out
+	}
+	_, size := utf8.DecodeRuneInString(qt)
+	first, qlen := qt[:size], utf8.RuneCountInString(qt)
+	for i := sort.SearchStrings(si.terms, first); i < len(si.terms) && strings.HasPrefix(si.terms[i], first); i++ {
+		t := si.terms[i]
+		if abs(utf8.RuneCountInString(t)-qlen) > maxDist || strings.HasPrefix(t, qt) {
+			continue
+		}
+		if levenshtein(qt, t) <= maxDist {
+			score(t, searchMatchFuzzy)
+		}
+	}
+	return out
+}
+
+// fuzzyDistance returns the edit distance tolerated for a query term
+func fuzzyDistance(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// tokenize lowercases text and splits it on anything that isn't a letter or number
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// levenshtein returns the edit distance in runes between two strings
+func levenshtein(as, bs string) int {
+	a, b := []rune(as), []rune(bs)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,106 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+// searchNames returns the names a query finds in ranked order
+func searchNames(si *SearchIndex, query string) []string {
+	res, _ := si.Search(query, 0, 100)
+	out := make([]string, 0, len(res))
+	for _, r := range res {
+		out = append(out, r.Name)
+	}
+	return out
+}
+
+func TestSearchIndexRanking(t *testing.T) {
+	si := NewSearchIndex()
+	si.Add("carol.id", Profile{Name: "Alice Smith"})
+	si.Add("alice.id", Profile{Name: "Someone Else"})
+	si.Add("dave.id", Profile{Name: "Dave", Account: []Account{{Service: "twitter", Identifier: "alice"}}})
+
+	// Matches on the name beat the profile's name, which beats its accounts
+	if got, want := searchNames(si, "alice"), []string{"alice.id", "carol.id", "dave.id"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Every term has to match
+	if got := searchNames(si, "alice smith"); !reflect.DeepEqual(got, []string{"carol.id"}) {
+		t.Fatalf("expected only carol.id, got %v", got)
+	}
+
+	// Rare terms are worth more than common ones
+	si.Add("erin.id", Profile{Name: "Someone Rare"})
+	res, _ := si.Search("someone rare", 0, 10)
+	if len(res) != 1 || res[0].Name != "erin.id" {
+		t.Fatalf("expected only erin.id, got %v", res)
+	}
+	if rare, common := si.matchTerm("rare")["erin.id"], si.matchTerm("someone")["erin.id"]; rare <= common {
+		t.Fatalf("expected the rare term to score higher, got %f and %f", rare, common)
+	}
+
+	// Reindexing a name drops its old terms
+	si.Add("carol.id", Profile{Name: "Carol Jones"})
+	if got := searchNames(si, "smith"); len(got) != 0 {
+		t.Fatalf("expected no matches for a removed term, got %v", got)
+	}
+	si.Remove("dave.id")
+	if got := searchNames(si, "twitter"); len(got) != 0 || si.Len() != 3 {
+		t.Fatalf("expected dave.id gone, got %v and %d names", got, si.Len())
+	}
+}
+
+func TestSearchIndexPrefixAndFuzzy(t *testing.T) {
+	si := NewSearchIndex()
+	si.Add("muneeb.id", Profile{Name: "Muneeb Ali"})
+	si.Add("jude.id", Profile{Name: "Jude Nelson"})
+
+	for query, want := range map[string][]string{
+		// Prefixes match at any length
+		"mu":   {"muneeb.id"},
+		"nels": {"jude.id"},
+		// Typos are tolerated in terms of four letters or more, one in up to seven
+		"muneb":   {"muneeb.id"},
+		"nelsen":  {"jude.id"},
+		"jdue":    {},
+		"ali":     {"muneeb.id"},
+		"alx":     {},
+		"munebb":  {"muneeb.id"},
+		"mumeeeb": {},
+		// but fuzzy matches have to share the first letter
+		"nuneeb": {},
+	} {
+		if got := searchNames(si, query); len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Fatalf("%q: expected %v, got %v", query, want, got)
+		}
+	}
+
+	// Exact matches rank above prefix ones
+	si.Add("munee.id", Profile{})
+	if got := searchNames(si, "munee"); !reflect.DeepEqual(got, []string{"munee.id", "muneeb.id"}) {
+		t.Fatalf("expected the exact match first, got %v", got)
+	}
+}
+
+func TestSearchIndexFuzzyNonASCII(t *testing.T) {
+	si := NewSearchIndex()
+	si.Add("jorg.id", Profile{Name: "Jörgen Ångström"})
+	si.Add("ulf.id", Profile{Name: "Ülfar"})
+
+	for query, want := range map[string][]string{
+		// A letter outside ASCII is one edit, not two
+		"jorgen":   {"jorg.id"},
+		"angstrom": {},
+		"ångstrom": {"jorg.id"},
+		"jörg":     {"jorg.id"},
+		// and a first letter sharing its leading byte is still a different letter
+		"ölfar": {},
+		"ülfer": {"ulf.id"},
+	} {
+		if got := searchNames(si, query); len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Fatalf("%q: expected %v, got %v", query, want, got)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package indexer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Status returns the indexer status
@@ -18,6 +21,21 @@ type Status struct {
 	sync.Mutex
 }
 
+// Stage returns the status of the names, zonefiles or profiles index
+func (s *Status) Stage(stage string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	switch stage {
+	case "names":
+		return s.NamesIndex, true
+	case "zonefiles":
+		return s.ZonefilesIndex, true
+	case "profiles":
+		return s.ProfilesIndex, true
+	}
+	return "", false
+}
+
 func newStatus() *Status {
 	return &Status{
 		NamesIndex:     "indexing",
@@ -26,85 +44,303 @@ func newStatus() *Status {
 	}
 }
 
-// Stats handles the stats about names fetched
+// StatGroup is a section of /idxstats, every counter and gauge belongs to one
+type StatGroup uint8
+
+// The stat groups
+const (
+	StatNamespaces StatGroup = iota
+	StatNameFetch
+	StatNameDetails
+	StatZonefiles
+	StatProfiles
+	StatBlocks
+	StatHosts
+	StatRetries
+	StatDeadLetters
+	StatPipeline
+	StatQueues
+	StatNamespaceIndex
+
+	numStatGroups
+)
+
+var statGroupNames = [numStatGroups]string{
+	"namespaces", "nameFetch", "nameDetails", "zonefiles", "profiles", "blocks", "hosts", "retries", "deadLetters",
+	"pipeline", "queues", "namespaceIndex",
+}
+
+func (g StatGroup) String() string {
+	return statGroupNames[g]
+}
+
+// CounterKey names a counter. Counters only go up
+type CounterKey struct {
+	group StatGroup
+	// label is the host, call, stage or namespace of a labeled counter, empty for the rest
+	label string
+	name  string
+	// id is the counter's index in Stats.static plus one, zero for counters registered on first use
+	id int
+}
+
+// GaugeKey names a gauge. Gauges are set to the latest value
+type GaugeKey struct {
+	group StatGroup
+	name  string
+}
+
+// Counter returns the key of a counter in the group, for counters named at run time like
+// a dead letter stage. Fixed counters are declared below and registered up front
+func (g StatGroup) Counter(name string) CounterKey {
+	if id, ok := staticIDs[g.String()+"."+name]; ok {
+		return CounterKey{group: g, name: name, id: id}
+	}
+	return CounterKey{group: g, name: name}
+}
+
+// Labeled returns the key of a counter for a host, call, stage or namespace, named by outcome.
+// The label is kept apart from the name so it can hold anything, underscores included
+func (g StatGroup) Labeled(label, name string) CounterKey {
+	return CounterKey{group: g, label: label, name: name}
+}
+
+// key is the counter's name in /idxstats, {label}_{name} for labeled counters
+func (k CounterKey) key() string {
+	if k.label == "" {
+		return k.name
+	}
+	return k.label + "_" + k.name
+}
+
+// Gauge returns the key of a gauge in the group
+func (g StatGroup) Gauge(name string) GaugeKey {
+	return GaugeKey{group: g, name: name}
+}
+
+var (
+	staticKeys = make([]CounterKey, 0)
+	staticIDs  = make(map[string]int)
+)
+
+// staticCounter declares a fixed counter, every Stats has a slot for it
+func staticCounter(g StatGroup, name string) CounterKey {
+	k := CounterKey{group: g, name: name, id: len(staticKeys) + 1}
+	staticKeys = append(staticKeys, k)
+	staticIDs[g.String()+"."+name] = k.id
+	return k
+}
+
+// The fixed counters
+var (
+	statNameFetchSponsored = staticCounter(StatNameFetch, "sponsored")
+	statNameFetchAdded     = staticCounter(StatNameFetch, "added")
+	statNameFetchRemoved   = staticCounter(StatNameFetch, "removed")
+
+	statNameDetailsDisagreements = staticCounter(StatNameDetails, "disagreements")
+	statNameDetailsNoQuorum      = staticCounter(StatNameDetails, "no_quorum")
+	statNameDetailsTransferred   = staticCounter(StatNameDetails, "transferred")
+	statNameDetailsExpired       = staticCounter(StatNameDetails, NameExpired)
+	statNameDetailsRevoked       = staticCounter(StatNameDetails, NameRevoked)
+
+	statZonefilesChanged             = staticCounter(StatZonefiles, "changed")
+	statZonefilesSkipped             = staticCounter(StatZonefiles, "skipped")
+	statZonefilesMismatched          = staticCounter(StatZonefiles, "mismatched")
+	statZonefilesResolved            = staticCounter(StatZonefiles, "resolved")
+	statZonefilesSubdomains          = staticCounter(StatZonefiles, "subdomains")
+	statZonefilesSubdomainParseError = staticCounter(StatZonefiles, "subdomain_parse_error")
+
+	statProfilesZfInvalid        = staticCounter(StatProfiles, "zf_invalid")
+	statProfilesZfValid          = staticCounter(StatProfiles, "zf_valid")
+	statProfilesZfParseError     = staticCounter(StatProfiles, "zf_parse_error")
+	statProfilesZfParsed         = staticCounter(StatProfiles, "zf_parsed")
+	statProfilesFetchError       = staticCounter(StatProfiles, "fetch_error")
+	statProfilesFetchSuccess     = staticCounter(StatProfiles, "fetch_success")
+	statProfilesFetchEmpty       = staticCounter(StatProfiles, "fetch_empty")
+	statProfilesMultipleProfiles = staticCounter(StatProfiles, "multiple_profiles")
+	statProfilesVerified         = staticCounter(StatProfiles, "verified")
+	statProfilesOwnerVerified    = staticCounter(StatProfiles, "owner_verified")
+	statProfilesInserted         = staticCounter(StatProfiles, "inserted")
+	statProfilesInsertError      = staticCounter(StatProfiles, "insert_error")
+	statProfilesRefreshed        = staticCounter(StatProfiles, "refreshed")
+	statProfilesNotResolved      = staticCounter(StatProfiles, "not_resolved")
+
+	statBlocksIndexed      = staticCounter(StatBlocks, "indexed")
+	statBlocksNamesChanged = staticCounter(StatBlocks, "names_changed")
+	statBlocksFullResyncs  = staticCounter(StatBlocks, "full_resyncs")
+
+	statDeadLettersRetried = staticCounter(StatDeadLetters, "retried")
+	statDeadLettersCleared = staticCounter(StatDeadLetters, "cleared")
+)
+
+// Stats is a registry of atomic counters and gauges. Recording never blocks so any
+// number of goroutines can record at once
 type Stats struct {
-	Namespaces  map[string]int `json:"namespaces"`
-	NameFetch   map[string]int `json:"nameFetch"`
-	NameDetails map[string]int `json:"nameDetails"`
-	Zonefiles   map[string]int `json:"zonefiles"`
-	Profiles    map[string]int `json:"profiles"`
-	Status      *Status        `json:"status"`
+	Status *Status
+	Port   int
 
-	// Stats map[string]int `json:"stats"`
-	Port int `json:"-"`
+	// static holds the fixed counters, counters holds the rest by CounterKey and gauges by GaugeKey
+	static   []atomic.Int64
+	counters sync.Map
+	gauges   sync.Map
 
-	statsChan  chan map[string]int
-	statusChan chan string
+	server *http.Server
+
+	// scraped and latencies are only served on /metrics
+	scraped   []scrapedGauge
+	latencies map[string]*histogramVec
 
 	sync.Mutex
 }
 
-// NewStats returns a copy of the stats struct
+// NewStats returns a new stats registry serving on port
 func NewStats(port int) *Stats {
 	st := &Stats{
-		Namespaces:  make(map[string]int, 0),
-		NameFetch:   make(map[string]int, 0),
-		NameDetails: make(map[string]int, 0),
-		Zonefiles:   make(map[string]int, 0),
-		Profiles:    make(map[string]int, 0),
-		Status:      newStatus(),
-		Port:        port,
-		statsChan:   make(chan map[string]int, 0),
-		statusChan:  make(chan string, 0),
-	}
-	go st.handleStatsChan()
-	go st.handleStatusChan()
+		Status:    newStatus(),
+		Port:      port,
+		static:    make([]atomic.Int64, len(staticKeys)),
+		latencies: newLatencies(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/idxstats", st.handleStats)
+	mux.HandleFunc("/status", st.handleStatus)
+	mux.HandleFunc("/metrics", st.handleMetrics)
+	st.server = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
 	go st.listen()
 	return st
 }
 
 func (stats *Stats) listen() {
-	http.HandleFunc("/idxstats", stats.handleStats)
-	http.HandleFunc("/status", stats.handleStatus)
 	log.Printf("[stats_server] Listening for signals on port :%d", stats.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", stats.Port), nil))
+	if err := stats.server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops the stats server once the requests in flight have been answered or ctx is done
+func (stats *Stats) Shutdown(ctx context.Context) error {
+	return stats.server.Shutdown(ctx)
+}
+
+// Rec adds v to a counter
+func (stats *Stats) Rec(k CounterKey, v int) {
+	stats.counter(k).Add(int64(v))
+}
+
+// Set sets a gauge to v
+func (stats *Stats) Set(k GaugeKey, v int) {
+	g, ok := stats.gauges.Load(k)
+	if !ok {
+		g, _ = stats.gauges.LoadOrStore(k, new(atomic.Int64))
+	}
+	g.(*atomic.Int64).Store(int64(v))
+}
+
+// Count returns the value of a counter
+func (stats *Stats) Count(k CounterKey) int {
+	return int(stats.counter(k).Load())
+}
+
+func (stats *Stats) counter(k CounterKey) *atomic.Int64 {
+	if k.id > 0 {
+		return &stats.static[k.id-1]
+	}
+	c, ok := stats.counters.Load(k)
+	if !ok {
+		c, _ = stats.counters.LoadOrStore(k, new(atomic.Int64))
+	}
+	return c.(*atomic.Int64)
+}
+
+// Snapshot returns the current value of every counter and gauge by group and name
+func (stats *Stats) Snapshot() map[StatGroup]map[string]int64 {
+	out := make(map[StatGroup]map[string]int64, numStatGroups)
+	for g, values := range stats.values() {
+		out[StatGroup(g)] = make(map[string]int64, len(values))
+		for _, v := range values {
+			out[StatGroup(g)][v.key.key()] = v.value
+		}
+	}
+	return out
 }
 
-// func (stats *Stats) reset() {
-// 	stats.Lock()
-// 	stats.Stats = make(map[string]int, 0)
-// 	stats.Unlock()
-// }
+// statValue is the value of a counter, or of a gauge keyed by its name alone
+type statValue struct {
+	key   CounterKey
+	value int64
+}
 
-// Rec sends a map[string]int to be reorded in the stats
-func (stats *Stats) Rec(k string, v int) {
-	rec := map[string]int{k: v}
-	stats.statsChan <- rec
+// values returns the current value of every counter and gauge by group, sorted by label and name
+func (stats *Stats) values() [numStatGroups][]statValue {
+	out := [numStatGroups][]statValue{}
+	for i, k := range staticKeys {
+		out[k.group] = append(out[k.group], statValue{key: k, value: stats.static[i].Load()})
+	}
+	stats.counters.Range(func(k, v interface{}) bool {
+		ck := k.(CounterKey)
+		out[ck.group] = append(out[ck.group], statValue{key: ck, value: v.(*atomic.Int64).Load()})
+		return true
+	})
+	stats.gauges.Range(func(k, v interface{}) bool {
+		gk := k.(GaugeKey)
+		out[gk.group] = append(out[gk.group], statValue{key: CounterKey{group: gk.group, name: gk.name}, value: v.(*atomic.Int64).Load()})
+		return true
+	})
+	for _, values := range out {
+		sort.Slice(values, func(i, j int) bool {
+			if values[i].key.label != values[j].key.label {
+				return values[i].key.label < values[j].key.label
+			}
+			return values[i].key.name < values[j].key.name
+		})
+	}
+	return out
 }
 
-// UpdateStatus updates the indexer status struct
+// UpdateStatus updates the indexer status struct, st is {index}.{status}
 func (stats *Stats) UpdateStatus(st string) {
-	stats.statusChan <- st
+	statusUpdate := strings.Split(st, ".")
+	stats.Status.Lock()
+	defer stats.Status.Unlock()
+	switch statusUpdate[0] {
+	case "names":
+		stats.Status.NamesIndex = statusUpdate[1]
+	case "zonefiles":
+		stats.Status.ZonefilesIndex = statusUpdate[1]
+	case "profiles":
+		stats.Status.ProfilesIndex = statusUpdate[1]
+	default:
+		log.Println("[stats], failed to update status", st)
+	}
 }
 
-// Stats returns the JSON Marshaled stats
+// statsRoute returns the JSON Marshaled stats
 func (stats *Stats) statsRoute() []byte {
-	stats.Lock()
-	byt, err := json.Marshal(stats)
+	out := make(map[string]interface{}, numStatGroups+1)
+	for g, values := range stats.Snapshot() {
+		out[g.String()] = values
+	}
+	stats.Status.Lock()
+	byt, err := json.Marshal(stats.Status)
+	stats.Status.Unlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	out["status"] = json.RawMessage(byt)
+	byt, err = json.Marshal(out)
 	if err != nil {
 		log.Fatal(err)
 	}
-	stats.Unlock()
 	return byt
 }
 
 func (stats *Stats) statusRoute() []byte {
-	stats.Lock()
+	stats.Status.Lock()
 	byt, err := json.Marshal(stats.Status)
 	if err != nil {
 		log.Fatal(err)
 	}
-	stats.Unlock()
+	stats.Status.Unlock()
 	return byt
 }
 
@@ -118,45 +354,3 @@ func (stats *Stats) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(stats.statusRoute())
 	return
 }
-
-// handleStatsChan handles the stats goroutine
-func (stats *Stats) handleStatsChan() {
-	for st := range stats.statsChan {
-		for k, v := range st {
-			stats.Lock()
-			path := strings.Split(k, ".")
-			switch path[0] {
-			case "profiles":
-				stats.Profiles[path[1]] += v
-			case "zonefiles":
-				stats.Zonefiles[path[1]] += v
-			case "nameFetch":
-				stats.NameFetch[path[1]] += v
-			case "namespaces":
-				stats.Namespaces[path[1]] = v
-			case "nameDetails":
-				stats.NameDetails[path[1]] += v
-			default:
-				log.Println("[stats], failed to record stat", k, v)
-			}
-			stats.Unlock()
-		}
-	}
-}
-
-// handleStatusChan handles the status channel
-func (stats *Stats) handleStatusChan() {
-	for st := range stats.statusChan {
-		statusUpdate := strings.Split(st, ".")
-		stats.Status.Lock()
-		switch statusUpdate[0] {
-		case "names":
-			stats.Status.NamesIndex = statusUpdate[1]
-		case "zonefiles":
-			stats.Status.ZonefilesIndex = statusUpdate[1]
-		case "profiles":
-			stats.Status.ProfilesIndex = statusUpdate[1]
-		}
-		stats.Status.Unlock()
-	}
-}
@@ -0,0 +1,119 @@
+package indexer
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStatsConcurrentRec(t *testing.T) {
+	st := NewStats(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				st.Rec(statProfilesVerified, 1)
+				st.Rec(StatHosts.Labeled("a", "success"), 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if c := st.Count(statProfilesVerified); c != 100000 {
+		t.Fatalf("expected 100000 verified profiles, got %d", c)
+	}
+	if c := st.Count(StatHosts.Labeled("a", "success")); c != 100000 {
+		t.Fatalf("expected 100000 host successes, got %d", c)
+	}
+
+	// A key built from its group is the same counter as the fixed one
+	if c := st.Count(StatProfiles.Counter("verified")); c != 100000 {
+		t.Fatalf("expected the fixed counter by name, got %d", c)
+	}
+
+	// Gauges keep the last value set
+	st.Set(StatNamespaces.Gauge("id_count"), 10)
+	st.Set(StatNamespaces.Gauge("id_count"), 7)
+
+	out := map[string]map[string]int64{}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(st.statsRoute(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	delete(raw, "status")
+	byt, _ := json.Marshal(raw)
+	if err := json.Unmarshal(byt, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["profiles"]["verified"] != 100000 || out["hosts"]["a_success"] != 100000 || out["namespaces"]["id_count"] != 7 {
+		t.Fatalf("unexpected stats %v", out)
+	}
+	// Fixed counters are there before anything is recorded
+	if v, ok := out["blocks"]["full_resyncs"]; !ok || v != 0 {
+		t.Fatalf("expected blocks.full_resyncs to be registered, got %v", out["blocks"])
+	}
+}
+
+// chanStats is the design Stats replaced, every Rec is sent over an unbuffered
+// channel to one goroutine that updates the maps under a lock
+type chanStats struct {
+	groups    map[string]map[string]int
+	statsChan chan map[string]int
+	sync.Mutex
+}
+
+func newChanStats() *chanStats {
+	cs := &chanStats{groups: make(map[string]map[string]int), statsChan: make(chan map[string]int)}
+	for _, g := range statGroupNames {
+		cs.groups[g] = make(map[string]int)
+	}
+	go func() {
+		for st := range cs.statsChan {
+			for k, v := range st {
+				cs.Lock()
+				path := strings.SplitN(k, ".", 2)
+				cs.groups[path[0]][path[1]] += v
+				cs.Unlock()
+			}
+		}
+	}()
+	return cs
+}
+
+func (cs *chanStats) Rec(k string, v int) {
+	cs.statsChan <- map[string]int{k: v}
+}
+
+// The benchmarks record from 100 goroutines per CPU, like the resolvers do
+func BenchmarkStatsRecChannel(b *testing.B) {
+	cs := newChanStats()
+	defer close(cs.statsChan)
+	b.SetParallelism(100)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cs.Rec("profiles.verified", 1)
+		}
+	})
+}
+
+func BenchmarkStatsRecFixed(b *testing.B) {
+	st := NewStats(0)
+	b.SetParallelism(100)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			st.Rec(statProfilesVerified, 1)
+		}
+	})
+}
+
+func BenchmarkStatsRecByName(b *testing.B) {
+	st := NewStats(0)
+	b.SetParallelism(100)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			st.Rec(StatHosts.Labeled("http://core-1:6270", "success"), 1)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package indexer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Subdomain is a name sponsored by an on-chain name, defined by a TXT record in
+// the on-chain name's zonefile, e.g. for alice.id.blockstack in the id.blockstack zonefile:
+//
+//	alice TXT "owner=1MwPD6dH4fE3gQ9mCov81L1DEQWT7E85qH" "seqn=0" "parts=1" "zf0=JE9SSUdJTi..."
+type Subdomain struct {
+	Name     string
+	Owner    string
+	Sequence int
+	Zonefile string
+}
+
+// isSubdomain returns true for names with more than a name and a namespace label
+func isSubdomain(name string) bool {
+	return strings.Count(name, ".") > 1
+}
+
+// parseSubdomains returns the subdomains defined in the TXT records of a domain's zonefile.
+// When a subdomain is defined more than once the highest sequence number wins
+func parseSubdomains(domain, zonefile string) ([]Subdomain, error) {
+	txts, err := zonefileTXT(zonefile)
+	if err != nil {
+		return nil, err
+	}
+	subs := make(map[string]Subdomain)
+	for _, txt := range txts {
+		label := strings.SplitN(txt.Hdr.Name, ".", 2)[0]
+		sub, ok := parseSubdomainTXT(label+"."+domain, txt.Txt)
+		if !ok {
+			continue
+		}
+		if prev, ok := subs[sub.Name]; ok && prev.Sequence > sub.Sequence {
+			continue
+		}
+		subs[sub.Name] = sub
+	}
+	out := make([]Subdomain, 0, len(subs))
+	for _, sub := range subs {
+		out = append(out, sub)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// parseSubdomainTXT reads the key=value strings of a subdomain TXT record, the
+// embedded zonefile is base64 encoded and split across the zf0..zf{parts-1} keys
+func parseSubdomainTXT(name string, strs []string) (Subdomain, bool) {
+	kv := make(map[string]string)
+	for _, s := range strs {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) == 2 {
+			kv[parts[0]] = parts[1]
+		}
+	}
+	parts, err := strconv.Atoi(kv["parts"])
+	if err != nil || kv["owner"] == "" {
+		return Subdomain{}, false
+	}
+	seqn, _ := strconv.Atoi(kv["seqn"])
+	var b64 strings.Builder
+	for i := 0; i < parts; i++ {
+		part, ok := kv[fmt.Sprintf("zf%d", i)]
+		if !ok {
+			return Subdomain{}, false
+		}
+		b64.WriteString(part)
+	}
+	zf, err := base64.StdEncoding.DecodeString(b64.String())
+	if err != nil {
+		return Subdomain{}, false
+	}
+	return Subdomain{Name: name, Owner: kv["owner"], Sequence: seqn, Zonefile: string(zf)}, true
+}
+
+// indexSubdomains stores the subdomains defined in a domain's zonefile as first
+// class names: their zonefiles and owners go in the database and their names are
+// added to the indexer's names. It returns the subdomains it stored
+func (idx *Indexer) indexSubdomains(ctx context.Context, domain, zonefile string) []string {
+	subs, err := parseSubdomains(domain, zonefile)
+	if err != nil {
+		idx.ST.Rec(statZonefilesSubdomainParseError, 1)
+		return []string{}
+	}
+	names := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		if err := idx.DB.UpsertNameZonefile(ctx, sub.Name, zonefileHash(sub.Zonefile), sub.Zonefile); err != nil {
+			idx.log("[zonefiles]", fmt.Sprintf("Failed to insert or update subdomain zonefile: %s %s", sub.Name, err))
+			continue
+		}
+		if err := idx.DB.UpsertNameRecord(ctx, NameRecord{Name: sub.Name, Owner: sub.Owner}); err != nil {
+			idx.log("[zonefiles]", fmt.Sprintf("Failed to insert or update subdomain record: %s %s", sub.Name, err))
+			continue
+		}
+		names = append(names, sub.Name)
+	}
+	if len(names) > 0 {
+		idx.names.add(names)
+		idx.ST.Rec(statZonefilesSubdomains, len(names))
+	}
+	return names
+}
@@ -0,0 +1,103 @@
+package indexer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseSubdomains(t *testing.T) {
+	sub := func(label string, seqn int, zf string) string {
+		return fmt.Sprintf("%s TXT \"owner=1J3PUxY5uDShUnHRrMyU6yKtoHEUPhKULs\" \"seqn=%d\" \"parts=1\" \"zf0=%s\"\n",
+			label, seqn, base64.StdEncoding.EncodeToString([]byte(zf)))
+	}
+	zonefile := "$ORIGIN id.blockstack\n$TTL 3600\n" +
+		sub("alice", 0, "old") +
+		sub("alice", 2, "new") +
+		sub("bob", 0, "bob") +
+		"notasubdomain TXT \"hello\"\n"
+
+	subs, err := parseSubdomains("id.blockstack", zonefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 {
+		t.Fatalf("expected 2 subdomains, got %+v", subs)
+	}
+	if subs[0].Name != "alice.id.blockstack" || subs[0].Sequence != 2 || subs[0].Zonefile != "new" {
+		t.Fatalf("expected the latest alice.id.blockstack, got %+v", subs[0])
+	}
+	if subs[1].Name != "bob.id.blockstack" || subs[1].Owner != "1J3PUxY5uDShUnHRrMyU6yKtoHEUPhKULs" {
+		t.Fatalf("unexpected subdomain %+v", subs[1])
+	}
+}
+
+func TestSubdomainsIndexed(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	carol, dave := testKey(11), testKey(12)
+	fc.addSubdomain("user000.id", "carol", "Carol Subdomain", carol)
+	fc.addSubdomain("user000.id", "dave", "Dave Subdomain", dave)
+	db := NewMemDB()
+	idx := newTestIndexer(t, fc, db, nil)
+
+	idx.GetAllNames(ctx)
+	if n := idx.names.length(); n != len(fc.names())+2 {
+		t.Fatalf("expected sponsored names to be added, got %d names", n)
+	}
+
+	idx.GetAllZonefiles(ctx)
+	zf, err := db.FetchZonefile(ctx, "carol.user000.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls, err := zf.URL(); err != nil || len(urls) != 1 || urls[0].Path != "/hub/carol.user000.id/profile.json" {
+		t.Fatalf("unexpected subdomain zonefile urls %v, err %v", urls, err)
+	}
+	if rec, err := db.FetchNameRecord(ctx, "dave.user000.id"); err != nil || rec.Owner != testAddress(dave) {
+		t.Fatalf("unexpected subdomain record %+v, err %v", rec, err)
+	}
+
+	idx.ResolveIndexerNames(ctx)
+	for name, display := range map[string]string{"carol.user000.id": "Carol Subdomain", "dave.user000.id": "Dave Subdomain"} {
+		p, err := db.FetchProfile(ctx, name)
+		if err != nil || p.Profile.Name != display || !p.Verified() {
+			t.Fatalf("unexpected profile for %s %+v, err %v", name, p, err)
+		}
+	}
+}
+
+func TestSubdomainsSurviveNameSync(t *testing.T) {
+	ctx := context.Background()
+	fc := newTestNetwork(t)
+	fc.addSubdomain("user000.id", "carol", "Carol Subdomain", testKey(11))
+	// Only defined in the domain's zonefile, core doesn't list it
+	fc.Lock()
+	fc.sponsored = nil
+	fc.Unlock()
+	idx := newTestIndexer(t, fc, NewMemDB(), nil)
+
+	idx.GetAllNames(ctx)
+	idx.GetAllZonefiles(ctx)
+	if !idx.names.has("carol.user000.id") {
+		t.Fatal("expected the subdomain to be added from its domain's zonefile")
+	}
+	diff, err := idx.GetAllNames(ctx)
+	if err != nil || len(diff.Removed) != 0 || !idx.names.has("carol.user000.id") {
+		t.Fatalf("expected a complete sync to keep the subdomain, got %+v, err %v", diff, err)
+	}
+
+	// A subdomain goes once its domain does
+	next := make([]string, 0)
+	for _, n := range fc.names() {
+		if n != "user000.id" {
+			next = append(next, n)
+		}
+	}
+	diff = idx.names.sync(next, true)
+	if !reflect.DeepEqual(diff.Removed, []string{"carol.user000.id", "user000.id"}) {
+		t.Fatalf("expected the domain and its subdomain removed, got %+v", diff)
+	}
+}
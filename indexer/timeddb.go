@@ -0,0 +1,126 @@
+package indexer
+
+import (
+	"context"
+	"time"
+)
+
+// timedDB wraps a DB and records the latency of every operation in the stats
+type timedDB struct {
+	DB
+	st *Stats
+}
+
+func (t timedDB) observe(op string, start time.Time) {
+	t.st.Observe(LatencyDB, op, start)
+}
+
+func (t timedDB) Ping(ctx context.Context) error {
+	defer t.observe("Ping", time.Now())
+	return t.DB.Ping(ctx)
+}
+
+func (t timedDB) UpsertNameZonefile(ctx context.Context, name, hash, zonefile string) error {
+	defer t.observe("UpsertNameZonefile", time.Now())
+	return t.DB.UpsertNameZonefile(ctx, name, hash, zonefile)
+}
+
+func (t timedDB) UpsertNameZonefiles(ctx context.Context, zfs []ZonefileRecord) error {
+	defer t.observe("UpsertNameZonefiles", time.Now())
+	return t.DB.UpsertNameZonefiles(ctx, zfs)
+}
+
+func (t timedDB) ZonefilesCount(ctx context.Context) int {
+	defer t.observe("ZonefilesCount", time.Now())
+	return t.DB.ZonefilesCount(ctx)
+}
+
+func (t timedDB) ProfilesCount(ctx context.Context) int {
+	defer t.observe("ProfilesCount", time.Now())
+	return t.DB.ProfilesCount(ctx)
+}
+
+func (t timedDB) FetchZonefile(ctx context.Context, name string) (NameZonefile, error) {
+	defer t.observe("FetchZonefile", time.Now())
+	return t.DB.FetchZonefile(ctx, name)
+}
+
+func (t timedDB) UpsertProfile(ctx context.Context, rec ProfileRecord) error {
+	defer t.observe("UpsertProfile", time.Now())
+	return t.DB.UpsertProfile(ctx, rec)
+}
+
+func (t timedDB) FetchProfile(ctx context.Context, name string) (ProfileRecord, error) {
+	defer t.observe("FetchProfile", time.Now())
+	return t.DB.FetchProfile(ctx, name)
+}
+
+func (t timedDB) EachProfile(ctx context.Context, fn func(rec ProfileRecord) error) error {
+	defer t.observe("EachProfile", time.Now())
+	return t.DB.EachProfile(ctx, fn)
+}
+
+func (t timedDB) UpsertNameRecord(ctx context.Context, rec NameRecord) error {
+	defer t.observe("UpsertNameRecord", time.Now())
+	return t.DB.UpsertNameRecord(ctx, rec)
+}
+
+func (t timedDB) FetchNameRecord(ctx context.Context, name string) (NameRecord, error) {
+	defer t.observe("FetchNameRecord", time.Now())
+	return t.DB.FetchNameRecord(ctx, name)
+}
+
+func (t timedDB) UpsertState(ctx context.Context, key, value string) error {
+	defer t.observe("UpsertState", time.Now())
+	return t.DB.UpsertState(ctx, key, value)
+}
+
+func (t timedDB) FetchState(ctx context.Context, key string) (string, error) {
+	defer t.observe("FetchState", time.Now())
+	return t.DB.FetchState(ctx, key)
+}
+
+func (t timedDB) UpsertDeadLetter(ctx context.Context, dl DeadLetter) error {
+	defer t.observe("UpsertDeadLetter", time.Now())
+	return t.DB.UpsertDeadLetter(ctx, dl)
+}
+
+func (t timedDB) FetchDeadLetter(ctx context.Context, name string) (DeadLetter, error) {
+	defer t.observe("FetchDeadLetter", time.Now())
+	return t.DB.FetchDeadLetter(ctx, name)
+}
+
+func (t timedDB) DeleteDeadLetter(ctx context.Context, name string) error {
+	defer t.observe("DeleteDeadLetter", time.Now())
+	return t.DB.DeleteDeadLetter(ctx, name)
+}
+
+func (t timedDB) EachDeadLetter(ctx context.Context, fn func(dl DeadLetter) error) error {
+	defer t.observe("EachDeadLetter", time.Now())
+	return t.DB.EachDeadLetter(ctx, fn)
+}
+
+func (t timedDB) EachNameRecord(ctx context.Context, fn func(rec NameRecord) error) error {
+	defer t.observe("EachNameRecord", time.Now())
+	return t.DB.EachNameRecord(ctx, fn)
+}
+
+func (t timedDB) PurgeName(ctx context.Context, name string) error {
+	defer t.observe("PurgeName", time.Now())
+	return t.DB.PurgeName(ctx, name)
+}
+
+func (t timedDB) UpsertResolvedAt(ctx context.Context, name string, at time.Time) error {
+	defer t.observe("UpsertResolvedAt", time.Now())
+	return t.DB.UpsertResolvedAt(ctx, name, at)
+}
+
+func (t timedDB) FetchResolvedAt(ctx context.Context, name string) (time.Time, error) {
+	defer t.observe("FetchResolvedAt", time.Now())
+	return t.DB.FetchResolvedAt(ctx, name)
+}
+
+func (t timedDB) EachResolvedAt(ctx context.Context, fn func(name string, t time.Time) error) error {
+	defer t.observe("EachResolvedAt", time.Now())
+	return t.DB.EachResolvedAt(ctx, fn)
+}
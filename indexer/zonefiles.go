@@ -1,78 +1,122 @@
 package indexer
 
 import (
+	"context"
 	"log"
+	"strings"
 	"sync"
+
+	"github.com/jackzampolin/bsk-idx/internal/pipeline"
 )
 
 // GetAllZonefiles saves the current zonefiles to the mongo database
-func (idx *Indexer) GetAllZonefiles() {
-	// chan handles map[zonefileHash]zonefile
-	zonefileHashZonefileChan := make(chan map[string]string, 0)
-	go idx.handleZonefileHashChan(zonefileHashZonefileChan)
-
-	// this is a map[zonefileHash]name
-	zonefileHashNameMap := make(map[string]string, 0)
-	// chan handles map[zonefileHash]name
-	zonefileHashNameChan := make(chan map[string]string, 0)
-	go idx.handleZonefileHashNameChan(zonefileHashNameMap, zonefileHashNameChan, zonefileHashZonefileChan)
-
-	// Limit number of calls to core to idx.Concurrency
-	sem := make(chan struct{}, idx.Conc)
-	var wg sync.WaitGroup
-	for _, name := range idx.names.current() {
-		sem <- struct{}{}
-		go idx.fetchNameDetails(name, zonefileHashNameChan, sem, &wg)
-	}
-
-	wg.Wait()
+func (idx *Indexer) GetAllZonefiles(ctx context.Context) {
+	idx.GetZonefilesFor(ctx, idx.names.current())
 }
 
-// handleZonefileHashChan ranges over the zonefileHashChan and writes name -> zonefile mappings to the database
-func (idx *Indexer) handleZonefileHashChan(zonefileHashChan chan map[string]string) {
-	for zonefileHashes := range zonefileHashChan {
-		keys := make([]string, 0)
-		for k := range zonefileHashes {
-			keys = append(keys, k)
-		}
-		ret, err := idx.GetZonefiles(keys)
-		if err != nil {
-			panic(err)
+// GetZonefilesFor saves the current zonefiles for the passed names to the database and
+// returns the names that need resolving: those whose zonefiles were written, including any
+// subdomains they define, and those that changed hands. Expired and revoked names are purged.
+// Names in namespaces that aren't indexed are skipped. Once ctx is done no more names are
+// looked up but the batches already started are written
+func (idx *Indexer) GetZonefilesFor(ctx context.Context, names []string) []string {
+	// Subdomains aren't on chain, their zonefiles come from their domain's zonefile
+	onChain := make([]string, 0, len(names))
+	for _, name := range idx.config.Namespaces.filter(names) {
+		if !isSubdomain(name) {
+			onChain = append(onChain, name)
 		}
-		zonefiles := ret.Decode()
-		for zfh, zf := range zonefiles {
-			err := idx.DB.UpsertNameZonefile(zonefileHashes[zfh], zf)
+	}
+
+	// Look up idx.Conc names at a time, or as many as a namespace's policy says, batch the
+	// zonefiles that changed and write each batch as it fills
+	var mu sync.Mutex
+	reresolve := make([]string, 0)
+	p := idx.pipeline(ctx)
+	zonefiles := namespaceStage(idx, p, onChain, namespaceOf, stageNameDetails,
+		func(ctx context.Context, name string, emit func(changedZonefile)) error {
+			zf, changed, err := idx.fetchNameDetails(ctx, name)
 			if err != nil {
-				log.Printf("[zonefiles] Failed to insert or update name zonefile: %s %s\n", zonefileHashes[zfh], err)
+				return err
 			}
-		}
+			if changed {
+				mu.Lock()
+				reresolve = append(reresolve, name)
+				mu.Unlock()
+			}
+			if zf.hash != "" {
+				emit(zf)
+			}
+			return nil
+		})
+	batches := pipeline.Batch(zonefiles, stageZonefileBatch, 1, newZonefileBatcher(idx.config).run)
+	writes := pipeline.Stage(batches, stageZonefiles, pipeline.Options{Workers: 1, Drain: true}, idx.writeZonefiles)
+	written := make([]string, 0)
+	pipeline.Sink(writes, func(names []string) { written = append(written, names...) })
+	p.Wait()
+	if len(reresolve) == 0 {
+		return written
 	}
+	return uniq(append(written, reresolve...))
 }
 
-func (idx *Indexer) handleZonefileHashNameChan(zonefileHashNameMap map[string]string, zonefileHashNameChan chan map[string]string, zonefileHashZonefileChan chan map[string]string) {
-	for ret := range zonefileHashNameChan {
-		if len(ret) > 1 {
-			panic("NOT SUPPOSED TO BE HERE: More than 1 map[zfh]name coming down zonefileHashChan")
+// writeZonefiles writes the name -> zonefile mappings of a batch to the database in one write
+// and emits the names it wrote. It runs as a drain stage so ctx isn't cancelled by a shutdown
+// and a batch isn't dropped half way through
+func (idx *Indexer) writeZonefiles(ctx context.Context, batch zonefileBatch, emit func([]string)) error {
+	zfs := make([]ZonefileRecord, 0, len(batch))
+	for zfh, bz := range batch {
+		// Core should only ever return the zonefile the record's hash is of
+		if zonefileHash(bz.zonefile) != zfh {
+			log.Printf("[zonefiles] Zonefile for %s does not match its hash %s\n", strings.Join(bz.names, ", "), zfh)
+			idx.ST.Rec(statZonefilesMismatched, 1)
+			continue
 		}
-		for k, v := range ret {
-			zonefileHashNameMap[k] = v
+		for _, name := range bz.names {
+			zfs = append(zfs, ZonefileRecord{Name: name, Hash: zfh, Zonefile: bz.zonefile})
 		}
-		if len(zonefileHashNameMap) >= 100 {
-			zonefileHashZonefileChan <- zonefileHashNameMap
-			zonefileHashNameMap = make(map[string]string, 0)
+	}
+	// NOTE: A batch that fails is dead lettered and the next carries on
+	if len(zfs) > 0 {
+		if err := idx.DB.UpsertNameZonefiles(ctx, zfs); err != nil {
+			return err
 		}
 	}
+	written := make([]string, 0)
+	for _, zf := range zfs {
+		idx.ST.Rec(statZonefilesChanged, 1)
+		idx.clearDeadLetter(ctx, zf.Name)
+		idx.sched.Changed(zf.Name)
+		written = append(written, zf.Name)
+		written = append(written, idx.indexSubdomains(ctx, zf.Name, zf.Zonefile)...)
+	}
+	for _, name := range written {
+		idx.ST.Rec(namespaceCounter(namespaceOf(name), "zonefiles"), 1)
+	}
+	idx.progressed(ctx)
+	emit(written)
+	return nil
 }
 
-func (idx *Indexer) fetchNameDetails(name string, zonefileHashNameChan chan map[string]string, sem chan struct{}, wg *sync.WaitGroup) {
-	wg.Add(1)
-	res, err := idx.GetNameBlockchainRecord(name)
+// fetchNameDetails looks up and stores the name record. It returns the zonefile that came
+// with it when the zonefile changed since it was last stored, and whether the name needs
+// resolving again whatever its zonefile because its owner or status changed
+func (idx *Indexer) fetchNameDetails(ctx context.Context, name string) (changedZonefile, bool, error) {
+	// NOTE: The call is retried
+	res, err := idx.GetNameBlockchainRecord(ctx, name)
 	if err != nil {
-		panic(err)
+		return changedZonefile{}, false, err
+	}
+	rec, changed := idx.storeNameRecord(ctx, name, res)
+	if !rec.Active() || res.ZonefileHash == "" {
+		idx.clearDeadLetter(ctx, name)
+		return changedZonefile{}, changed, nil
 	}
-	if res.Record.ValueHash != "" {
-		zonefileHashNameChan <- map[string]string{res.Record.ValueHash: name}
+	// Only write zonefiles that changed since they were last stored
+	if stored, err := idx.DB.FetchZonefile(ctx, name); err == nil && stored.Hash() == res.ZonefileHash {
+		idx.ST.Rec(statZonefilesSkipped, 1)
+		idx.clearDeadLetter(ctx, name)
+		return changedZonefile{}, changed, nil
 	}
-	<-sem
-	wg.Done()
+	return changedZonefile{name: name, hash: res.ZonefileHash, zonefile: res.Zonefile}, changed, nil
 }
@@ -0,0 +1,219 @@
+// Package pipeline runs work through typed stages connected by bounded queues. Each
+// stage has its own number of workers, a full queue holds up the stage feeding it, and
+// errors are routed to one handler along with the stage and item they came from
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Metrics is told how much each stage has done and how much is waiting for it. Its
+// methods are called from every worker at once
+type Metrics interface {
+	// Processed is called each time a stage finishes an item without error
+	Processed(stage string)
+	// Failed is called each time a stage returns an error for an item
+	Failed(stage string)
+	// Queued is called with the depth of a stage's queue each time it takes an item
+	Queued(stage string, depth int)
+}
+
+// Error is an item a stage failed on
+type Error struct {
+	Stage string
+	Item  interface{}
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Config configures a Pipeline, both fields are optional
+type Config struct {
+	Metrics Metrics
+	// OnError is called with each failed item, from every worker at once. Drain stages
+	// call it with a ctx that isn't cancelled so a failure during shutdown is still recorded
+	OnError func(ctx context.Context, err *Error)
+}
+
+// Pipeline is a set of stages sharing a context, metrics and error handler
+type Pipeline struct {
+	ctx     context.Context
+	metrics Metrics
+	onError func(ctx context.Context, err *Error)
+
+	wg sync.WaitGroup
+}
+
+// New returns a pipeline whose stages stop taking new work once ctx is done
+func New(ctx context.Context, cfg Config) *Pipeline {
+	return &Pipeline{ctx: ctx, metrics: cfg.Metrics, onError: cfg.OnError}
+}
+
+// Wait blocks until every stage has finished
+func (p *Pipeline) Wait() {
+	p.wg.Wait()
+}
+
+func (p *Pipeline) processed(stage string) {
+	if p.metrics != nil {
+		p.metrics.Processed(stage)
+	}
+}
+
+func (p *Pipeline) queued(stage string, depth int) {
+	if p.metrics != nil {
+		p.metrics.Queued(stage, depth)
+	}
+}
+
+func (p *Pipeline) failed(ctx context.Context, stage string, item interface{}, err error) {
+	if p.metrics != nil {
+		p.metrics.Failed(stage)
+	}
+	if p.onError != nil {
+		p.onError(ctx, &Error{Stage: stage, Item: item, Err: err})
+	}
+}
+
+// Stream is the queue between two stages
+type Stream[T any] struct {
+	p *Pipeline
+	c chan T
+}
+
+// From returns a stream of items, it stops sending once the pipeline's ctx is done
+func From[T any](p *Pipeline, items []T) *Stream[T] {
+	out := &Stream[T]{p: p, c: make(chan T)}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(out.c)
+		for _, item := range items {
+			select {
+			case out.c <- item:
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Options configures a stage
+type Options struct {
+	// Workers is how many items the stage works on at once, at least one
+	Workers int
+	// Buffer is how many items the stage's output queue holds before emit blocks
+	Buffer int
+	// Drain keeps the stage working through its queue once ctx is done, for stages
+	// that write out what earlier stages already fetched. Their fn is passed a ctx that
+	// isn't cancelled with the pipeline's. Other stages drop what is queued
+	Drain bool
+}
+
+// Stage runs fn over every item in in with opts.Workers workers. fn can emit any
+// number of outputs for an item, the returned stream is closed once every worker is done.
+// Errors from fn are counted against name and routed to the pipeline's OnError
+func Stage[In, Out any](in *Stream[In], name string, opts Options, fn func(ctx context.Context, item In, emit func(Out)) error) *Stream[Out] {
+	p := in.p
+	out := &Stream[Out]{p: p, c: make(chan Out, opts.Buffer)}
+	emit := func(v Out) { out.c <- v }
+	ctx := p.ctx
+	if opts.Drain {
+		ctx = context.WithoutCancel(ctx)
+	}
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	p.wg.Add(1)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			// Workers always read in to the end so the stages before never block on a
+			// stage that stopped early
+			for item := range in.c {
+				p.queued(name, len(in.c))
+				if !opts.Drain && p.ctx.Err() != nil {
+					continue
+				}
+				if err := fn(ctx, item, emit); err != nil {
+					p.failed(ctx, name, item, err)
+					continue
+				}
+				p.processed(name)
+			}
+		}()
+	}
+	go func() {
+		defer p.wg.Done()
+		wg.Wait()
+		close(out.c)
+	}()
+	return out
+}
+
+// Batch runs fn once over the whole of in in a single worker, for stages that group or
+// reorder items. fn returns once in is closed, the returned stream is closed after it
+func Batch[In, Out any](in *Stream[In], name string, buffer int, fn func(in <-chan In, emit func(Out))) *Stream[Out] {
+	p := in.p
+	out := &Stream[Out]{p: p, c: make(chan Out, buffer)}
+	emit := func(v Out) {
+		p.queued(name, len(in.c))
+		out.c <- v
+		p.processed(name)
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(out.c)
+		fn(in.c, emit)
+	}()
+	return out
+}
+
+// Sink calls fn with every item in in from a single goroutine, so fn needs no locking
+func Sink[T any](in *Stream[T], fn func(item T)) {
+	in.p.wg.Add(1)
+	go func() {
+		defer in.p.wg.Done()
+		for item := range in.c {
+			fn(item)
+		}
+	}()
+}
+
+// Merge returns a stream of the items of every stream in streams, closed once they all are
+func Merge[T any](p *Pipeline, streams ...*Stream[T]) *Stream[T] {
+	if len(streams) == 1 {
+		return streams[0]
+	}
+	out := &Stream[T]{p: p, c: make(chan T)}
+	var wg sync.WaitGroup
+	wg.Add(len(streams))
+	for _, s := range streams {
+		go func(s *Stream[T]) {
+			defer wg.Done()
+			for item := range s.c {
+				out.c <- item
+			}
+		}(s)
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		wg.Wait()
+		close(out.c)
+	}()
+	return out
+}
@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	processed, failed sync.Map
+	maxDepth          atomic.Int64
+}
+
+func (m *testMetrics) Processed(stage string) { m.count(&m.processed, stage) }
+func (m *testMetrics) Failed(stage string)    { m.count(&m.failed, stage) }
+
+func (m *testMetrics) Queued(stage string, depth int) {
+	for {
+		old := m.maxDepth.Load()
+		if int64(depth) <= old || m.maxDepth.CompareAndSwap(old, int64(depth)) {
+			return
+		}
+	}
+}
+
+func (m *testMetrics) count(counts *sync.Map, stage string) {
+	c, _ := counts.LoadOrStore(stage, new(atomic.Int64))
+	c.(*atomic.Int64).Add(1)
+}
+
+func (m *testMetrics) get(counts *sync.Map, stage string) int64 {
+	c, ok := counts.Load(stage)
+	if !ok {
+		return 0
+	}
+	return c.(*atomic.Int64).Load()
+}
+
+func numbers(n int) []int {
+	out := make([]int, n)
+	for i := range out {
+		out[i] = i
+	}
+	return out
+}
+
+func TestStages(t *testing.T) {
+	m := &testMetrics{}
+	var mu sync.Mutex
+	var failed []interface{}
+	p := New(context.Background(), Config{Metrics: m, OnError: func(ctx context.Context, err *Error) {
+		mu.Lock()
+		failed = append(failed, err.Item)
+		mu.Unlock()
+	}})
+
+	// Odd numbers fail, even ones are emitted twice
+	var running, most atomic.Int64
+	doubled := Stage(From(p, numbers(100)), "double", Options{Workers: 4, Buffer: 2}, func(ctx context.Context, n int, emit func(int)) error {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := most.Load()
+			if now <= old || most.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		if n%2 == 1 {
+			return errors.New("odd")
+		}
+		emit(n)
+		emit(n)
+		return nil
+	})
+	sums := Batch(doubled, "sum", 0, func(in <-chan int, emit func(int)) {
+		sum := 0
+		for n := range in {
+			sum += n
+		}
+		emit(sum)
+	})
+	var got []int
+	Sink(sums, func(n int) { got = append(got, n) })
+	p.Wait()
+
+	if len(got) != 1 || got[0] != 2*2450 {
+		t.Fatalf("expected the even numbers summed twice, got %v", got)
+	}
+	if most.Load() > 4 || most.Load() < 2 {
+		t.Fatalf("expected up to 4 workers at once, got %d", most.Load())
+	}
+	if len(failed) != 50 || m.get(&m.failed, "double") != 50 || m.get(&m.processed, "double") != 50 {
+		t.Fatalf("expected 50 items routed as errors and 50 processed, got %d, %d and %d",
+			len(failed), m.get(&m.failed, "double"), m.get(&m.processed, "double"))
+	}
+	if d := m.maxDepth.Load(); d > 2 {
+		t.Fatalf("expected no queue deeper than its buffer of 2, got %d", d)
+	}
+	if m.get(&m.processed, "sum") != 1 {
+		t.Fatalf("expected one sum, got %d", m.get(&m.processed, "sum"))
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	m := &testMetrics{}
+	p := New(context.Background(), Config{Metrics: m})
+	release := make(chan struct{})
+	var emitted atomic.Int64
+	out := Stage(From(p, numbers(20)), "fast", Options{Workers: 1, Buffer: 3}, func(ctx context.Context, n int, emit func(int)) error {
+		emit(n)
+		emitted.Add(1)
+		return nil
+	})
+	Sink(out, func(int) { <-release })
+
+	// The sink holds one item and the queue three more, the stage is blocked on the fifth
+	time.Sleep(50 * time.Millisecond)
+	if n := emitted.Load(); n != 4 {
+		t.Fatalf("expected the stage held up after 4 items, got %d", n)
+	}
+	close(release)
+	p.Wait()
+	if n := emitted.Load(); n != 20 {
+		t.Fatalf("expected every item through, got %d", n)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New(ctx, Config{})
+	first := make(chan struct{})
+	var once sync.Once
+	fetched := Stage(From(p, numbers(100)), "fetch", Options{Workers: 1, Buffer: 10}, func(ctx context.Context, n int, emit func(int)) error {
+		emit(n)
+		if n == 5 {
+			once.Do(func() { close(first) })
+			<-ctx.Done()
+		}
+		return nil
+	})
+	var mu sync.Mutex
+	written := make([]int, 0)
+	writes := Stage(fetched, "write", Options{Workers: 1, Drain: true}, func(ctx context.Context, n int, emit func(int)) error {
+		<-first
+		emit(n)
+		return nil
+	})
+	Sink(writes, func(n int) {
+		mu.Lock()
+		written = append(written, n)
+		mu.Unlock()
+	})
+	<-first
+	cancel()
+	p.Wait()
+
+	// Everything fetched before the cancel is still written, nothing after it is fetched
+	sort.Ints(written)
+	if len(written) != 6 || written[5] != 5 {
+		t.Fatalf("expected 0 through 5 written, got %v", written)
+	}
+}
+
+func TestDrainContext(t *testing.T) {
+	pctx, cancel := context.WithCancel(context.Background())
+	m := &testMetrics{}
+	p := New(pctx, Config{Metrics: m})
+	first := make(chan struct{})
+	var once sync.Once
+	fetched := Stage(From(p, numbers(100)), "fetch", Options{Workers: 1, Buffer: 10}, func(ctx context.Context, n int, emit func(int)) error {
+		emit(n)
+		if n == 5 {
+			once.Do(func() { close(first) })
+			<-ctx.Done()
+		}
+		return nil
+	})
+	// A write that checks its ctx, like a database call, still succeeds for the items drained
+	writes := Stage(fetched, "write", Options{Workers: 1, Drain: true}, func(ctx context.Context, n int, emit func(int)) error {
+		<-pctx.Done()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		emit(n)
+		return nil
+	})
+	written := 0
+	Sink(writes, func(n int) { written++ })
+	<-first
+	cancel()
+	p.Wait()
+
+	if written != 6 || m.get(&m.processed, "write") != 6 || m.get(&m.failed, "write") != 0 {
+		t.Fatalf("expected the 6 drained items written, got %d written, %d processed and %d failed",
+			written, m.get(&m.processed, "write"), m.get(&m.failed, "write"))
+	}
+}
+
+func TestMerge(t *testing.T) {
+	p := New(context.Background(), Config{})
+	evens := Stage(From(p, numbers(50)), "evens", Options{Workers: 2}, func(ctx context.Context, n int, emit func(int)) error {
+		emit(2 * n)
+		return nil
+	})
+	odds := Stage(From(p, numbers(50)), "odds", Options{Workers: 3}, func(ctx context.Context, n int, emit func(int)) error {
+		emit(2*n + 1)
+		return nil
+	})
+	var got []int
+	Sink(Merge(p, evens, odds), func(n int) { got = append(got, n) })
+	var none []int
+	Sink(Merge[int](p), func(n int) { none = append(none, n) })
+	p.Wait()
+
+	sort.Ints(got)
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("expected 0 through 99 merged, got %v", got)
+		}
+	}
+	if len(got) != 100 || len(none) != 0 {
+		t.Fatalf("expected 100 items merged and none from no streams, got %d and %d", len(got), len(none))
+	}
+}